@@ -13,4 +13,6 @@ type V1ChatCompletionsPost200ResponseChoicesInnerDelta struct {
 	Role string `json:"role,omitempty"`
 
 	Content string `json:"content,omitempty"`
+
+	ToolCalls []V1ChatCompletionsPost200ResponseChoicesInnerDeltaToolCallsInner `json:"tool_calls,omitempty"`
 }
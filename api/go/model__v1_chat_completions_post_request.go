@@ -29,6 +29,9 @@ type V1ChatCompletionsPostRequest struct {
 	// 默认为 false 如果设置,则像在 ChatGPT 中一样会发送部分消息增量。标记将以仅数据的服务器发送事件的形式发送,这些事件在可用时,并在 data: [DONE] 消息终止流。Python 代码示例。
 	Stream bool `json:"stream,omitempty"`
 
+	// 流式响应的选项,仅在 stream 为 true 时设置。
+	StreamOptions *V1ChatCompletionsPostRequestStreamOptions `json:"stream_options,omitempty"`
+
 	// 默认为 inf 在聊天补全中生成的最大标记数。  输入标记和生成标记的总长度受模型的上下文长度限制。计算标记的 Python 代码示例。
 	MaxTokens int32 `json:"max_tokens,omitempty"`
 
@@ -48,8 +51,11 @@ type V1ChatCompletionsPostRequest struct {
 	Seen int32 `json:"seen,omitempty"`
 
 	// 模型可以调用的一组工具列表。目前,只支持作为工具的函数。使用此功能来提供模型可以为之生成 JSON 输入的函数列表。
-	Tools []string `json:"tools,omitempty"`
+	Tools []V1ChatCompletionsPostRequestToolsInner `json:"tools,omitempty"`
 
 	// 控制模型调用哪个函数(如果有的话)。none 表示模型不会调用函数,而是生成消息。auto 表示模型可以在生成消息和调用函数之间进行选择。通过 {\"type\": \"function\", \"function\": {\"name\": \"my_function\"}} 强制模型调用该函数。  如果没有函数存在,默认为 none。如果有函数存在,默认为 auto。  显示可能的类型
-	ToolChoice map[string]interface{} `json:"tool_choice,omitempty"`
+	ToolChoice interface{} `json:"tool_choice,omitempty"`
+
+	// 是否在使用工具时启用并行函数调用。
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
 }
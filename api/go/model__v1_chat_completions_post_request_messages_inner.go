@@ -14,4 +14,12 @@ type V1ChatCompletionsPostRequestMessagesInner struct {
 	Role string `json:"role,omitempty"`
 
 	Content string `json:"content,omitempty"`
+
+	Name string `json:"name,omitempty"`
+
+	// 模型生成的工具调用，例如函数调用。
+	ToolCalls []V1ChatCompletionsPostRequestMessagesInnerToolCallsInner `json:"tool_calls,omitempty"`
+
+	// 此消息所响应的工具调用。
+	ToolCallId string `json:"tool_call_id,omitempty"`
 }
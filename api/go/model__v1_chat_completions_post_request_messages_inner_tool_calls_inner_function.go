@@ -0,0 +1,19 @@
+/*
+ * OpenAI（ChatGPT）
+ *
+ * Open AI（ChatGPT）几乎可以应用于任何涉及理解或生成自然语言或代码的任务。我们提供一系列具有不同功率级别的模型，适用于不同的任务，并且能够微调您自己的自定义模型。这些模型可用于从内容生成到语义搜索和分类的所有领域。  
+ *
+ * API version: 1.0.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package openapi
+
+type V1ChatCompletionsPostRequestMessagesInnerToolCallsInnerFunction struct {
+
+	// 要调用的函数的名称。
+	Name string `json:"name"`
+
+	// 调用函数所用的参数，由模型以 JSON 格式生成。请注意，模型并不总是生成有效的 JSON，并且可能会产生未由函数架构定义的参数。在调用函数之前验证代码中的参数。
+	Arguments string `json:"arguments"`
+}
@@ -0,0 +1,16 @@
+/*
+ * OpenAI（ChatGPT）
+ *
+ * Open AI（ChatGPT）几乎可以应用于任何涉及理解或生成自然语言或代码的任务。我们提供一系列具有不同功率级别的模型，适用于不同的任务，并且能够微调您自己的自定义模型。这些模型可用于从内容生成到语义搜索和分类的所有领域。
+ *
+ * API version: 1.0.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package openapi
+
+type V1ChatCompletionsPostRequestStreamOptions struct {
+
+	// 如果设置,在 data: [DONE] 之前会发送一个额外的块,其 usage 字段包含整个请求的 token 用量,choices 为空数组。
+	IncludeUsage bool `json:"include_usage,omitempty"`
+}
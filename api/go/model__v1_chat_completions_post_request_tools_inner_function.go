@@ -0,0 +1,25 @@
+/*
+ * OpenAI（ChatGPT）
+ *
+ * Open AI（ChatGPT）几乎可以应用于任何涉及理解或生成自然语言或代码的任务。我们提供一系列具有不同功率级别的模型，适用于不同的任务，并且能够微调您自己的自定义模型。这些模型可用于从内容生成到语义搜索和分类的所有领域。  
+ *
+ * API version: 1.0.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package openapi
+
+type V1ChatCompletionsPostRequestToolsInnerFunction struct {
+
+	// 要调用的函数的名称。必须是 a-z、A-Z、0-9，或包含下划线和破折号，最大长度为 64。
+	Name string `json:"name"`
+
+	// 函数功能的描述，模型使用它来选择何时以及如何调用该函数。
+	Description string `json:"description,omitempty"`
+
+	// 函数接受的参数，描述为 JSON Schema 对象。省略参数会定义一个参数列表为空的函数。
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+
+	// 是否在生成函数调用时启用严格的架构遵循。
+	Strict bool `json:"strict,omitempty"`
+}
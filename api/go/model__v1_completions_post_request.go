@@ -47,6 +47,9 @@ type V1CompletionsPostRequest struct {
 	// 默认为false 是否流回部分进度。如果设置,令牌将作为可用时发送为仅数据的服务器发送事件,流由数据 Terminated by a data: [DONE] message. 对象消息终止。 Python代码示例。
 	Stream bool `json:"stream,omitempty"`
 
+	// 流式响应的选项,仅在 stream 为 true 时设置。
+	StreamOptions *V1ChatCompletionsPostRequestStreamOptions `json:"stream_options,omitempty"`
+
 	// 默认为null 在插入文本的补全之后出现的后缀。
 	Suffix string `json:"suffix,omitempty"`
 
@@ -13,7 +13,8 @@ type V1EmbeddingsPost200ResponseDataInner struct {
 
 	Object string `json:"object,omitempty"`
 
-	Embedding []float32 `json:"embedding,omitempty"`
+	// float 数组，或 base64 编码的 float32 小端序列
+	Embedding interface{} `json:"embedding"`
 
-	Index int32 `json:"index,omitempty"`
+	Index int32 `json:"index"`
 }
@@ -15,5 +15,13 @@ type V1EmbeddingsPostRequest struct {
 	Model string `json:"model"`
 
 	// 输入文本以获取嵌入，编码为字符串或标记数组。要在单个请求中获取多个输入的嵌入，请传递一个字符串数组或令牌数组数组。每个输入的长度不得超过 8192 个标记。
-	Input string `json:"input"`
+	Input interface{} `json:"input"`
+
+	// 返回嵌入的格式，float 或 base64。
+	EncodingFormat string `json:"encoding_format,omitempty"`
+
+	// 输出嵌入的维数，仅部分模型支持。
+	Dimensions int32 `json:"dimensions,omitempty"`
+
+	User string `json:"user,omitempty"`
 }
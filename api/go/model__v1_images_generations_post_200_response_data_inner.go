@@ -11,5 +11,9 @@ package openapi
 
 type V1ImagesGenerationsPost200ResponseDataInner struct {
 
-	Url string `json:"url"`
+	Url string `json:"url,omitempty"`
+
+	B64Json string `json:"b64_json,omitempty"`
+
+	RevisedPrompt string `json:"revised_prompt,omitempty"`
 }
@@ -18,4 +18,8 @@ type V1ModelsGet200ResponseDataInner struct {
 	Created int32 `json:"created"`
 
 	OwnedBy string `json:"owned_by"`
+
+	Backend string `json:"backend,omitempty"`
+
+	Capabilities []string `json:"capabilities,omitempty"`
 }
@@ -104,6 +104,30 @@ func getRoutes(handleFunctions ApiHandleFunctions) []Route {
 			"/v1/completions",
 			handleFunctions.CompletionsAPI.V1CompletionsPost,
 		},
+		{
+			"V1EmbeddingsPost",
+			http.MethodPost,
+			"/v1/embeddings",
+			handleFunctions.EmbeddingsAPI.V1EmbeddingsPost,
+		},
+		{
+			"V1ImagesEditsPost",
+			http.MethodPost,
+			"/v1/images/edits",
+			handleFunctions.ImagesAPI.V1ImagesEditsPost,
+		},
+		{
+			"V1ImagesGenerationsPost",
+			http.MethodPost,
+			"/v1/images/generations",
+			handleFunctions.ImagesAPI.V1ImagesGenerationsPost,
+		},
+		{
+			"V1ImagesVariationsPost",
+			http.MethodPost,
+			"/v1/images/variations",
+			handleFunctions.ImagesAPI.V1ImagesVariationsPost,
+		},
 		{
 			"V1ModelsGet",
 			http.MethodGet,
@@ -113,7 +137,7 @@ func getRoutes(handleFunctions ApiHandleFunctions) []Route {
 		{
 			"V1ModelsModelGet",
 			http.MethodGet,
-			"/v1/models/:model",
+			"/v1/models/*model",
 			handleFunctions.ModelsAPI.V1ModelsModelGet,
 		},
 	}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/mux/merlin"
+	"k8s.io/klog/v2"
+)
+
+const (
+	adminRequired   = "admin_required"
+	backendNotFound = "backend_not_found"
+)
+
+// backendPatch change one backend, nil fields are kept
+type backendPatch struct {
+	Disabled *bool `json:"disabled,omitempty"`
+	Index    *int  `json:"index,omitempty"`
+}
+
+// RegisterAdmin add the admin api, only the admin keys are allowed
+func (ca *Controller) RegisterAdmin(e *gin.Engine) {
+	g := e.Group("/admin", adminOnly)
+	g.GET("/backends", ca.AdminBackends)
+	g.PATCH("/backends", ca.AdminPatch)
+	g.PATCH("/backends/:name", ca.AdminPatchOne)
+	g.POST("/backends/:name/reset", ca.AdminReset)
+	g.POST("/backends/:name/login", ca.AdminLogin)
+	g.GET("/backends/:name/accounts", ca.AdminAccounts)
+}
+
+func adminOnly(c *gin.Context) {
+	if k := Tenant(c.Request.Context()); k == nil || !k.Admin {
+		abortWithError(c, http.StatusForbidden, permissionErr, adminRequired, "The admin api requires an admin key")
+		return
+	}
+	c.Next()
+}
+
+// AdminBackends Get /admin/backends
+// backends in routing order with runtime settings
+func (ca *Controller) AdminBackends(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"backends": ca.backends(),
+		"failed":   ca.Failed(),
+	})
+}
+
+// AdminPatch Patch /admin/backends
+// change backends by name, all or none are applied
+func (ca *Controller) AdminPatch(c *gin.Context) {
+	var patches map[string]*backendPatch
+	if err := c.ShouldBindJSON(&patches); err != nil {
+		abortWithError(c, http.StatusBadRequest, invalidRequestErr, "", err.Error())
+		return
+	}
+	ca.patch(c, patches)
+}
+
+// AdminPatchOne Patch /admin/backends/:name
+func (ca *Controller) AdminPatchOne(c *gin.Context) {
+	p := &backendPatch{}
+	if err := c.ShouldBindJSON(p); err != nil {
+		abortWithError(c, http.StatusBadRequest, invalidRequestErr, "", err.Error())
+		return
+	}
+	ca.patch(c, map[string]*backendPatch{c.Param("name"): p})
+}
+
+// patch apply the changes to a new router and swap it,
+// requests in flight keep the old one.
+func (ca *Controller) patch(c *gin.Context, patches map[string]*backendPatch) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	var (
+		router   = ca.Router()
+		settings = router.Settings()
+	)
+	for name, p := range patches {
+		if router.Lookup(name) == nil {
+			abortWithError(c, http.StatusNotFound, invalidRequestErr, backendNotFound,
+				fmt.Sprintf("The backend '%s' does not exist", name))
+			return
+		}
+		if p == nil {
+			continue
+		}
+		s, ok := settings[name]
+		if !ok {
+			s = &mux.Setting{}
+			settings[name] = s
+		}
+		if p.Disabled != nil {
+			s.Disabled = *p.Disabled
+		}
+		if p.Index != nil {
+			index := *p.Index
+			s.Index = &index
+		}
+	}
+	ca.router.Store(router.With(settings))
+	klog.Infof("admin '%s' changed backends: %v", Tenant(c.Request.Context()), settings)
+	c.JSON(http.StatusOK, gin.H{
+		"backends": ca.backends(),
+	})
+}
+
+// AdminReset Post /admin/backends/:name/reset
+// close the circuit and clear the failures
+func (ca *Controller) AdminReset(c *gin.Context) {
+	m, ok := ca.backend(c)
+	if !ok {
+		return
+	}
+	ca.Router().Health(m).Reset()
+	klog.Infof("admin '%s' reset backend '%s'", Tenant(c.Request.Context()), m.Name())
+	c.JSON(http.StatusOK, ca.Router().Health(m).Status())
+}
+
+// AdminLogin Post /admin/backends/:name/login
+// refresh the tokens of account backend, the circuit is closed on success
+func (ca *Controller) AdminLogin(c *gin.Context) {
+	m, ok := ca.backend(c)
+	if !ok {
+		return
+	}
+	am, ok := m.(mux.Authenticator)
+	if !ok {
+		abortWithError(c, http.StatusBadRequest, invalidRequestErr, "",
+			fmt.Sprintf("The backend '%s' has no login", m.Name()))
+		return
+	}
+	if err := am.Login(c.Request.Context()); err != nil {
+		klog.Warningf("admin login backend '%s' failed: %v", m.Name(), err)
+		abortWithAttempts(c, []*attempt{newAttempt(m.Name(), err)})
+		return
+	}
+	ca.Router().Health(m).Reset()
+	klog.Infof("admin '%s' login backend '%s'", Tenant(c.Request.Context()), m.Name())
+	c.JSON(http.StatusOK, am.Credential())
+}
+
+// AdminAccounts Get /admin/backends/:name/accounts
+// the merlin accounts in queue order
+func (ca *Controller) AdminAccounts(c *gin.Context) {
+	m, ok := ca.backend(c)
+	if !ok {
+		return
+	}
+	ml, ok := m.(*merlin.Merlin)
+	if !ok {
+		abortWithError(c, http.StatusBadRequest, invalidRequestErr, "",
+			fmt.Sprintf("The backend '%s' has no accounts", m.Name()))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"accounts": ml.Accounts(),
+	})
+}
+
+func (ca *Controller) backend(c *gin.Context) (mux.Model, bool) {
+	m := ca.Router().Lookup(c.Param("name"))
+	if m == nil {
+		abortWithError(c, http.StatusNotFound, invalidRequestErr, backendNotFound,
+			fmt.Sprintf("The backend '%s' does not exist", c.Param("name")))
+		return nil, false
+	}
+	return m, true
+}
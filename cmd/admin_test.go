@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	api "github.com/yylt/gptmux/api/go"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/mux/mock"
+	"github.com/yylt/gptmux/pkg"
+)
+
+const (
+	adminKey = "sk-admin-0001"
+	userKey  = "sk-user-0002"
+)
+
+func TestAdmin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		a = mock.New(&mock.Conf{Models: []string{"gpt-4o"}, Script: []string{"a"}, Index: 2,
+			Fail: &mock.Fail{Class: pkg.ClassUpstream, Times: 1}, Options: mux.Options{Name: "a"}})
+		b  = mock.New(&mock.Conf{Models: []string{"gpt-4o"}, Script: []string{"b"}, Index: 1, Options: mux.Options{Name: "b"}})
+		ca = NewController(ctx, false, nil, a, b)
+	)
+	auth, err := NewAuth(&AuthConf{Keys: []*ApiKey{
+		{Key: adminKey, Name: "admin", Admin: true},
+		{Key: userKey, Name: "user"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEngine(ca, auth.Handler)
+	ca.RegisterAdmin(e)
+
+	answer := func() string {
+		t.Helper()
+		bs, _ := json.Marshal(&api.V1ChatCompletionsPostRequest{
+			Model:    "gpt-4o",
+			Messages: []api.V1ChatCompletionsPostRequestMessagesInner{{Role: "user", Content: "hi"}},
+		})
+		w := do(e, http.MethodPost, "/v1/chat/completions", userKey, string(bs))
+		var resp api.V1ChatCompletionsPost200Response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Choices) == 0 {
+			t.Fatalf("chat answer %d %s", w.Code, w.Body.String())
+		}
+		return resp.Choices[0].Message.Content
+	}
+	backends := func(w *httptest.ResponseRecorder) map[string]*backendStatus {
+		t.Helper()
+		var resp struct {
+			Backends []*backendStatus `json:"backends"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		ret := map[string]*backendStatus{}
+		for _, st := range resp.Backends {
+			ret[st.Name] = st
+		}
+		return ret
+	}
+
+	// the admin api require an admin key
+	if w := do(e, http.MethodGet, "/admin/backends", userKey, ""); w.Code != http.StatusForbidden || errorCode(t, w) != adminRequired {
+		t.Fatalf("user key get admin api %d %s", w.Code, w.Body.String())
+	}
+
+	// a failed once, the request fail over to b
+	if got := answer(); got != "b" {
+		t.Fatalf("answer '%s', want 'b' after a failed", got)
+	}
+	w := do(e, http.MethodGet, "/admin/backends", adminKey, "")
+	if st := backends(w)["a"]; w.Code != http.StatusOK || st == nil || st.Failures != 1 {
+		t.Fatalf("admin backends %d %s", w.Code, w.Body.String())
+	}
+
+	// reset clear the failures
+	w = do(e, http.MethodPost, "/admin/backends/a/reset", adminKey, "")
+	var st mux.HealthStatus
+	if err = json.Unmarshal(w.Body.Bytes(), &st); err != nil || st.Failures != 0 || st.State != mux.CircuitClosed {
+		t.Fatalf("reset backend %d %s", w.Code, w.Body.String())
+	}
+	if got := answer(); got != "a" {
+		t.Fatalf("answer '%s', want 'a' after reset", got)
+	}
+
+	// a patch with an unknown backend change nothing
+	w = do(e, http.MethodPatch, "/admin/backends", adminKey, `{"a": {"disabled": true}, "c": {"index": 9}}`)
+	if w.Code != http.StatusNotFound || errorCode(t, w) != backendNotFound {
+		t.Fatalf("patch unknown backend %d %s", w.Code, w.Body.String())
+	}
+	if got := answer(); got != "a" {
+		t.Fatalf("answer '%s', want 'a' after a failed patch", got)
+	}
+
+	// disable a, and b is used
+	w = do(e, http.MethodPatch, "/admin/backends/a", adminKey, `{"disabled": true}`)
+	if st := backends(w)["a"]; w.Code != http.StatusOK || st == nil || !st.Disabled || st.Routable {
+		t.Fatalf("disable backend %d %s", w.Code, w.Body.String())
+	}
+	if got := answer(); got != "b" {
+		t.Fatalf("answer '%s', want 'b' after a is disabled", got)
+	}
+
+	// enable a with a lower index, b is still first
+	w = do(e, http.MethodPatch, "/admin/backends/a", adminKey, `{"disabled": false, "index": 0}`)
+	if st := backends(w)["a"]; w.Code != http.StatusOK || st == nil || st.Disabled || st.Index != 0 {
+		t.Fatalf("patch index %d %s", w.Code, w.Body.String())
+	}
+	if got := answer(); got != "b" {
+		t.Fatalf("answer '%s', want 'b' after a index is lowered", got)
+	}
+
+	// mock has no login
+	if w = do(e, http.MethodPost, "/admin/backends/a/login", adminKey, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("login backend without login %d", w.Code)
+	}
+	if w = do(e, http.MethodPost, "/admin/backends/c/reset", adminKey, ""); w.Code != http.StatusNotFound {
+		t.Errorf("reset unknown backend %d", w.Code)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yylt/gptmux/mux"
+	"gopkg.in/yaml.v3"
+	"k8s.io/klog/v2"
+)
+
+const (
+	invalidApiKey   = "invalid_api_key"
+	permissionErr   = "permission_error"
+	modelNotAllowed = "model_not_allowed"
+)
+
+// AuthConf of gptmux endpoints, without any key the endpoints are open.
+// keyfile is a yaml list of keys.
+type AuthConf struct {
+	Keys    []*ApiKey `yaml:"keys,omitempty"`
+	KeyFile string    `yaml:"keyfile,omitempty"`
+}
+
+// ApiKey is a caller of gptmux, empty models or backends allow all.
+// models can be glob patterns, language overwrite the backend policy.
+// admin key can use the admin api.
+type ApiKey struct {
+	Key      string        `yaml:"key"`
+	Name     string        `yaml:"name"`
+	Models   []string      `yaml:"models,omitempty"`
+	Backends []string      `yaml:"backends,omitempty"`
+	Disabled bool          `yaml:"disabled,omitempty"`
+	Admin    bool          `yaml:"admin,omitempty"`
+	Language *mux.Language `yaml:"language,omitempty"`
+	Limit    *Limit        `yaml:"limit,omitempty"`
+}
+
+type tenantKey struct{}
+
+// Tenant return the caller key of request, nil when auth is off
+func Tenant(ctx context.Context) *ApiKey {
+	k, _ := ctx.Value(tenantKey{}).(*ApiKey)
+	return k
+}
+
+// AllowModel report whether the model can be requested
+func (k *ApiKey) AllowModel(model string) bool {
+	if k == nil || len(k.Models) == 0 {
+		return true
+	}
+	for _, p := range k.Models {
+		if ok, _ := path.Match(p, model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowBackend report whether the backend can be used
+func (k *ApiKey) AllowBackend(name string) bool {
+	return k == nil || len(k.Backends) == 0 || slices.Contains(k.Backends, name)
+}
+
+// Id return the hash of key, names may be duplicated or change on reload
+func (k *ApiKey) Id() string {
+	sum := sha256.Sum256([]byte(k.Key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// String hide the key
+func (k *ApiKey) String() string {
+	if k == nil {
+		return "anonymous"
+	}
+	return k.Name
+}
+
+type Auth struct {
+	keys map[string]*ApiKey
+}
+
+// NewAuth return nil when no key is configured
+func NewAuth(c *AuthConf) (*Auth, error) {
+	if c == nil {
+		return nil, nil
+	}
+	keys := append([]*ApiKey(nil), c.Keys...)
+	if c.KeyFile != "" {
+		bs, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read key file %s failed: %v", c.KeyFile, err)
+		}
+		var fks []*ApiKey
+		if err = yaml.Unmarshal(bs, &fks); err != nil {
+			return nil, fmt.Errorf("parse key file %s failed: %v", c.KeyFile, err)
+		}
+		keys = append(keys, fks...)
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	a := &Auth{keys: map[string]*ApiKey{}}
+	for i, k := range keys {
+		if k == nil || k.Key == "" {
+			return nil, fmt.Errorf("key %d is empty", i)
+		}
+		if _, ok := a.keys[k.Key]; ok {
+			return nil, fmt.Errorf("key '%s' is duplicated", k.Name)
+		}
+		if k.Name == "" {
+			k.Name = fmt.Sprintf("key-%d", i)
+		}
+		a.keys[k.Key] = k
+	}
+	klog.Infof("auth enabled, %d keys", len(a.keys))
+	return a, nil
+}
+
+// Handler validate the bearer key and attach the caller to request context
+func (a *Auth) Handler(c *gin.Context) {
+	if a == nil {
+		c.Next()
+		return
+	}
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	token = strings.TrimSpace(token)
+	if !ok || token == "" {
+		abortWithError(c, http.StatusUnauthorized, invalidRequestErr, "",
+			"You didn't provide an API key. You need to provide your API key in an Authorization header using Bearer auth (i.e. Authorization: Bearer YOUR_KEY)")
+		return
+	}
+	k, ok := a.keys[token]
+	if !ok {
+		abortWithError(c, http.StatusUnauthorized, invalidRequestErr, invalidApiKey,
+			fmt.Sprintf("Incorrect API key provided: %s", maskKey(token)))
+		return
+	}
+	if k.Disabled {
+		abortWithError(c, http.StatusUnauthorized, invalidRequestErr, invalidApiKey,
+			fmt.Sprintf("API key '%s' is disabled", k.Name))
+		return
+	}
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), tenantKey{}, k))
+	c.Next()
+}
+
+func maskKey(s string) string {
+	if len(s) <= 8 {
+		return "****"
+	}
+	return s[:3] + "****" + s[len(s)-4:]
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// do send a request with the bearer key, empty key send none
+func do(e *gin.Engine, method, path, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+	return w
+}
+
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var resp errorResp
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode error %s failed: %v", w.Body.String(), err)
+	}
+	return resp.Error.Code
+}
+
+func TestNewAuth(t *testing.T) {
+	keyfile := filepath.Join(t.TempDir(), "keys.yaml")
+	if err := os.WriteFile(keyfile, []byte("- {key: sk-file, name: file}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		conf *AuthConf
+		keys int
+		err  string
+	}{
+		{name: "nil"},
+		{name: "no key", conf: &AuthConf{}},
+		{name: "keys", conf: &AuthConf{Keys: []*ApiKey{{Key: "sk-a"}, {Key: "sk-b"}}}, keys: 2},
+		{name: "keyfile", conf: &AuthConf{Keys: []*ApiKey{{Key: "sk-a"}}, KeyFile: keyfile}, keys: 2},
+		{name: "missing keyfile", conf: &AuthConf{KeyFile: keyfile + ".missing"}, err: "read key file"},
+		{name: "empty key", conf: &AuthConf{Keys: []*ApiKey{{Name: "a"}}}, err: "key 0 is empty"},
+		{name: "duplicated", conf: &AuthConf{Keys: []*ApiKey{{Key: "sk-a"}, {Key: "sk-a", Name: "b"}}}, err: "'b' is duplicated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewAuth(tt.conf)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error '%v', want '%s'", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.keys == 0 {
+				if a != nil {
+					t.Fatal("auth is on without keys")
+				}
+				return
+			}
+			if len(a.keys) != tt.keys {
+				t.Fatalf("%d keys, want %d", len(a.keys), tt.keys)
+			}
+			// the unnamed keys get a name
+			for _, k := range a.keys {
+				if k.Name == "" {
+					t.Errorf("key %s has no name", maskKey(k.Key))
+				}
+			}
+		})
+	}
+}
+
+func TestAuthHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	a, err := NewAuth(&AuthConf{Keys: []*ApiKey{
+		{Key: "sk-alice-0001", Name: "alice"},
+		{Key: "sk-bob-0002", Name: "bob", Disabled: true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := gin.New()
+	e.Use(a.Handler)
+	e.GET("/v1/models", func(c *gin.Context) {
+		c.String(http.StatusOK, Tenant(c.Request.Context()).String())
+	})
+
+	tests := []struct {
+		name string
+		key  string
+		code int
+		want string
+	}{
+		{name: "valid", key: "sk-alice-0001", code: http.StatusOK, want: "alice"},
+		{name: "missing", code: http.StatusUnauthorized},
+		{name: "unknown", key: "sk-eve-0003", code: http.StatusUnauthorized, want: invalidApiKey},
+		{name: "disabled", key: "sk-bob-0002", code: http.StatusUnauthorized, want: invalidApiKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(e, http.MethodGet, "/v1/models", tt.key, "")
+			if w.Code != tt.code {
+				t.Fatalf("status %d, want %d", w.Code, tt.code)
+			}
+			got := w.Body.String()
+			if w.Code != http.StatusOK {
+				got = errorCode(t, w)
+				// the unknown key is masked in message
+				if strings.Contains(w.Body.String(), tt.key) && tt.key != "" {
+					t.Errorf("error %s has the key", w.Body.String())
+				}
+			}
+			if got != tt.want {
+				t.Errorf("got '%s', want '%s'", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApiKeyAllow(t *testing.T) {
+	var (
+		k = &ApiKey{Models: []string{"gpt-*", "glm-4"}, Backends: []string{"a"}}
+		// without auth all are allowed
+		anonymous *ApiKey
+	)
+	for model, want := range map[string]bool{"gpt-4o": true, "glm-4": true, "glm-4-plus": false, "qwen": false} {
+		if got := k.AllowModel(model); got != want {
+			t.Errorf("model '%s' allowed %v, want %v", model, got, want)
+		}
+		if !anonymous.AllowModel(model) {
+			t.Errorf("model '%s' is not allowed without auth", model)
+		}
+	}
+	if !k.AllowBackend("a") || k.AllowBackend("b") || !anonymous.AllowBackend("b") {
+		t.Error("backends are allowed wrongly")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	api "github.com/yylt/gptmux/api/go"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/pkg/cache"
+)
+
+const (
+	// backend name of the answers from cache in records
+	cacheBackend = "cache"
+
+	cacheHit    = "hit"
+	cacheMiss   = "miss"
+	cacheBypass = "bypass"
+)
+
+// cacheMessage is the normalized message of cache key
+type cacheMessage struct {
+	Role       string                                                        `json:"role"`
+	Name       string                                                        `json:"name,omitempty"`
+	Content    string                                                        `json:"content"`
+	ToolCalls  []api.V1ChatCompletionsPostRequestMessagesInnerToolCallsInner `json:"tool_calls,omitempty"`
+	ToolCallId string                                                        `json:"tool_call_id,omitempty"`
+}
+
+// cacheKey return the key of chat request, empty when the cache is off
+// or bypassed by temperature and Cache-Control: no-store or no-cache,
+// the answer is neither looked up nor saved.
+func (ca *Controller) cacheKey(c *gin.Context, body *api.V1ChatCompletionsPostRequest, lang *mux.Language) string {
+	if ca.cache == nil {
+		return ""
+	}
+	if cacheControl(c, "no-store") || cacheControl(c, "no-cache") || !ca.cache.Allow(float64(body.Temperature)) {
+		cacheRequests.WithLabelValues(cacheBypass).Inc()
+		return ""
+	}
+	msgs := make([]cacheMessage, 0, len(body.Messages))
+	for _, m := range body.Messages {
+		msgs = append(msgs, cacheMessage{
+			Role:       strings.ToLower(strings.TrimSpace(m.Role)),
+			Name:       m.Name,
+			Content:    strings.TrimSpace(m.Content),
+			ToolCalls:  m.ToolCalls,
+			ToolCallId: m.ToolCallId,
+		})
+	}
+	return cache.Key(map[string]any{
+		"model":             body.Model,
+		"messages":          msgs,
+		"temperature":       body.Temperature,
+		"top_p":             body.TopP,
+		"max_tokens":        body.MaxTokens,
+		"presence_penalty":  body.PresencePenalty,
+		"frequency_penalty": body.FrequencyPenalty,
+		"response_format":   body.ResponseFormat,
+		"seed":              body.Seen,
+		"tools":             body.Tools,
+		"tool_choice":       body.ToolChoice,
+		"language":          lang,
+	})
+}
+
+// cached return the saved answer of key, the answer of a backend which
+// the caller can not use is a miss.
+func (ca *Controller) cached(c *gin.Context, key string) (*cache.Entry, bool) {
+	if key == "" {
+		return nil, false
+	}
+	e, ok := ca.cache.Get(key)
+	if ok && !Tenant(c.Request.Context()).AllowBackend(e.Backend) {
+		ok = false
+	}
+	if !ok {
+		cacheRequests.WithLabelValues(cacheMiss).Inc()
+		return nil, false
+	}
+	cacheRequests.WithLabelValues(cacheHit).Inc()
+	return e, true
+}
+
+// replayCached send the cached answer as the backend would
+func replayCached(c *gin.Context, sw *streamWriter, ret *api.V1ChatCompletionsPost200Response, body *api.V1ChatCompletionsPostRequest, e *cache.Entry) {
+	u := &api.V1ChatCompletionsPost200ResponseUsage{
+		PromptTokens:     int32(e.PromptTokens),
+		CompletionTokens: int32(e.CompletionTokens),
+		TotalTokens:      int32(e.PromptTokens + e.CompletionTokens),
+	}
+	sw.rec.Done(cacheBackend, e.Text, e.FinishReason)
+	if body.Stream {
+		chunks := e.Chunks
+		if len(chunks) == 0 {
+			chunks = []string{e.Text}
+		}
+		for _, ch := range chunks {
+			if err := sw.Write(ch); err != nil {
+				return
+			}
+		}
+		sw.Finish(e.FinishReason, streamUsage(body.StreamOptions, u))
+		return
+	}
+	ret.Choices = []api.V1ChatCompletionsPost200ResponseChoicesInner{
+		{
+			Message: api.V1ChatCompletionsPost200ResponseChoicesInnerDelta{
+				Role:    mux.RoleAssistant,
+				Content: e.Text,
+			},
+			FinishReason: e.FinishReason,
+		},
+	}
+	ret.Usage = *u
+	c.JSON(http.StatusOK, ret)
+}
+
+// store save the answer of backend, tool calls are not cached
+func (ca *Controller) store(key, backend, text string, chunks []string, reason string, u *api.V1ChatCompletionsPost200ResponseUsage) {
+	if key == "" || text == "" || reason == "tool_calls" {
+		return
+	}
+	ca.cache.Put(&cache.Entry{
+		Key:              key,
+		Backend:          backend,
+		Text:             text,
+		Chunks:           chunks,
+		FinishReason:     reason,
+		PromptTokens:     int(u.PromptTokens),
+		CompletionTokens: int(u.CompletionTokens),
+	})
+}
+
+// cacheControl report whether the Cache-Control header of request has directive
+func cacheControl(c *gin.Context, directive string) bool {
+	for _, d := range strings.Split(c.GetHeader("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(d), directive) {
+			return true
+		}
+	}
+	return false
+}
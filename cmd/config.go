@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/yylt/gptmux/mux"
 	"github.com/yylt/gptmux/mux/claude"
 	"github.com/yylt/gptmux/mux/deepseek"
 	"github.com/yylt/gptmux/mux/merlin"
@@ -11,20 +13,35 @@ import (
 	"github.com/yylt/gptmux/mux/openai"
 	"github.com/yylt/gptmux/mux/rkllm"
 	"github.com/yylt/gptmux/mux/zhipu"
+	"github.com/yylt/gptmux/pkg/cache"
+	"github.com/yylt/gptmux/pkg/record"
+	"github.com/yylt/gptmux/pkg/tracing"
 	"gopkg.in/yaml.v3"
 )
 
+// Config of gptmux, backends are declared in providers,
+// the top-level backend keys are kept for compatibility.
 type Config struct {
-	Merlin      merlin.Config `yaml:"merlin,omitempty"`
-	Claude      claude.Conf   `yaml:"claude,omitempty"`
-	Ollama      ollama.Config `yaml:"ollama,omitempty"`
-	Deepseek    deepseek.Conf `yaml:"deepseek,omitempty"`
-	DeepseekApi openai.Conf   `yaml:"deepseekapi,omitempty"`
-	Rkllm       rkllm.Conf    `yaml:"rkllm,omitempty"`
-	Zhipu       zhipu.Conf    `yaml:"zhipu,omitempty"`
-	Silicon     openai.Conf   `yaml:"silicon,omitempty"`
-	Addr        string        `yaml:"address"`
-	Debug       bool          `yaml:"debug"`
+	Merlin      merlin.Config   `yaml:"merlin,omitempty"`
+	Claude      claude.Conf     `yaml:"claude,omitempty"`
+	Ollama      ollama.Config   `yaml:"ollama,omitempty"`
+	Deepseek    deepseek.Conf   `yaml:"deepseek,omitempty"`
+	DeepseekApi openai.Conf     `yaml:"deepseekapi,omitempty"`
+	Rkllm       rkllm.Conf      `yaml:"rkllm,omitempty"`
+	Zhipu       zhipu.Conf      `yaml:"zhipu,omitempty"`
+	Silicon     openai.Conf     `yaml:"silicon,omitempty"`
+	Providers   []*Provider     `yaml:"providers,omitempty"`
+	Routes      []*mux.Route    `yaml:"routes,omitempty"`
+	Auth        *AuthConf       `yaml:"auth,omitempty"`
+	Limits      *LimitConf      `yaml:"limits,omitempty"`
+	Record      *record.Conf    `yaml:"record,omitempty"`
+	Cache       *cache.Conf     `yaml:"cache,omitempty"`
+	Intent      *mux.IntentConf `yaml:"intent,omitempty"`
+	Trace       *tracing.Conf   `yaml:"trace,omitempty"`
+	Addr        string          `yaml:"address"`
+	FailFast    bool            `yaml:"fail_fast,omitempty"`
+	Drain       time.Duration   `yaml:"drain_timeout,omitempty"`
+	Debug       bool            `yaml:"debug"`
 }
 
 // LoadConfigmap reads configmap data from config-path
@@ -44,3 +61,21 @@ func LoadConfigmap(fp string) (*Config, error) {
 
 	return cfg, nil
 }
+
+// legacy return the providers of the top-level backend keys
+func (c *Config) legacy() []*Provider {
+	// deepseekapi and silicon are both openai, keep them apart
+	if c.Silicon.Name == "" {
+		c.Silicon.Name = "silicon"
+	}
+	return []*Provider{
+		{Type: "deepseek", conf: &c.Deepseek},
+		{Type: "merlin", conf: &c.Merlin},
+		{Type: "zhipu", conf: &c.Zhipu},
+		{Type: "openai", conf: &c.DeepseekApi},
+		{Type: "claude", conf: &c.Claude},
+		{Type: "rkllm", conf: &c.Rkllm},
+		{Type: "ollama", conf: &c.Ollama},
+		{Type: "openai", conf: &c.Silicon},
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	api "github.com/yylt/gptmux/api/go"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/pkg"
+	"github.com/yylt/gptmux/pkg/tracing"
+	"github.com/yylt/gptmux/pkg/util"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
+)
+
+const (
+	embeddingObject = "embedding"
+	listObject      = "list"
+
+	// endpoint label of metrics
+	embeddingEndpoint = "embedding"
+
+	formatFloat  = "float"
+	formatBase64 = "base64"
+)
+
+// V1EmbeddingsPost Post /v1/embeddings
+// 创建嵌入
+func (ca *Controller) V1EmbeddingsPost(c *gin.Context) {
+	var (
+		body         = &api.V1EmbeddingsPostRequest{}
+		attempts     []*attempt
+		rctx, cancle = context.WithCancel(c.Request.Context())
+	)
+	defer cancle()
+	defer context.AfterFunc(ca.drain, cancle)()
+
+	if err := c.ShouldBindBodyWithJSON(body); err != nil {
+		abortWithError(c, http.StatusBadRequest, invalidRequestErr, "", err.Error())
+		return
+	}
+	input, err := embedInput(body.Input)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, invalidRequestErr, "", err.Error())
+		return
+	}
+	switch body.EncodingFormat {
+	case "", formatFloat, formatBase64:
+	default:
+		abortWithError(c, http.StatusBadRequest, invalidRequestErr, "",
+			fmt.Sprintf("The encoding_format '%s' is not supported", body.EncodingFormat))
+		return
+	}
+	trace.SpanFromContext(rctx).SetAttributes(tracing.ModelKey.String(body.Model))
+	cands, ok := ca.candidates(c, body.Model)
+	if !ok {
+		return
+	}
+	release, ok := ca.limiter.Acquire(c, false)
+	if !ok {
+		return
+	}
+	var tokens int
+	defer func() {
+		release(tokens)
+	}()
+
+	for _, m := range cands {
+		em, ok := m.Model.(mux.Embedder)
+		if !ok {
+			attempts = append(attempts, newAttempt(m.Name(), pkg.NewError(pkg.ClassUnsupported, "embedding not support")))
+			continue
+		}
+		if err := take(m); err != nil {
+			attempts = append(attempts, newAttempt(m.Name(), err))
+			continue
+		}
+		if len(attempts) > 0 {
+			failovers.WithLabelValues(m.Name(), embeddingEndpoint).Inc()
+		}
+		start := time.Now()
+		actx, span := tracing.Start(rctx, "backend "+m.Name(),
+			tracing.BackendKey.String(m.Name()), tracing.UpstreamKey.String(m.Upstream))
+		data, err := em.Embed(actx, &mux.EmbedRequest{
+			Model:      m.Upstream,
+			Input:      input,
+			Dimensions: int(body.Dimensions),
+		})
+		if err == nil && len(data.Vectors) != len(input) {
+			err = pkg.NewError(pkg.ClassUpstream, "%d embeddings of %d inputs", len(data.Vectors), len(input))
+		}
+		m.Health.Leave()
+		err = ca.terminated(rctx, err)
+		observeAttempt(embeddingEndpoint, m, start, nil, err)
+		tracing.End(span, err)
+		if err == nil {
+			m.Health.Success()
+			klog.Infof("model '%s' success", m.Name())
+			if data.PromptTokens == 0 {
+				for _, in := range input {
+					data.PromptTokens += util.EstimateTokens(in)
+				}
+			}
+			tokens = data.PromptTokens
+			tokenCount.WithLabelValues(m.Name(), "in").Add(float64(tokens))
+			c.JSON(http.StatusOK, embedResponse(body, data))
+			return
+		}
+		judge(m, err)
+		klog.Warningf("model '%s' embedding failed: %v", m.Name(), err)
+		a := newAttempt(m.Name(), err)
+		attempts = append(attempts, a)
+		// the client is gone, nobody is waiting for the answer
+		if a.class == pkg.ClassCanceled {
+			return
+		}
+		if !a.class.Failover() || err == errShutdown {
+			break
+		}
+	}
+	abortWithAttempts(c, attempts)
+}
+
+// embedInput return the texts of input, a string or an array of strings.
+// token arrays need the tokenizer of upstream, which is not supported.
+func embedInput(input any) ([]string, error) {
+	var ret []string
+	switch v := input.(type) {
+	case string:
+		ret = []string{v}
+	case []any:
+		for i, in := range v {
+			s, ok := in.(string)
+			if !ok {
+				return nil, fmt.Errorf("The input %d is not a string, token arrays are not supported", i)
+			}
+			ret = append(ret, s)
+		}
+	default:
+		return nil, fmt.Errorf("The input must be a string or an array of strings")
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("The input is empty")
+	}
+	for i, s := range ret {
+		if s == "" {
+			return nil, fmt.Errorf("The input %d is empty", i)
+		}
+	}
+	return ret, nil
+}
+
+func embedResponse(body *api.V1EmbeddingsPostRequest, data *mux.Embedding) *api.V1EmbeddingsPost200Response {
+	ret := &api.V1EmbeddingsPost200Response{
+		Object: listObject,
+		Model:  body.Model,
+		Data:   make([]api.V1EmbeddingsPost200ResponseDataInner, 0, len(data.Vectors)),
+		Usage: api.V1EmbeddingsPost200ResponseUsage{
+			PromptTokens: int32(data.PromptTokens),
+			TotalTokens:  int32(data.PromptTokens),
+		},
+	}
+	for i, vec := range data.Vectors {
+		var emb any = vec
+		if body.EncodingFormat == formatBase64 {
+			emb = encodeVector(vec)
+		}
+		ret.Data = append(ret.Data, api.V1EmbeddingsPost200ResponseDataInner{
+			Object:    embeddingObject,
+			Embedding: emb,
+			Index:     int32(i),
+		})
+	}
+	return ret
+}
+
+// encodeVector return the base64 of little endian float32, as openai does
+func encodeVector(vec []float32) string {
+	bs := make([]byte, 4*len(vec))
+	for i, f := range vec {
+		binary.LittleEndian.PutUint32(bs[4*i:], math.Float32bits(f))
+	}
+	return base64.StdEncoding.EncodeToString(bs)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/mux/mock"
+	"github.com/yylt/gptmux/pkg"
+)
+
+// embedData is the embeddings response, the embedding is floats or base64
+type embedData struct {
+	Data []struct {
+		Index     int             `json:"index"`
+		Embedding json.RawMessage `json:"embedding"`
+	} `json:"data"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+	} `json:"usage"`
+}
+
+func TestEmbeddings(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		models = []string{"text-embedding-3-small"}
+		bad    = mock.New(&mock.Conf{Models: models, Index: 2, Fail: &mock.Fail{Class: pkg.ClassUpstream},
+			Options: mux.Options{Name: "bad"}})
+		good = mock.New(&mock.Conf{Models: models, Index: 1, Dimensions: 4, Options: mux.Options{Name: "good"}})
+		e    = newTestEngine(NewController(ctx, false, nil, bad, good))
+	)
+	embed := func(body string) (int, *embedData) {
+		t.Helper()
+		w := do(e, http.MethodPost, "/v1/embeddings", "", body)
+		if w.Code != http.StatusOK {
+			return w.Code, nil
+		}
+		ret := &embedData{}
+		if err := json.Unmarshal(w.Body.Bytes(), ret); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, ret
+	}
+
+	code, floats := embed(`{"model": "text-embedding-3-small", "input": ["hello world", "bye"]}`)
+	if code != http.StatusOK || len(floats.Data) != 2 || floats.Usage.PromptTokens != 3 {
+		t.Fatalf("float embeddings %d %+v", code, floats)
+	}
+	var vecs [][]float32
+	for i, d := range floats.Data {
+		var vec []float32
+		if err := json.Unmarshal(d.Embedding, &vec); err != nil || d.Index != i || len(vec) != 4 {
+			t.Fatalf("embedding %d is %s", i, d.Embedding)
+		}
+		vecs = append(vecs, vec)
+	}
+
+	// base64 is the little endian float32 of the same vectors
+	code, b64 := embed(`{"model": "text-embedding-3-small", "input": ["hello world", "bye"], "encoding_format": "base64"}`)
+	if code != http.StatusOK || len(b64.Data) != 2 {
+		t.Fatalf("base64 embeddings %d %+v", code, b64)
+	}
+	for i, d := range b64.Data {
+		var s string
+		if err := json.Unmarshal(d.Embedding, &s); err != nil {
+			t.Fatalf("embedding %d is not a string: %s", i, d.Embedding)
+		}
+		bs, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(bs) != 16 {
+			t.Fatalf("embedding %d decode %d bytes: %v", i, len(bs), err)
+		}
+		var vec []float32
+		for j := 0; j < len(bs); j += 4 {
+			vec = append(vec, math.Float32frombits(binary.LittleEndian.Uint32(bs[j:])))
+		}
+		if !slices.Equal(vec, vecs[i]) {
+			t.Errorf("base64 embedding %d is %v, want %v", i, vec, vecs[i])
+		}
+	}
+
+	for _, body := range []string{
+		`{"model": "text-embedding-3-small", "input": [[1, 2]]}`,
+		`{"model": "text-embedding-3-small", "input": []}`,
+		`{"model": "text-embedding-3-small", "input": ["a", ""]}`,
+		`{"model": "text-embedding-3-small", "input": "a", "encoding_format": "int8"}`,
+	} {
+		if code, _ = embed(body); code != http.StatusBadRequest {
+			t.Errorf("embed %s status %d, want 400", body, code)
+		}
+	}
+	// the failed backend is tried first every time
+	if n := len(bad.Calls()); n != 2 {
+		t.Errorf("failed backend calls %d, want 2", n)
+	}
+}
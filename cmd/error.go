@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yylt/gptmux/pkg"
+)
+
+const (
+	invalidRequestErr = "invalid_request_error"
+	serverErr         = "server_error"
+
+	modelNotFound = "model_not_found"
+)
+
+// openai style error response
+type errorResp struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Message  string     `json:"message"`
+	Type     string     `json:"type"`
+	Param    *string    `json:"param"`
+	Code     string     `json:"code,omitempty"`
+	Attempts []*attempt `json:"attempts,omitempty"`
+}
+
+// attempt is the failure of one backend
+type attempt struct {
+	Backend string `json:"backend"`
+	Type    string `json:"type"`
+	Message string `json:"message"`
+
+	class pkg.Class
+}
+
+func newAttempt(backend string, err error) *attempt {
+	class := pkg.Classify(err)
+	return &attempt{
+		Backend: backend,
+		Type:    string(class),
+		Message: err.Error(),
+		class:   class,
+	}
+}
+
+func abortWithError(c *gin.Context, status int, typ, code, msg string) {
+	c.AbortWithStatusJSON(status, &errorResp{
+		Error: errorDetail{
+			Message: msg,
+			Type:    typ,
+			Code:    code,
+		},
+	})
+}
+
+// abortWithAttempts report all failed backends, the status is decided by
+// the class when all backends failed with the same class.
+func abortWithAttempts(c *gin.Context, attempts []*attempt) {
+	var (
+		class = pkg.ClassUnavailable
+		msgs  []string
+	)
+	for i, a := range attempts {
+		if i == 0 {
+			class = a.class
+		} else if a.class != class {
+			class = pkg.ClassUpstream
+		}
+		msgs = append(msgs, fmt.Sprintf("%s: %s", a.Backend, a.Message))
+	}
+	msg := "no backend available"
+	if len(msgs) != 0 {
+		msg = "all backends failed, " + strings.Join(msgs, "; ")
+	}
+	c.AbortWithStatusJSON(class.Status(), &errorResp{
+		Error: errorDetail{
+			Message:  msg,
+			Type:     errorType(class),
+			Code:     string(class),
+			Attempts: attempts,
+		},
+	})
+}
+
+// errorType return the openai error type of class
+func errorType(class pkg.Class) string {
+	switch class {
+	case pkg.ClassAuth, pkg.ClassBadRequest:
+		return string(class)
+	case pkg.ClassQuota, pkg.ClassRateLimit:
+		return "rate_limit_error"
+	case pkg.ClassUnsupported:
+		return invalidRequestErr
+	}
+	return serverErr
+}
@@ -1,70 +1,192 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"sort"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/tmc/langchaingo/llms"
 	api "github.com/yylt/gptmux/api/go"
 	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/pkg"
+	"github.com/yylt/gptmux/pkg/cache"
+	"github.com/yylt/gptmux/pkg/record"
+	"github.com/yylt/gptmux/pkg/tracing"
 	"github.com/yylt/gptmux/pkg/util"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/klog/v2"
 )
 
-var (
-	msgType = "message"
-)
-
 type Controller struct {
-	ctx   context.Context
-	debug bool
+	ctx     context.Context
+	debug   bool
+	created int32
 	// v1 completions
 	fims []mux.FimModel
 
-	// chat completions
-	chats []mux.Model
+	// chat completions, swapped by admin
+	router atomic.Pointer[mux.Router]
+	// serialize the router changes
+	mu sync.Mutex
+
+	limiter  *Limiter
+	recorder *record.Recorder
+	cache    *cache.Cache
+	intent   *mux.Intent
+
+	// providers which failed to create, protected by mu
+	failed []string
+
+	// done when the drain timeout is reached, requests in flight are terminated
+	drain context.Context
+	stop  context.CancelFunc
+	// new requests are refused when draining
+	draining atomic.Bool
+	inflight atomic.Int64
 }
 
-func NewController(ctx context.Context, debug bool, ms ...mux.Model) *Controller {
-	var (
-		models []mux.Model
-	)
+func NewController(ctx context.Context, debug bool, routes []*mux.Route, ms ...mux.Model) *Controller {
 	for i := range ms {
 		klog.Infof("append upstream '%s', index '%d'", ms[i].Name(), ms[i].Index())
-		models = append(models, ms[i])
 	}
-	sort.Slice(models, func(i, j int) bool {
-		return models[i].Index() > models[j].Index()
-	})
-	return &Controller{
-		ctx:   ctx,
-		debug: debug,
-		chats: models,
+	ca := &Controller{
+		ctx:     ctx,
+		debug:   debug,
+		created: int32(time.Now().UTC().Unix()),
 	}
+	ca.drain, ca.stop = context.WithCancel(context.Background())
+	ca.router.Store(mux.NewRouter(routes, ms...))
+	return ca
+}
+
+// Router return the current router
+func (ca *Controller) Router() *mux.Router {
+	return ca.router.Load()
+}
+
+// Failed return the providers which failed to create
+func (ca *Controller) Failed() []string {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.failed
+}
+
+// Swap replace the backends and routes, the circuits and runtime settings
+// of the kept backends are inherited. requests in flight keep the old ones,
+// the old router is returned.
+func (ca *Controller) Swap(routes []*mux.Route, failed []string, ms ...mux.Model) *mux.Router {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	old := ca.Router()
+	ca.router.Store(mux.NewRouter(routes, ms...).Inherit(old))
+	ca.failed = failed
+	return old
+}
+
+// candidates return backends for the model which the caller can use,
+// or abort with 404 when not found and 403 when not allowed.
+func (ca *Controller) candidates(c *gin.Context, model string) ([]*mux.Candidate, bool) {
+	key := Tenant(c.Request.Context())
+	if !key.AllowModel(model) {
+		abortWithError(c, http.StatusForbidden, permissionErr, modelNotAllowed,
+			fmt.Sprintf("The model '%s' is not allowed for key '%s'", model, key))
+		return nil, false
+	}
+	cands, ok := ca.Router().Match(model)
+	if !ok {
+		abortWithError(c, http.StatusNotFound, invalidRequestErr, modelNotFound,
+			fmt.Sprintf("The model '%s' does not exist", model))
+		return nil, false
+	}
+	// the backends are disabled or missing
+	if len(cands) == 0 {
+		abortWithAttempts(c, nil)
+		return nil, false
+	}
+	cands = allowed(key, cands)
+	if len(cands) == 0 {
+		abortWithError(c, http.StatusForbidden, permissionErr, modelNotAllowed,
+			fmt.Sprintf("No backend of model '%s' is allowed for key '%s'", model, key))
+		return nil, false
+	}
+	return cands, true
+}
+
+// match return the backends of model which the caller can use
+func (ca *Controller) match(key *ApiKey, model string) ([]*mux.Candidate, bool) {
+	if !key.AllowModel(model) {
+		return nil, false
+	}
+	cands, ok := ca.Router().Match(model)
+	if !ok {
+		return nil, false
+	}
+	cands = allowed(key, cands)
+	return cands, len(cands) > 0
+}
+
+func allowed(key *ApiKey, cands []*mux.Candidate) []*mux.Candidate {
+	var ret []*mux.Candidate
+	for _, cand := range cands {
+		if key.AllowBackend(cand.Name()) {
+			ret = append(ret, cand)
+		}
+	}
+	return ret
+}
+
+func withUpstream(opt []llms.CallOption, cand *mux.Candidate) []llms.CallOption {
+	if cand.Upstream == "" {
+		return slices.Clip(opt)
+	}
+	return append(opt[:len(opt):len(opt)], llms.WithModel(cand.Upstream))
 }
 
 // V1CompletionsPost Post /v1/completions
 // 创建完成
 func (ca *Controller) V1CompletionsPost(c *gin.Context) {
 	var (
-		body      = &api.V1CompletionsPostRequest{}
-		reterrors []error
+		body         = &api.V1CompletionsPostRequest{}
+		attempts     []*attempt
+		rctx, cancle = context.WithCancel(c.Request.Context())
 	)
+	defer cancle()
+	defer context.AfterFunc(ca.drain, cancle)()
 
 	err := c.ShouldBindBodyWithJSON(body)
 	if err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
+		abortWithError(c, http.StatusBadRequest, invalidRequestErr, "", err.Error())
 		return
 	}
 	if ca.debug {
 		klog.Infof("request: %#v", body)
 	}
+	trace.SpanFromContext(rctx).SetAttributes(tracing.ModelKey.String(body.Model))
+	cands, ok := ca.candidates(c, body.Model)
+	if !ok {
+		return
+	}
+	release, ok := ca.limiter.Acquire(c, body.Stream)
+	if !ok {
+		return
+	}
+	var tokens int
+	defer func() {
+		release(tokens)
+	}()
+	if body.Stream {
+		inflightStreams.Inc()
+		defer inflightStreams.Dec()
+	}
 	buf := util.GetBuf()
 	defer func() {
 		if ca.debug {
@@ -73,9 +195,10 @@ func (ca *Controller) V1CompletionsPost(c *gin.Context) {
 		util.PutBuf(buf)
 	}()
 	var (
+		sw  = newStreamWriter(c, completionObject, body.Model)
 		ret = &api.V1CompletionsPost200Response{
-			Id:      "Controllercmpl",
-			Object:  "Controller.completion",
+			Id:      sw.id,
+			Object:  completionObject,
 			Created: int32(time.Now().UTC().Unix()),
 			Model:   body.Model,
 		}
@@ -85,67 +208,104 @@ func (ca *Controller) V1CompletionsPost(c *gin.Context) {
 			llms.WithTopP(float64(body.TopP)),
 			llms.WithPresencePenalty(float64(body.PresencePenalty)),
 			llms.WithFrequencyPenalty(float64(body.FrequencyPenalty)),
-			llms.WithMetadata(map[string]interface{}{mux.ReqBody: body}),
 		}
 	)
+	sw.rec = ca.recorder.Start(sw.id, record.Completion, body.Model, body.Stream, prompt, body)
+	defer ca.recorder.Write(sw.rec)
 
-	if body.Stream {
-		opt = append(opt, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
-			defer func() {
-				c.Writer.Header().Add("Content-Type", "text/event-stream")
-				c.Writer.Flush()
-			}()
-
-			ret.Choices = []api.V1CompletionsPost200ResponseChoicesInner{
-				{
-					Index:        1,
-					Text:         string(chunk),
-					FinishReason: "1",
-				},
-			}
-			buf.Write(chunk)
-			c.SSEvent(msgType, ret)
-
-			select {
-			case <-c.Writer.CloseNotify():
-				c.SSEvent(msgType, "[DONE]")
-				return io.EOF
-			case <-ctx.Done():
-				c.SSEvent(msgType, "[DONE]")
-				return io.EOF
-			default:
-			}
-			return nil
-		}))
-	}
-
-	for _, m := range ca.chats {
-		fm, ok := m.(mux.FimModel)
+	for _, m := range cands {
+		fm, ok := m.Model.(mux.FimModel)
 		if !ok {
-			reterrors = append(reterrors, fmt.Errorf("model '%s' not support", m.Name()))
+			attempts = append(attempts, newAttempt(m.Name(), pkg.NewError(pkg.ClassUnsupported, "completion not support")))
 			klog.Warningf("model '%s' not support completion", m.Name())
 			continue
 		}
-		data, err := fm.Completion(ca.ctx, prompt, opt...)
+		if err := take(m); err != nil {
+			attempts = append(attempts, newAttempt(m.Name(), err))
+			continue
+		}
+		if len(attempts) > 0 {
+			failovers.WithLabelValues(m.Name(), record.Completion).Inc()
+		}
+		var (
+			start         = time.Now()
+			actx, acancel = context.WithCancel(rctx)
+			span          trace.Span
+			usage         = &mux.Usage{}
+			mopt          = append(withUpstream(opt, m), llms.WithMetadata(map[string]interface{}{
+				mux.ReqBody:  body,
+				mux.UsageKey: usage,
+			}))
+			g *gate
+		)
+		actx, span = tracing.Start(actx, "backend "+m.Name(),
+			tracing.BackendKey.String(m.Name()), tracing.UpstreamKey.String(cmp.Or(m.Upstream, body.Model)))
+		if body.Stream {
+			g = newGate(sw, buf, m.FirstToken(), acancel)
+			mopt = append(mopt, llms.WithStreamingFunc(g.Write))
+		}
+		data, err := fm.Completion(actx, prompt, mopt...)
+		err = closeGate(g, m, err)
+		acancel()
+		m.Health.Leave()
+		err = ca.terminated(rctx, err)
+		observeAttempt(record.Completion, m, start, g, err)
+		tracing.End(span, err)
 		if err == nil || errors.Is(err, io.EOF) {
+			if err == nil {
+				m.Health.Success()
+			} else {
+				// the client is gone, the backend is not judged
+				m.Health.Release()
+			}
 			klog.Infof("model '%s' success", m.Name())
-			if !body.Stream {
+			if body.Stream {
+				u := tokenUsage(usage, util.EstimateTokens(prompt), buf.String())
+				tokens = int(u.TotalTokens)
+				observeTokens(m.Name(), u)
+				sw.rec.Done(m.Name(), buf.String(), finishStop)
+				sw.Finish(finishStop, streamUsage(body.StreamOptions, u))
+			} else {
 				ret.Choices = []api.V1CompletionsPost200ResponseChoicesInner{
 					{
-						Text: string(data),
+						Text:         string(data),
+						FinishReason: finishStop,
 					},
 				}
+				ret.Usage = *tokenUsage(usage, util.EstimateTokens(prompt), data)
+				tokens = int(ret.Usage.TotalTokens)
+				observeTokens(m.Name(), &ret.Usage)
+				sw.rec.Done(m.Name(), data, finishStop)
 				c.JSON(http.StatusOK, ret)
 			}
+			return
+		}
+		judge(m, err)
+		sw.rec.Fail(m.Name(), err)
+		klog.Warningf("model '%s' failed: %v", m.Name(), err)
+		a := newAttempt(m.Name(), err)
+		attempts = append(attempts, a)
+		// the client is gone, nobody is waiting for the answer
+		if a.class == pkg.ClassCanceled {
+			return
+		}
+		// the client had received content, fail over is not possible
+		if sw.Started() {
+			u := tokenUsage(usage, util.EstimateTokens(prompt), buf.String())
+			tokens = int(u.TotalTokens)
+			observeTokens(m.Name(), u)
+			sw.Error(errorDetail{
+				Message: err.Error(),
+				Type:    errorType(a.class),
+				Code:    string(a.class),
+			})
+			return
+		}
+		if !a.class.Failover() || err == errShutdown {
 			break
-		} else {
-			reterrors = append(reterrors, err)
-			klog.Warningf("model '%s' failed: %v", m.Name(), err)
 		}
 	}
-	if len(reterrors) == len(ca.chats) {
-		c.AbortWithError(http.StatusInternalServerError, nil)
-	}
+	abortWithAttempts(c, attempts)
 }
 
 // V1ControllerCompletionsPost Post /v1/chat/completions
@@ -156,127 +316,265 @@ func (ca *Controller) V1ChatCompletionsPost(c *gin.Context) {
 		rctx, cancle = context.WithCancel(c.Request.Context())
 	)
 	defer cancle()
+	defer context.AfterFunc(ca.drain, cancle)()
 	err := c.ShouldBindBodyWithJSON(body)
 
 	if err != nil {
-		klog.Errorf("bind json failed: %v, body: %s", err, c.Request.Body)
-		c.AbortWithError(http.StatusBadRequest, err)
+		klog.Errorf("bind json failed: %v", err)
+		abortWithError(c, http.StatusBadRequest, invalidRequestErr, "", err.Error())
+		return
+	}
+	trace.SpanFromContext(rctx).SetAttributes(tracing.ModelKey.String(body.Model))
+	cands, ok := ca.candidates(c, body.Model)
+	if !ok {
+		return
+	}
+	release, ok := ca.limiter.Acquire(c, body.Stream)
+	if !ok {
 		return
 	}
+	var tokens int
+	defer func() {
+		release(tokens)
+	}()
+	if body.Stream {
+		inflightStreams.Inc()
+		defer inflightStreams.Dec()
+	}
 	var (
-		opt = []llms.CallOption{
+		conv = makePrompt(body)
+		opt  = []llms.CallOption{
 			llms.WithTemperature(float64(body.Temperature)),
 			llms.WithTopP(float64(body.TopP)),
 			llms.WithPresencePenalty(float64(body.PresencePenalty)),
 			llms.WithFrequencyPenalty(float64(body.FrequencyPenalty)),
-			llms.WithMetadata(map[string]interface{}{mux.ReqBody: body}),
 		}
 
-		message = makePrompt(body)
+		message = conv.Messages()
+		sw      = newStreamWriter(c, chatChunkObject, body.Model)
 		ret     = &api.V1ChatCompletionsPost200Response{
-			Id:      "Controllercmpl",
-			Object:  "Controller.completion",
+			Id:      sw.id,
+			Object:  chatObject,
 			Created: int32(time.Now().UTC().Unix()),
 			Model:   body.Model,
 		}
-		reterrs []error
+		attempts []*attempt
+		lang     *mux.Language
 	)
+	if len(body.Tools) != 0 {
+		opt = append(opt, llms.WithTools(chatTools(body)))
+	}
+	sw.rec = ca.recorder.Start(sw.id, record.Chat, body.Model, body.Stream, conv.Transcript(), body)
+	defer ca.recorder.Write(sw.rec)
+	if key := Tenant(c.Request.Context()); key != nil {
+		lang = key.Language
+	}
 	if ca.debug {
-		klog.Infof("request body: %q", body)
+		klog.Infof("request body: %+v", body)
 	}
+	key := ca.cacheKey(c, body, lang)
+	if e, ok := ca.cached(c, key); ok {
+		replayCached(c, sw, ret, body, e)
+		return
+	}
+	conv.Intent = ca.intent.Detect(rctx, body.Model, conv)
+	sw.keep = key != ""
 	buf := util.GetBuf()
 	defer func() {
 		util.PutBuf(buf)
 	}()
-	if body.Stream {
-		opt = append(opt, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
-			defer func() {
-				c.Writer.Header().Add("Content-Type", "text/event-stream")
-				c.Writer.Flush()
-			}()
-
-			ret.Choices = []api.V1ChatCompletionsPost200ResponseChoicesInner{
-				{
-					Index: 1,
-					Delta: api.V1ChatCompletionsPost200ResponseChoicesInnerDelta{
-						Role:    mux.RoleAssistant,
-						Content: string(chunk),
-					},
-					FinishReason: "1",
-				},
-			}
-			buf.Write(chunk)
-			c.SSEvent(msgType, ret)
-			select {
-			case <-c.Writer.CloseNotify():
-				cancle()
-				c.SSEvent(msgType, "[DONE]")
-				return io.EOF
-			case <-ctx.Done():
-				c.SSEvent(msgType, "[DONE]")
-				return io.EOF
-			default:
-			}
-			return nil
-		}))
-	}
 
-	for _, m := range ca.chats {
-		data, err := m.GenerateContent(rctx, message, opt...)
+	for _, m := range cands {
+		if len(body.Tools) != 0 && !toolCalling(m.Model) {
+			attempts = append(attempts, newAttempt(m.Name(), pkg.NewError(pkg.ClassUnsupported, "tools not support")))
+			continue
+		}
+		if err := take(m); err != nil {
+			attempts = append(attempts, newAttempt(m.Name(), err))
+			continue
+		}
+		if len(attempts) > 0 {
+			failovers.WithLabelValues(m.Name(), record.Chat).Inc()
+		}
+		var (
+			start         = time.Now()
+			actx, acancel = context.WithCancel(rctx)
+			span          trace.Span
+			usage         = &mux.Usage{}
+			mopt          = append(withUpstream(opt, m), llms.WithMetadata(map[string]interface{}{
+				mux.ReqBody:  body,
+				mux.ConvKey:  conv,
+				mux.UsageKey: usage,
+				mux.LangKey:  lang,
+			}))
+			g *gate
+		)
+		actx, span = tracing.Start(actx, "backend "+m.Name(),
+			tracing.BackendKey.String(m.Name()), tracing.UpstreamKey.String(cmp.Or(m.Upstream, body.Model)))
+		if body.Stream {
+			first := m.FirstToken()
+			// tool calls are sent at the end, no content may come before them
+			if len(body.Tools) != 0 {
+				first = 0
+			}
+			g = newGate(sw, buf, first, acancel)
+			mopt = append(mopt, llms.WithStreamingFunc(g.Write))
+		}
+		data, err := m.GenerateContent(actx, message, mopt...)
+		err = closeGate(g, m, err)
+		acancel()
+		m.Health.Leave()
+		err = ca.terminated(rctx, err)
+		observeAttempt(record.Chat, m, start, g, err)
+		tracing.End(span, err)
 		if err == nil || errors.Is(err, io.EOF) {
+			if err == nil {
+				m.Health.Success()
+			} else {
+				// the client is gone, the backend is not judged
+				m.Health.Release()
+			}
 			klog.Infof("model '%s' success", m.Name())
-			if !body.Stream {
+			if body.Stream {
+				u := tokenUsage(usage, chatTokens(conv), buf.String())
+				tokens = int(u.TotalTokens)
+				observeTokens(m.Name(), u)
+				sw.rec.Done(m.Name(), buf.String(), finishReason(data))
+				if calls := responseCalls(data); len(calls) != 0 {
+					sw.ToolCalls(calls)
+				}
+				sw.Finish(finishReason(data), streamUsage(body.StreamOptions, u))
+				if err == nil {
+					ca.store(key, m.Name(), buf.String(), sw.chunks, finishReason(data), u)
+				}
+			} else {
 				for _, v := range data.Choices {
 					buf.WriteString(v.Content)
 				}
 				ret.Choices = []api.V1ChatCompletionsPost200ResponseChoicesInner{
 					{
-						//Index: 0,
 						Message: api.V1ChatCompletionsPost200ResponseChoicesInnerDelta{
-							Content: buf.String(),
+							Role:      mux.RoleAssistant,
+							Content:   buf.String(),
+							ToolCalls: responseCalls(data),
 						},
+						FinishReason: finishReason(data),
 					},
 				}
+				ret.Usage = *tokenUsage(usage, chatTokens(conv), buf.String())
+				tokens = int(ret.Usage.TotalTokens)
+				observeTokens(m.Name(), &ret.Usage)
+				sw.rec.Done(m.Name(), buf.String(), finishReason(data))
+				if err == nil {
+					ca.store(key, m.Name(), buf.String(), nil, finishReason(data), &ret.Usage)
+				}
 				c.JSON(http.StatusOK, ret)
 			}
+			return
+		}
+		judge(m, err)
+		sw.rec.Fail(m.Name(), err)
+		klog.Warningf("model '%s' failed: %v", m.Name(), err)
+		a := newAttempt(m.Name(), err)
+		attempts = append(attempts, a)
+		// the client is gone, nobody is waiting for the answer
+		if a.class == pkg.ClassCanceled {
+			return
+		}
+		// the client had received content, fail over is not possible
+		if sw.Started() {
+			u := tokenUsage(usage, chatTokens(conv), buf.String())
+			tokens = int(u.TotalTokens)
+			observeTokens(m.Name(), u)
+			sw.Error(errorDetail{
+				Message: err.Error(),
+				Type:    errorType(a.class),
+				Code:    string(a.class),
+			})
+			return
+		}
+		if !a.class.Failover() || err == errShutdown {
 			break
-		} else {
-			reterrs = append(reterrs, err)
-			klog.Warningf("model '%s' failed: %v", m.Name(), err)
 		}
 	}
-	if len(reterrs) == len(ca.chats) {
-		c.AbortWithError(http.StatusInternalServerError, nil)
+	abortWithAttempts(c, attempts)
+}
+
+// terminated replace the error of attempt stopped by the drain timeout
+// or by the client gone, they are not failures of backend.
+func (ca *Controller) terminated(rctx context.Context, err error) error {
+	if ca.drain.Err() != nil && rctx.Err() != nil {
+		return errShutdown
+	}
+	if err != nil && !errors.Is(err, io.EOF) && rctx.Err() != nil {
+		return pkg.NewError(pkg.ClassCanceled, "client canceled: %w", err)
+	}
+	return err
+}
+
+// take the backend for an attempt until Health.Leave, the removed backend
+// and the open circuit are refused.
+func take(m *mux.Candidate) error {
+	if !m.Health.Enter() {
+		return pkg.NewError(pkg.ClassUnavailable, "backend is removed")
+	}
+	if !m.Health.Allow() {
+		m.Health.Leave()
+		return pkg.NewError(pkg.ClassUnavailable, "circuit is open")
+	}
+	return nil
+}
+
+// judge count the failed attempt in the circuit of backend,
+// the attempts stopped by shutdown or by the client only release the probe.
+func judge(m *mux.Candidate, err error) {
+	if err == errShutdown || pkg.Classify(err) == pkg.ClassCanceled {
+		m.Health.Release()
+		return
+	}
+	m.Health.Failure(err)
+}
+
+// closeGate end the streamed attempt, the first token timeout is an upstream error
+func closeGate(g *gate, m *mux.Candidate, err error) error {
+	if g == nil {
+		return err
+	}
+	if g.Close(err == nil || errors.Is(err, io.EOF)) {
+		return pkg.NewError(pkg.ClassUpstream, "no token in %s", m.FirstToken())
 	}
+	return err
 }
 
 // V1ModelsGet Get /v1/models
 // 列出模型
 func (ca *Controller) V1ModelsGet(c *gin.Context) {
-	now := time.Now().UTC().Unix()
-	c.JSON(200, api.V1ModelsGet200Response{
+	c.JSON(http.StatusOK, api.V1ModelsGet200Response{
 		Object: "list",
-		Data: []api.V1ModelsGet200ResponseDataInner{
-			{
-				Id:      "gpt-3.5-turbo",
-				Object:  "object",
-				Created: int32(now),
-				OwnedBy: "openai",
-			},
-			{
-				Id:      "gpt-4-turbo",
-				Object:  "object",
-				Created: int32(now),
-				OwnedBy: "openai",
-			},
-		},
+		Data:   ca.models(Tenant(c.Request.Context())),
 	})
 }
 
-// V1ModelsModelGet Get /v1/models/:model
-// 删除微调模型
+// V1ModelsModelGet Get /v1/models/*model
+// 检索模型
 func (ca *Controller) V1ModelsModelGet(c *gin.Context) {
-	api.DefaultHandleFunc(c)
+	var (
+		id  = strings.TrimPrefix(c.Param("model"), "/")
+		key = Tenant(c.Request.Context())
+	)
+	for _, m := range ca.models(key) {
+		if m.Id == id {
+			c.JSON(http.StatusOK, m)
+			return
+		}
+	}
+	// matched by a pattern route
+	if cands, ok := ca.match(key, id); ok && ca.Router().Routed() {
+		c.JSON(http.StatusOK, ca.aliasModel(id, cands))
+		return
+	}
+	abortWithError(c, http.StatusNotFound, invalidRequestErr, modelNotFound,
+		fmt.Sprintf("The model '%s' does not exist", id))
 }
 
 // V1ModelsModelidGet Get /v1/models/:modelid
@@ -286,6 +584,78 @@ func (ca *Controller) V1ModelsModelidGet(c *gin.Context) {
 	api.DefaultHandleFunc(c)
 }
 
+// models list route aliases and the upstream models of backends,
+// models which can not be routed or not allowed are skipped.
+func (ca *Controller) models(key *ApiKey) []api.V1ModelsGet200ResponseDataInner {
+	var (
+		ret    = []api.V1ModelsGet200ResponseDataInner{}
+		seen   = map[string]bool{}
+		router = ca.Router()
+	)
+	for _, rt := range router.Routes() {
+		if rt.IsPattern() || seen[rt.Model] {
+			continue
+		}
+		cands, ok := ca.match(key, rt.Model)
+		if !ok {
+			continue
+		}
+		seen[rt.Model] = true
+		ret = append(ret, ca.aliasModel(rt.Model, cands))
+	}
+	for _, m := range router.Models() {
+		if router.Disabled(m) {
+			continue
+		}
+		for _, info := range mux.Infos(m) {
+			if seen[info.Id] {
+				continue
+			}
+			if !key.AllowBackend(m.Name()) {
+				continue
+			}
+			if _, ok := ca.match(key, info.Id); !ok {
+				continue
+			}
+			seen[info.Id] = true
+			ret = append(ret, api.V1ModelsGet200ResponseDataInner{
+				Id:           info.Id,
+				Object:       "model",
+				Created:      ca.created,
+				OwnedBy:      info.OwnedBy,
+				Backend:      m.Name(),
+				Capabilities: info.Capabilities,
+			})
+		}
+	}
+	return ret
+}
+
+func (ca *Controller) aliasModel(id string, cands []*mux.Candidate) api.V1ModelsGet200ResponseDataInner {
+	var (
+		names []string
+		caps  []string
+	)
+	for _, cand := range cands {
+		names = append(names, cand.Name())
+		for _, info := range mux.Infos(cand.Model) {
+			for _, cp := range info.Capabilities {
+				if !slices.Contains(caps, cp) {
+					caps = append(caps, cp)
+				}
+			}
+		}
+	}
+	return api.V1ModelsGet200ResponseDataInner{
+		Id:           id,
+		Object:       "model",
+		Created:      ca.created,
+		OwnedBy:      "gptmux",
+		Backend:      strings.Join(names, ","),
+		Capabilities: caps,
+	}
+}
+
 func completionPrompt(req *api.V1CompletionsPostRequest) string {
 	return fmt.Sprintf(`
 	<prefix>%s<prefix>
@@ -294,38 +664,17 @@ func completionPrompt(req *api.V1CompletionsPostRequest) string {
 	`, req.Prompt, req.Suffix)
 }
 
-func makePrompt(req *api.V1ChatCompletionsPostRequest) []llms.MessageContent {
-	var (
-		cont = map[llms.ChatMessageType]llms.MessageContent{}
-		kind llms.ChatMessageType
-	)
+// makePrompt keep every message in order, names are kept by the conversation
+func makePrompt(req *api.V1ChatCompletionsPostRequest) *mux.Conversation {
+	conv := &mux.Conversation{}
 	for _, msg := range req.Messages {
-		switch msg.Role {
-		case string(llms.ChatMessageTypeAI), mux.RoleAssistant:
-			kind = llms.ChatMessageTypeAI
-		case string(llms.ChatMessageTypeHuman), mux.RoleUser:
-			kind = llms.ChatMessageTypeHuman
-		case string(llms.ChatMessageTypeSystem):
-			kind = llms.ChatMessageTypeSystem
-		case string(llms.ChatMessageTypeGeneric):
-			kind = llms.ChatMessageTypeGeneric
-		}
-		v, ok := cont[kind]
-		if !ok {
-			cont[kind] = llms.MessageContent{
-				Role: kind,
-				Parts: []llms.ContentPart{
-					llms.TextPart(msg.Content),
-				},
-			}
-		} else {
-			v.Parts = append(v.Parts, llms.TextPart(msg.Content))
-			cont[kind] = v
-		}
+		conv.Turns = append(conv.Turns, &mux.Turn{
+			Role:       mux.RoleType(msg.Role),
+			Name:       msg.Name,
+			Content:    msg.Content,
+			ToolCalls:  requestCalls(msg.ToolCalls),
+			ToolCallId: msg.ToolCallId,
+		})
 	}
-	ret := make([]llms.MessageContent, 0, len(cont))
-	for _, v := range cont {
-		ret = append(ret, v)
-	}
-	return ret
+	return conv
 }
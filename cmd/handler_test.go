@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/llms"
+	api "github.com/yylt/gptmux/api/go"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/mux/mock"
+	"github.com/yylt/gptmux/pkg"
+	"github.com/yylt/gptmux/pkg/cache"
+)
+
+// exchange is one chat request and the expected answer
+type exchange struct {
+	stream bool
+	// Cache-Control header of request
+	cacheControl string
+	code         int
+	// content of the answer, or the error code when code is not 200
+	want string
+}
+
+func TestChatCompletions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name   string
+		mocks  []*mock.Conf
+		limits *LimitConf
+		cache  *cache.Conf
+		reqs   []exchange
+		// calls of each mock after all requests
+		calls map[string]int
+	}{
+		{
+			name: "answer",
+			mocks: []*mock.Conf{
+				{Script: []string{"hello", " world"}, Options: mux.Options{Name: "a"}},
+			},
+			reqs: []exchange{
+				{code: http.StatusOK, want: "hello world"},
+				{stream: true, code: http.StatusOK, want: "hello world"},
+			},
+			calls: map[string]int{"a": 2},
+		},
+		{
+			name: "unknown model",
+			mocks: []*mock.Conf{
+				{Models: []string{"glm-4"}, Options: mux.Options{Name: "a"}},
+			},
+			reqs: []exchange{
+				{code: http.StatusNotFound, want: modelNotFound},
+			},
+			calls: map[string]int{"a": 0},
+		},
+		{
+			name: "first token gate",
+			mocks: []*mock.Conf{
+				{Script: []string{"slow"}, FirstLatency: time.Second, Index: 2,
+					Options: mux.Options{Name: "slow", FirstToken: 50 * time.Millisecond}},
+				{Script: []string{"fast"}, Index: 1, Options: mux.Options{Name: "fast"}},
+			},
+			reqs: []exchange{
+				{stream: true, code: http.StatusOK, want: "fast"},
+			},
+			calls: map[string]int{"slow": 1, "fast": 1},
+		},
+		{
+			name: "failover",
+			mocks: []*mock.Conf{
+				{Script: []string{"bad"}, Index: 2, Fail: &mock.Fail{Class: pkg.ClassUpstream},
+					Options: mux.Options{Name: "bad"}},
+				{Script: []string{"good"}, Index: 1, Options: mux.Options{Name: "good"}},
+			},
+			reqs: []exchange{
+				{code: http.StatusOK, want: "good"},
+				{stream: true, code: http.StatusOK, want: "good"},
+			},
+			calls: map[string]int{"bad": 2, "good": 2},
+		},
+		{
+			name: "no failover on bad request",
+			mocks: []*mock.Conf{
+				{Script: []string{"bad"}, Index: 2, Fail: &mock.Fail{Class: pkg.ClassBadRequest},
+					Options: mux.Options{Name: "bad"}},
+				{Script: []string{"good"}, Index: 1, Options: mux.Options{Name: "good"}},
+			},
+			reqs: []exchange{
+				{code: http.StatusBadRequest, want: string(pkg.ClassBadRequest)},
+			},
+			calls: map[string]int{"bad": 1, "good": 0},
+		},
+		{
+			name: "breaker open",
+			mocks: []*mock.Conf{
+				{Script: []string{"bad"}, Index: 2, Fail: &mock.Fail{Class: pkg.ClassUpstream},
+					Options: mux.Options{Name: "bad", Breaker: &mux.BreakerConf{Failures: 2, Cooldown: time.Hour}}},
+				{Script: []string{"good"}, Index: 1, Options: mux.Options{Name: "good"}},
+			},
+			reqs: []exchange{
+				{code: http.StatusOK, want: "good"},
+				{code: http.StatusOK, want: "good"},
+				{code: http.StatusOK, want: "good"},
+				{code: http.StatusOK, want: "good"},
+			},
+			// the open circuit is skipped
+			calls: map[string]int{"bad": 2, "good": 4},
+		},
+		{
+			name: "all failed",
+			mocks: []*mock.Conf{
+				{Script: []string{"bad"}, Fail: &mock.Fail{Class: pkg.ClassUpstream},
+					Options: mux.Options{Name: "bad"}},
+			},
+			reqs: []exchange{
+				{code: http.StatusBadGateway, want: string(pkg.ClassUpstream)},
+			},
+			calls: map[string]int{"bad": 1},
+		},
+		{
+			name: "limiter rpm",
+			mocks: []*mock.Conf{
+				{Script: []string{"ok"}, Options: mux.Options{Name: "a"}},
+			},
+			limits: &LimitConf{Limit: Limit{RPM: 2}},
+			reqs: []exchange{
+				{code: http.StatusOK, want: "ok"},
+				{stream: true, code: http.StatusOK, want: "ok"},
+				{code: http.StatusTooManyRequests, want: string(pkg.ClassRateLimit)},
+			},
+			calls: map[string]int{"a": 2},
+		},
+		{
+			name: "cache hit",
+			mocks: []*mock.Conf{
+				{Script: []string{"cached", " answer"}, Options: mux.Options{Name: "a"}},
+			},
+			cache: &cache.Conf{Size: 10},
+			reqs: []exchange{
+				{code: http.StatusOK, want: "cached answer"},
+				{code: http.StatusOK, want: "cached answer"},
+				{stream: true, code: http.StatusOK, want: "cached answer"},
+			},
+			calls: map[string]int{"a": 1},
+		},
+		{
+			name: "cache bypass",
+			mocks: []*mock.Conf{
+				{Script: []string{"fresh"}, Options: mux.Options{Name: "a"}},
+			},
+			cache: &cache.Conf{Size: 10},
+			reqs: []exchange{
+				{cacheControl: "no-cache", code: http.StatusOK, want: "fresh"},
+				{cacheControl: "no-store", code: http.StatusOK, want: "fresh"},
+				// the bypassed answers are not saved
+				{code: http.StatusOK, want: "fresh"},
+				{code: http.StatusOK, want: "fresh"},
+			},
+			calls: map[string]int{"a": 3},
+		},
+		{
+			name: "failed answer is not cached",
+			mocks: []*mock.Conf{
+				{Script: []string{"bad"}, Fail: &mock.Fail{Class: pkg.ClassUpstream, Times: 1},
+					Options: mux.Options{Name: "a"}},
+			},
+			cache: &cache.Conf{Size: 10},
+			reqs: []exchange{
+				{code: http.StatusBadGateway, want: string(pkg.ClassUpstream)},
+				{code: http.StatusOK, want: "bad"},
+				{code: http.StatusOK, want: "bad"},
+			},
+			calls: map[string]int{"a": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var (
+				ms    []mux.Model
+				mocks = map[string]*mock.Mock{}
+			)
+			for _, c := range tt.mocks {
+				if c.Models == nil {
+					c.Models = []string{"gpt-4o"}
+				}
+				m := mock.New(c)
+				ms = append(ms, m)
+				mocks[m.Name()] = m
+			}
+			ca := NewController(ctx, false, nil, ms...)
+			ca.limiter = NewLimiter(ctx, tt.limits)
+			ca.cache = cache.New(ctx, tt.cache)
+			e := newTestEngine(ca)
+
+			for i, ex := range tt.reqs {
+				code, got := chat(t, e, ex.stream, ex.cacheControl)
+				if code != ex.code || got != ex.want {
+					t.Errorf("request %d: got %d '%s', want %d '%s'", i, code, got, ex.code, ex.want)
+				}
+			}
+			for name, n := range tt.calls {
+				if got := len(mocks[name].Calls()); got != n {
+					t.Errorf("mock '%s' calls %d, want %d", name, got, n)
+				}
+			}
+		})
+	}
+}
+
+// upstream answer after delay, the cancel of context is wrapped as
+// an upstream error, as the http backends do.
+type upstream struct {
+	name  string
+	index int
+	delay time.Duration
+	calls atomic.Int32
+}
+
+func (u *upstream) Name() string { return u.name }
+func (u *upstream) Index() int   { return u.index }
+
+func (u *upstream) GenerateContent(ctx context.Context, _ []llms.MessageContent, _ ...llms.CallOption) (*llms.ContentResponse, error) {
+	u.calls.Add(1)
+	select {
+	case <-ctx.Done():
+		return nil, pkg.NewError(pkg.ClassUpstream, "%s request failed: %w", u.name, ctx.Err())
+	case <-time.After(u.delay):
+	}
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{{Content: u.name}}}, nil
+}
+
+func (u *upstream) Call(context.Context, string, ...llms.CallOption) (string, error) {
+	return "", pkg.UnsupportedErr
+}
+
+func TestClientCancel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		a  = &upstream{name: "a", index: 2, delay: time.Second}
+		b  = &upstream{name: "b", index: 1, delay: time.Second}
+		ca = NewController(ctx, false, []*mux.Route{
+			{Model: "gpt-4o", Backends: []*mux.Target{{Name: "a"}, {Name: "b"}}},
+		}, a, b)
+		e = newTestEngine(ca)
+	)
+	// more than the failures of breaker
+	for i := 0; i < 4; i++ {
+		rctx, rcancel := context.WithCancel(ctx)
+		time.AfterFunc(20*time.Millisecond, rcancel)
+		bs, _ := json.Marshal(&api.V1ChatCompletionsPostRequest{
+			Model:    "gpt-4o",
+			Messages: []api.V1ChatCompletionsPostRequestMessagesInner{{Role: "user", Content: "hi"}},
+		})
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(string(bs))).WithContext(rctx)
+		req.Header.Set("Content-Type", "application/json")
+		e.ServeHTTP(httptest.NewRecorder(), req)
+		rcancel()
+	}
+	// the client is gone, the next backend is not tried and no circuit is judged
+	if n := a.calls.Load(); n != 4 {
+		t.Errorf("backend a calls %d, want 4", n)
+	}
+	if n := b.calls.Load(); n != 0 {
+		t.Errorf("backend b calls %d, want 0", n)
+	}
+	for _, m := range []mux.Model{a, b} {
+		st := ca.Router().Health(m).Status()
+		if st.State != mux.CircuitClosed || st.Failures != 0 {
+			t.Errorf("backend '%s' circuit %s, failures %d", m.Name(), st.State, st.Failures)
+		}
+	}
+}
+
+func newTestEngine(ca *Controller, middleware ...gin.HandlerFunc) *gin.Engine {
+	e := gin.New()
+	e.Use(middleware...)
+	api.NewRouterWithGinEngine(e, api.ApiHandleFunctions{
+		ChatAPI:        ca,
+		CompletionsAPI: ca,
+		EmbeddingsAPI:  ca,
+		ImagesAPI:      ca,
+		ModelsAPI:      ca,
+	})
+	return e
+}
+
+// chat send a chat request, and return the status and the answer content,
+// or the error code when failed.
+func chat(t *testing.T, e *gin.Engine, stream bool, cacheControl string) (int, string) {
+	t.Helper()
+	bs, err := json.Marshal(&api.V1ChatCompletionsPostRequest{
+		Model:  "gpt-4o",
+		Stream: stream,
+		Messages: []api.V1ChatCompletionsPostRequestMessagesInner{
+			{Role: "user", Content: "say hello"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(string(bs)))
+	req.Header.Set("Content-Type", "application/json")
+	if cacheControl != "" {
+		req.Header.Set("Cache-Control", cacheControl)
+	}
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		var resp errorResp
+		if err = json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode error %s failed: %v", w.Body.String(), err)
+		}
+		return w.Code, resp.Error.Code
+	}
+	if !stream {
+		var resp api.V1ChatCompletionsPost200Response
+		if err = json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode answer %s failed: %v", w.Body.String(), err)
+		}
+		if len(resp.Choices) == 0 {
+			t.Fatalf("answer %s has no choice", w.Body.String())
+		}
+		return w.Code, resp.Choices[0].Message.Content
+	}
+	var (
+		buf     strings.Builder
+		scanner = bufio.NewScanner(w.Body)
+	)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var ch struct {
+			chatChunk
+			Error *errorDetail `json:"error"`
+		}
+		if err = json.Unmarshal([]byte(data), &ch); err != nil {
+			t.Fatalf("decode frame %s failed: %v", data, err)
+		}
+		if ch.Error != nil {
+			return http.StatusBadGateway, ch.Error.Code
+		}
+		for _, c := range ch.Choices {
+			buf.WriteString(c.Delta.Content)
+		}
+	}
+	return w.Code, buf.String()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	api "github.com/yylt/gptmux/api/go"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/pkg"
+	"github.com/yylt/gptmux/pkg/tracing"
+	"github.com/yylt/gptmux/pkg/util"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// endpoint label of metrics
+	imageEndpoint = "image"
+
+	// model of openai when not set
+	defaultImageModel = "dall-e-2"
+
+	formatUrl     = "url"
+	formatB64Json = "b64_json"
+
+	maxImages    = 10
+	maxImageSize = 20 << 20
+)
+
+var (
+	sizeRe = regexp.MustCompile(`^[1-9][0-9]*x[1-9][0-9]*$`)
+
+	imageClient = util.NewDebugHTTPClient("", false)
+)
+
+// V1ImagesGenerationsPost Post /v1/images/generations
+// 创建图像
+func (ca *Controller) V1ImagesGenerationsPost(c *gin.Context) {
+	var (
+		body         = &api.V1ImagesGenerationsPostRequest{}
+		attempts     []*attempt
+		rctx, cancle = context.WithCancel(c.Request.Context())
+	)
+	defer cancle()
+	defer context.AfterFunc(ca.drain, cancle)()
+
+	if err := c.ShouldBindBodyWithJSON(body); err != nil {
+		abortWithError(c, http.StatusBadRequest, invalidRequestErr, "", err.Error())
+		return
+	}
+	if msg := validImage(body); msg != "" {
+		abortWithError(c, http.StatusBadRequest, invalidRequestErr, "", msg)
+		return
+	}
+	body.Model = cmp.Or(body.Model, defaultImageModel)
+	trace.SpanFromContext(rctx).SetAttributes(tracing.ModelKey.String(body.Model))
+	cands, ok := ca.candidates(c, body.Model)
+	if !ok {
+		return
+	}
+	release, ok := ca.limiter.Acquire(c, false)
+	if !ok {
+		return
+	}
+	defer release(0)
+
+	b64 := body.ResponseFormat == formatB64Json
+	for _, m := range cands {
+		im, ok := m.Model.(mux.ImageGenerator)
+		if !ok {
+			attempts = append(attempts, newAttempt(m.Name(), pkg.NewError(pkg.ClassUnsupported, "image not support")))
+			continue
+		}
+		if err := take(m); err != nil {
+			attempts = append(attempts, newAttempt(m.Name(), err))
+			continue
+		}
+		if len(attempts) > 0 {
+			failovers.WithLabelValues(m.Name(), imageEndpoint).Inc()
+		}
+		start := time.Now()
+		actx, span := tracing.Start(rctx, "backend "+m.Name(),
+			tracing.BackendKey.String(m.Name()), tracing.UpstreamKey.String(m.Upstream))
+		imgs, err := im.GenerateImage(actx, &mux.ImageRequest{
+			Model:   m.Upstream,
+			Prompt:  body.Prompt,
+			N:       int(max(body.N, 1)),
+			Size:    body.Size,
+			Quality: body.Quality,
+			Style:   body.Style,
+			B64:     b64,
+		})
+		var data []api.V1ImagesGenerationsPost200ResponseDataInner
+		if err == nil {
+			data, err = imageData(actx, imgs, b64)
+		}
+		m.Health.Leave()
+		err = ca.terminated(rctx, err)
+		observeAttempt(imageEndpoint, m, start, nil, err)
+		tracing.End(span, err)
+		if err == nil {
+			m.Health.Success()
+			klog.Infof("model '%s' generated %d images", m.Name(), len(data))
+			c.JSON(http.StatusOK, &api.V1ImagesGenerationsPost200Response{
+				Created: int32(time.Now().UTC().Unix()),
+				Data:    data,
+			})
+			return
+		}
+		judge(m, err)
+		klog.Warningf("model '%s' image failed: %v", m.Name(), err)
+		a := newAttempt(m.Name(), err)
+		attempts = append(attempts, a)
+		// the client is gone, nobody is waiting for the answer
+		if a.class == pkg.ClassCanceled {
+			return
+		}
+		if !a.class.Failover() || err == errShutdown {
+			break
+		}
+	}
+	abortWithAttempts(c, attempts)
+}
+
+// V1ImagesEditsPost Post /v1/images/edits
+// 创建图片编辑
+func (ca *Controller) V1ImagesEditsPost(c *gin.Context) {
+	abortWithError(c, http.StatusNotImplemented, invalidRequestErr, "", "The image edits are not supported")
+}
+
+// V1ImagesVariationsPost Post /v1/images/variations
+// 创建图像变体
+func (ca *Controller) V1ImagesVariationsPost(c *gin.Context) {
+	abortWithError(c, http.StatusNotImplemented, invalidRequestErr, "", "The image variations are not supported")
+}
+
+// validImage return the message of invalid request, empty when valid
+func validImage(body *api.V1ImagesGenerationsPostRequest) string {
+	switch {
+	case body.Prompt == "":
+		return "The prompt is empty"
+	case body.N < 0 || body.N > maxImages:
+		return fmt.Sprintf("The n must be between 1 and %d", maxImages)
+	case body.Size != "" && !sizeRe.MatchString(body.Size):
+		return fmt.Sprintf("The size '%s' is invalid, such as 1024x1024", body.Size)
+	}
+	switch body.ResponseFormat {
+	case "", formatUrl, formatB64Json:
+		return ""
+	}
+	return fmt.Sprintf("The response_format '%s' is not supported", body.ResponseFormat)
+}
+
+// imageData return images in the asked format, urls are downloaded for b64_json
+// and the data is returned as data url for url.
+func imageData(ctx context.Context, imgs []*mux.Image, b64 bool) ([]api.V1ImagesGenerationsPost200ResponseDataInner, error) {
+	ret := make([]api.V1ImagesGenerationsPost200ResponseDataInner, 0, len(imgs))
+	for _, img := range imgs {
+		d := api.V1ImagesGenerationsPost200ResponseDataInner{
+			RevisedPrompt: img.RevisedPrompt,
+		}
+		switch {
+		case b64 && img.B64 != "":
+			d.B64Json = img.B64
+		case b64:
+			data, err := fetchImage(ctx, img.Url)
+			if err != nil {
+				return nil, err
+			}
+			d.B64Json = data
+		case img.Url != "":
+			d.Url = img.Url
+		default:
+			d.Url = "data:image/png;base64," + img.B64
+		}
+		ret = append(ret, d)
+	}
+	return ret, nil
+}
+
+// fetchImage download the image and return the base64 of it
+func fetchImage(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", pkg.NewError(pkg.ClassUpstream, "invalid image url '%s': %w", url, err)
+	}
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		return "", pkg.NewError(pkg.ClassUpstream, "download image failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if !util.IsHttp20xCode(resp.StatusCode) {
+		return "", pkg.NewError(pkg.ClassUpstream, "download image failed, code: %d", resp.StatusCode)
+	}
+	bs, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return "", pkg.NewError(pkg.ClassUpstream, "download image failed: %w", err)
+	}
+	if len(bs) > maxImageSize {
+		return "", pkg.NewError(pkg.ClassUpstream, "image is larger than %d bytes", maxImageSize)
+	}
+	return base64.StdEncoding.EncodeToString(bs), nil
+}
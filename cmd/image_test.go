@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/llms"
+	api "github.com/yylt/gptmux/api/go"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/pkg"
+)
+
+// painter return the images of url or base64 data
+type painter struct {
+	name  string
+	index int
+	url   string
+	b64   string
+
+	mu   sync.Mutex
+	reqs []*mux.ImageRequest
+}
+
+func (p *painter) Name() string { return p.name }
+func (p *painter) Index() int   { return p.index }
+
+func (p *painter) Models() []*mux.ModelInfo {
+	return []*mux.ModelInfo{{Id: defaultImageModel, OwnedBy: p.name, Capabilities: []string{mux.CapImage}}}
+}
+
+func (p *painter) GenerateImage(_ context.Context, req *mux.ImageRequest) ([]*mux.Image, error) {
+	p.mu.Lock()
+	p.reqs = append(p.reqs, req)
+	p.mu.Unlock()
+	var ret []*mux.Image
+	for i := 0; i < req.N; i++ {
+		ret = append(ret, &mux.Image{Url: p.url, B64: p.b64, RevisedPrompt: "a cat"})
+	}
+	return ret, nil
+}
+
+func (p *painter) GenerateContent(context.Context, []llms.MessageContent, ...llms.CallOption) (*llms.ContentResponse, error) {
+	return nil, pkg.UnsupportedErr
+}
+
+func (p *painter) Call(context.Context, string, ...llms.CallOption) (string, error) {
+	return "", pkg.UnsupportedErr
+}
+
+func TestImages(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	png := []byte("\x89PNG fake image")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/cat.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(png)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		painters []*painter
+		body     string
+		code     int
+		url      string
+		b64      string
+		// requests of each painter
+		reqs []int
+	}{
+		{
+			name:     "url",
+			painters: []*painter{{name: "a", url: srv.URL + "/cat.png"}},
+			body:     `{"prompt": "a cat", "n": 2}`,
+			code:     http.StatusOK,
+			url:      srv.URL + "/cat.png",
+			reqs:     []int{1},
+		},
+		{
+			name:     "url downloaded as b64_json",
+			painters: []*painter{{name: "a", url: srv.URL + "/cat.png"}},
+			body:     `{"prompt": "a cat", "response_format": "b64_json"}`,
+			code:     http.StatusOK,
+			b64:      base64.StdEncoding.EncodeToString(png),
+			reqs:     []int{1},
+		},
+		{
+			name:     "b64 as data url",
+			painters: []*painter{{name: "a", b64: "aGk="}},
+			body:     `{"prompt": "a cat"}`,
+			code:     http.StatusOK,
+			url:      "data:image/png;base64,aGk=",
+			reqs:     []int{1},
+		},
+		{
+			name: "failed download fail over",
+			painters: []*painter{
+				{name: "a", index: 2, url: srv.URL + "/missing.png"},
+				{name: "b", index: 1, b64: "aGk="},
+			},
+			body: `{"prompt": "a cat", "response_format": "b64_json"}`,
+			code: http.StatusOK,
+			b64:  "aGk=",
+			reqs: []int{1, 1},
+		},
+		{name: "empty prompt", painters: []*painter{{name: "a"}}, body: `{"n": 1}`, code: http.StatusBadRequest, reqs: []int{0}},
+		{name: "too many", painters: []*painter{{name: "a"}}, body: `{"prompt": "a cat", "n": 11}`, code: http.StatusBadRequest, reqs: []int{0}},
+		{name: "bad size", painters: []*painter{{name: "a"}}, body: `{"prompt": "a cat", "size": "big"}`, code: http.StatusBadRequest, reqs: []int{0}},
+		{name: "bad format", painters: []*painter{{name: "a"}}, body: `{"prompt": "a cat", "response_format": "gif"}`, code: http.StatusBadRequest, reqs: []int{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ms []mux.Model
+			for _, p := range tt.painters {
+				ms = append(ms, p)
+			}
+			e := newTestEngine(NewController(ctx, false, nil, ms...))
+			w := do(e, http.MethodPost, "/v1/images/generations", "", tt.body)
+			if w.Code != tt.code {
+				t.Fatalf("status %d %s, want %d", w.Code, w.Body.String(), tt.code)
+			}
+			for i, p := range tt.painters {
+				if len(p.reqs) != tt.reqs[i] {
+					t.Errorf("painter '%s' requests %d, want %d", p.name, len(p.reqs), tt.reqs[i])
+				}
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var resp api.V1ImagesGenerationsPost200Response
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Data) == 0 {
+				t.Fatal("no image")
+			}
+			for _, d := range resp.Data {
+				if d.Url != tt.url || d.B64Json != tt.b64 || d.RevisedPrompt != "a cat" {
+					t.Errorf("image url '%s' b64 '%s', want '%s' '%s'", d.Url, d.B64Json, tt.url, tt.b64)
+				}
+			}
+			if last := tt.painters[len(tt.painters)-1]; last.reqs[0].N != len(resp.Data) {
+				t.Errorf("%d images of n %d", len(resp.Data), last.reqs[0].N)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"strings"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+	api "github.com/yylt/gptmux/api/go"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/pkg"
+)
+
+const (
+	defaultClassifyTimeout = 10 * time.Second
+
+	classifyPrompt = `Decide whether the user wants an image to be drawn or generated, or a text answer.
+Reply with exactly one word: image or text.`
+)
+
+// NewIntent return the intent of chat, the classifier backend is looked up
+// in the current router, so it follows the reloads.
+func NewIntent(ca *Controller, c *mux.IntentConf) (*mux.Intent, error) {
+	if c == nil || c.Classifier == nil || c.Classifier.Backend == "" {
+		return mux.NewIntent(c, nil)
+	}
+	return mux.NewIntent(c, ca.classifier(c.Classifier))
+}
+
+// classifier ask the text backend to answer image or text
+func (ca *Controller) classifier(c *mux.ClassifierConf) mux.Classifier {
+	timeout := cmp.Or(c.Timeout, defaultClassifyTimeout)
+	return func(ctx context.Context, text string) (mux.ChatModel, error) {
+		router := ca.Router()
+		m := router.Lookup(c.Backend)
+		if m == nil || !router.Health(m).Enter() {
+			return mux.NonModel, pkg.NewError(pkg.ClassUnavailable, "classifier backend '%s' not found", c.Backend)
+		}
+		defer router.Health(m).Leave()
+		ctx, cancle := context.WithTimeout(ctx, timeout)
+		defer cancle()
+
+		conv := &mux.Conversation{Intent: mux.TxtModel}
+		conv.Add(llms.ChatMessageTypeSystem, "", classifyPrompt)
+		conv.Add(llms.ChatMessageTypeHuman, "", text)
+		body := &api.V1ChatCompletionsPostRequest{Model: c.Model}
+		for _, t := range conv.Turns {
+			body.Messages = append(body.Messages, api.V1ChatCompletionsPostRequestMessagesInner{
+				Role:    mux.RoleName(t.Role),
+				Content: t.Content,
+			})
+		}
+		opt := []llms.CallOption{
+			llms.WithTemperature(0),
+			llms.WithMetadata(map[string]interface{}{
+				mux.ReqBody: body,
+				mux.ConvKey: conv,
+				// the one word answer, no reply language instruction
+				mux.LangKey: &mux.Language{Mode: mux.LangNone},
+			}),
+		}
+		if c.Model != "" {
+			opt = append(opt, llms.WithModel(c.Model))
+		}
+		resp, err := m.GenerateContent(ctx, conv.Messages(), opt...)
+		if err != nil {
+			return mux.NonModel, err
+		}
+		// streamed backends return a choice per chunk
+		var buf strings.Builder
+		for _, ch := range resp.Choices {
+			if ch != nil {
+				buf.WriteString(ch.Content)
+			}
+		}
+		answer := strings.ToLower(strings.TrimSpace(buf.String()))
+		if answer == "" {
+			return mux.NonModel, pkg.NewError(pkg.ClassUpstream, "classifier '%s' return nothing", c.Backend)
+		}
+		switch {
+		case strings.HasPrefix(answer, string(mux.ImgModel)):
+			return mux.ImgModel, nil
+		case strings.HasPrefix(answer, string(mux.TxtModel)):
+			return mux.TxtModel, nil
+		}
+		return mux.NonModel, pkg.NewError(pkg.ClassUpstream, "classifier '%s' answer '%s'", c.Backend, answer)
+	}
+}
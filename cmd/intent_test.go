@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/mux/mock"
+)
+
+func TestDetectClassifier(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		script []string
+		delay  time.Duration
+		want   mux.ChatModel
+		// the classifier is asked
+		asked bool
+	}{
+		{name: "rule hit", text: "画一只猫", script: []string{"text"}, want: mux.ImgModel},
+		{name: "image answer", text: "一只猫在草地上晒太阳", script: []string{"Image", "."}, want: mux.ImgModel, asked: true},
+		{name: "text answer", text: "why is the sky blue", script: []string{" text"}, want: mux.TxtModel, asked: true},
+		{name: "garbage answer", text: "a cat on the grass", script: []string{"maybe"}, want: mux.TxtModel, asked: true},
+		{name: "timeout", text: "a cat on the grass", script: []string{"image"}, delay: time.Second, want: mux.TxtModel, asked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			m := mock.New(&mock.Conf{
+				Script:       tt.script,
+				FirstLatency: tt.delay,
+				// auto mode ask to answer in chinese for chinese text
+				Options: mux.Options{Name: "classifier", Language: &mux.Language{Mode: mux.LangAuto}},
+			})
+			ca := NewController(ctx, false, nil, m)
+			in, err := NewIntent(ca, &mux.IntentConf{
+				Classifier: &mux.ClassifierConf{Backend: "classifier", Timeout: 50 * time.Millisecond},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conv := &mux.Conversation{}
+			conv.Add(llms.ChatMessageTypeHuman, "", tt.text)
+			if got := in.Detect(ctx, "gpt-4o", conv); got != tt.want {
+				t.Errorf("detect '%s' is %s, want %s", tt.text, got, tt.want)
+			}
+			calls := m.Calls()
+			if asked := len(calls) != 0; asked != tt.asked {
+				t.Fatalf("classifier asked %v, want %v", asked, tt.asked)
+			}
+			for _, c := range calls {
+				if strings.Contains(c.Prompt, "中文") {
+					t.Errorf("classifier prompt has language instruction: %s", c.Prompt)
+				}
+			}
+		})
+	}
+}
+
+// chunked answer a choice per chunk, as the streamed openai backend
+type chunked struct {
+	chunks []string
+}
+
+func (c *chunked) Name() string { return "chunked" }
+func (c *chunked) Index() int   { return 0 }
+
+func (c *chunked) GenerateContent(context.Context, []llms.MessageContent, ...llms.CallOption) (*llms.ContentResponse, error) {
+	ret := &llms.ContentResponse{}
+	for _, s := range c.chunks {
+		ret.Choices = append(ret.Choices, &llms.ContentChoice{Content: s})
+	}
+	return ret, nil
+}
+
+func (c *chunked) Call(context.Context, string, ...llms.CallOption) (string, error) {
+	return "", nil
+}
+
+func TestDetectChunkedClassifier(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the first chunk only carry the role
+	ca := NewController(ctx, false, nil, &chunked{chunks: []string{"", "im", "age"}})
+	in, err := NewIntent(ca, &mux.IntentConf{
+		Classifier: &mux.ClassifierConf{Backend: "chunked"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv := &mux.Conversation{}
+	conv.Add(llms.ChatMessageTypeHuman, "", "a cat on the grass")
+	if got := in.Detect(ctx, "gpt-4o", conv); got != mux.ImgModel {
+		t.Errorf("detect is %s, want %s", got, mux.ImgModel)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yylt/gptmux/pkg"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultFlush = 10 * time.Second
+	dayLayout    = "2006-01-02"
+)
+
+// Limit of one caller, zero means no limit
+type Limit struct {
+	RPM         int `yaml:"rpm,omitempty"`
+	Streams     int `yaml:"streams,omitempty"`
+	DailyTokens int `yaml:"daily_tokens,omitempty"`
+}
+
+// LimitConf is the default limit of callers, a key can overwrite it.
+// callers are keyed on the bearer key, or the client ip without auth.
+// counters are saved to file every flush, the expired ones are removed.
+type LimitConf struct {
+	Limit `yaml:",inline"`
+	File  string        `yaml:"file,omitempty"`
+	Flush time.Duration `yaml:"flush,omitempty"`
+}
+
+// counter of one caller
+type counter struct {
+	// start time of requests in the last minute
+	Requests []time.Time `json:"requests,omitempty"`
+	Day      string      `json:"day"`
+	Tokens   int         `json:"tokens"`
+
+	streams int
+}
+
+type Limiter struct {
+	mu sync.Mutex
+	// serialize the writes of file
+	smu sync.Mutex
+
+	c        *LimitConf
+	counters map[string]*counter
+	dirty    bool
+}
+
+// NewLimiter return nil when limits are not configured
+func NewLimiter(ctx context.Context, c *LimitConf) *Limiter {
+	if c == nil {
+		return nil
+	}
+	if c.Flush <= 0 {
+		c.Flush = defaultFlush
+	}
+	l := &Limiter{
+		c:        c,
+		counters: map[string]*counter{},
+	}
+	if c.File != "" {
+		if err := l.load(); err != nil {
+			klog.Warningf("load limit counters failed: %v", err)
+		}
+	}
+	go l.run(ctx)
+	return l
+}
+
+// Acquire check the limits of caller before any backend is invoked,
+// abort with 429 and Retry-After when exceeded.
+// release must be called when the request is done.
+func (l *Limiter) Acquire(c *gin.Context, stream bool) (release func(tokens int), ok bool) {
+	if l == nil {
+		return func(int) {}, true
+	}
+	var (
+		id, name, lim = l.caller(c)
+		now           = time.Now()
+	)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cnt := l.counter(id, now)
+	if lim.DailyTokens > 0 && cnt.Tokens >= lim.DailyTokens {
+		tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		abortWithLimit(c, tomorrow.Sub(now), pkg.ClassQuota,
+			fmt.Sprintf("Daily token quota %d of '%s' is exhausted", lim.DailyTokens, name))
+		return nil, false
+	}
+	if lim.RPM > 0 {
+		i := 0
+		for i < len(cnt.Requests) && now.Sub(cnt.Requests[i]) >= time.Minute {
+			i++
+		}
+		cnt.Requests = cnt.Requests[i:]
+		if len(cnt.Requests) >= lim.RPM {
+			abortWithLimit(c, cnt.Requests[0].Add(time.Minute).Sub(now), pkg.ClassRateLimit,
+				fmt.Sprintf("Rate limit of '%s' reached, %d requests per minute", name, lim.RPM))
+			return nil, false
+		}
+	}
+	if stream && lim.Streams > 0 && cnt.streams >= lim.Streams {
+		abortWithLimit(c, time.Second, pkg.ClassRateLimit,
+			fmt.Sprintf("Rate limit of '%s' reached, %d concurrent streams", name, lim.Streams))
+		return nil, false
+	}
+	if lim.RPM > 0 {
+		cnt.Requests = append(cnt.Requests, now)
+	}
+	if stream {
+		cnt.streams++
+	}
+	l.dirty = true
+
+	var once sync.Once
+	return func(tokens int) {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			cnt := l.counter(id, time.Now())
+			cnt.Tokens += tokens
+			if stream && cnt.streams > 0 {
+				cnt.streams--
+			}
+			l.dirty = true
+		})
+	}, true
+}
+
+// caller return the counter id, name and limit of request,
+// the id of key is the hash of token. the non-zero limits of key overwrite the default.
+func (l *Limiter) caller(c *gin.Context) (string, string, *Limit) {
+	lim := l.c.Limit
+	key := Tenant(c.Request.Context())
+	if key == nil {
+		ip := "ip:" + c.ClientIP()
+		return ip, ip, &lim
+	}
+	if o := key.Limit; o != nil {
+		if o.RPM > 0 {
+			lim.RPM = o.RPM
+		}
+		if o.Streams > 0 {
+			lim.Streams = o.Streams
+		}
+		if o.DailyTokens > 0 {
+			lim.DailyTokens = o.DailyTokens
+		}
+	}
+	return "key:" + key.Id(), key.Name, &lim
+}
+
+// counter return the counter of caller, tokens are reset every day
+func (l *Limiter) counter(id string, now time.Time) *counter {
+	cnt, ok := l.counters[id]
+	if !ok {
+		cnt = &counter{}
+		l.counters[id] = cnt
+	}
+	if day := now.Format(dayLayout); cnt.Day != day {
+		cnt.Day = day
+		cnt.Tokens = 0
+	}
+	return cnt
+}
+
+func (l *Limiter) run(ctx context.Context) {
+	tk := time.NewTicker(l.c.Flush)
+	defer tk.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			l.Close()
+			return
+		case <-tk.C:
+			l.prune(time.Now())
+			// the counters are saved when file is set
+			l.Close()
+		}
+	}
+}
+
+// prune remove the counters without requests in the last minute,
+// streams and tokens of today, such as the ones of gone client ips.
+func (l *Limiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	day := now.Format(dayLayout)
+	for id, cnt := range l.counters {
+		if cnt.streams > 0 || (cnt.Day == day && cnt.Tokens > 0) {
+			continue
+		}
+		if n := len(cnt.Requests); n > 0 && now.Sub(cnt.Requests[n-1]) < time.Minute {
+			continue
+		}
+		delete(l.counters, id)
+		l.dirty = true
+	}
+}
+
+// Close save the counters of requests finished after ctx is done
+func (l *Limiter) Close() {
+	if l == nil || l.c.File == "" {
+		return
+	}
+	l.save()
+}
+
+func (l *Limiter) load() error {
+	bs, err := os.ReadFile(l.c.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return json.Unmarshal(bs, &l.counters)
+}
+
+// save write counters to a temp file and rename it
+func (l *Limiter) save() {
+	l.smu.Lock()
+	defer l.smu.Unlock()
+	l.mu.Lock()
+	if !l.dirty {
+		l.mu.Unlock()
+		return
+	}
+	bs, err := json.Marshal(l.counters)
+	l.dirty = false
+	l.mu.Unlock()
+	if err != nil {
+		klog.Errorf("marshal limit counters failed: %v", err)
+		return
+	}
+	tmp := l.c.File + ".tmp"
+	if err = os.WriteFile(tmp, bs, 0600); err == nil {
+		err = os.Rename(tmp, l.c.File)
+	}
+	if err != nil {
+		klog.Errorf("save limit counters failed: %v", err)
+	}
+}
+
+func abortWithLimit(c *gin.Context, retry time.Duration, class pkg.Class, msg string) {
+	c.Header("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retry.Seconds())))))
+	abortWithError(c, http.StatusTooManyRequests, errorType(class), string(class), msg)
+}
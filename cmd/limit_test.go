@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// acquire take the limit of the anonymous caller, and report the status
+func acquire(l *Limiter, stream bool) (func(int), int) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	release, ok := l.Acquire(c, stream)
+	if !ok {
+		return nil, w.Code
+	}
+	return release, http.StatusOK
+}
+
+func TestLimiterPersist(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conf := &LimitConf{
+		Limit: Limit{RPM: 2, DailyTokens: 100},
+		File:  filepath.Join(t.TempDir(), "limits.json"),
+	}
+	l := NewLimiter(ctx, conf)
+	release, code := acquire(l, false)
+	if code != http.StatusOK {
+		t.Fatalf("first request status %d", code)
+	}
+	release(100)
+	l.Close()
+
+	// the used tokens and requests are loaded after restart
+	l = NewLimiter(ctx, conf)
+	if _, code = acquire(l, false); code != http.StatusTooManyRequests {
+		t.Errorf("request after quota exhausted status %d, want 429", code)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.counters) != 1 {
+		t.Fatalf("%d counters loaded, want 1", len(l.counters))
+	}
+	for id, cnt := range l.counters {
+		if cnt.Tokens != 100 || len(cnt.Requests) != 1 {
+			t.Errorf("counter '%s' tokens %d requests %d, want 100 and 1", id, cnt.Tokens, len(cnt.Requests))
+		}
+	}
+}
+
+func TestLimiterStreams(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := NewLimiter(ctx, &LimitConf{Limit: Limit{Streams: 1}})
+
+	release, code := acquire(l, true)
+	if code != http.StatusOK {
+		t.Fatalf("first stream status %d", code)
+	}
+	if _, code = acquire(l, true); code != http.StatusTooManyRequests {
+		t.Errorf("second stream status %d, want 429", code)
+	}
+	// the non-stream request is not counted
+	if _, code = acquire(l, false); code != http.StatusOK {
+		t.Errorf("request status %d, want 200", code)
+	}
+	// release twice is released once
+	release(0)
+	release(0)
+	if _, code = acquire(l, true); code != http.StatusOK {
+		t.Errorf("stream after release status %d, want 200", code)
+	}
+}
+
+func TestLimiterPrune(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		l   = NewLimiter(ctx, &LimitConf{})
+		now = time.Now()
+		day = now.Format(dayLayout)
+	)
+	l.counters = map[string]*counter{
+		"ip:gone":      {Requests: []time.Time{now.Add(-2 * time.Minute)}, Day: day},
+		"ip:yesterday": {Day: now.AddDate(0, 0, -1).Format(dayLayout), Tokens: 10},
+		"ip:recent":    {Requests: []time.Time{now.Add(-2 * time.Minute), now.Add(-time.Second)}, Day: day},
+		"ip:tokens":    {Day: day, Tokens: 10},
+		"ip:stream":    {Day: day, streams: 1},
+	}
+	l.prune(now)
+	var ids []string
+	for id := range l.counters {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if want := []string{"ip:recent", "ip:stream", "ip:tokens"}; !slices.Equal(ids, want) {
+		t.Errorf("counters %v after prune, want %v", ids, want)
+	}
+}
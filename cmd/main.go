@@ -8,16 +8,12 @@ import (
 	"syscall"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	openapi "github.com/yylt/gptmux/api/go"
-	"github.com/yylt/gptmux/mux"
-	"github.com/yylt/gptmux/mux/claude"
-	"github.com/yylt/gptmux/mux/deepseek"
-	"github.com/yylt/gptmux/mux/merlin"
-	"github.com/yylt/gptmux/mux/ollama"
-	"github.com/yylt/gptmux/mux/openai"
-	"github.com/yylt/gptmux/mux/rkllm"
-	"github.com/yylt/gptmux/mux/zhipu"
-
+	"github.com/yylt/gptmux/pkg/cache"
+	"github.com/yylt/gptmux/pkg/record"
+	"github.com/yylt/gptmux/pkg/tracing"
 	"k8s.io/klog/v2"
 )
 
@@ -33,53 +29,66 @@ func main() {
 		panic(err)
 	}
 	ctx := SetupSignalHandler()
-
-	var ms []mux.Model
-	ds := deepseek.New(&cfg.Deepseek)
-	if ds != nil {
-		ms = append(ms, ds)
-	}
-	ml := merlin.NewMerlinIns(&cfg.Merlin)
-	if ml != nil {
-		ms = append(ms, ml)
-	}
-	zp := zhipu.New(&cfg.Zhipu)
-	if zp != nil {
-		ms = append(ms, zp)
-	}
-	apidp := openai.New(ctx, &cfg.DeepseekApi)
-	if apidp != nil {
-		ms = append(ms, apidp)
+	shutdown, err := tracing.Setup(ctx, cfg.Trace)
+	if err != nil {
+		panic(err)
 	}
-	ca := claude.New(ctx, &cfg.Claude)
-	if ca != nil {
-		ms = append(ms, ca)
+	defer shutdown(context.Background())
+
+	backends := &Backends{}
+	ms, failed, err := backends.Build(ctx, cfg)
+	if err != nil {
+		panic(err)
 	}
-	rk := rkllm.New(&cfg.Rkllm)
-	if rk != nil {
-		ms = append(ms, rk)
+	if cfg.FailFast && !usable(cfg.Routes, ms) {
+		klog.Fatalf("no backend is usable, failed providers: %v", failed)
 	}
-
-	ollm := ollama.New(ctx, &cfg.Ollama)
-	if ollm != nil {
-		ms = append(ms, ollm)
-
+	backends.Commit(nil)
+	chat := NewController(ctx, cfg.Debug, cfg.Routes, ms...)
+	chat.failed = failed
+	chat.limiter = NewLimiter(ctx, cfg.Limits)
+	chat.recorder, err = record.New(cfg.Record)
+	if err != nil {
+		panic(err)
 	}
-	sili := openai.New(ctx, &cfg.Silicon)
-	if sili != nil {
-		ms = append(ms, sili)
+	chat.cache = cache.New(ctx, cfg.Cache)
+	chat.intent, err = NewIntent(chat, cfg.Intent)
+	if err != nil {
+		panic(err)
 	}
-	chat := NewController(ctx, cfg.Debug, ms...)
 
 	muxhandler := openapi.ApiHandleFunctions{
 		ChatAPI:        chat,
 		CompletionsAPI: chat,
+		EmbeddingsAPI:  chat,
+		ImagesAPI:      chat,
 		ModelsAPI:      chat,
 	}
+	auth, err := NewAuth(cfg.Auth)
+	if err != nil {
+		panic(err)
+	}
+	prometheus.MustRegister(newAccountCollector(chat))
+	reloader := NewReloader(*cp, chat, backends, auth)
+	go reloader.Run(ctx)
+
 	e := gin.Default()
+	// metrics and probes are served without key
+	e.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	e.GET("/healthz", chat.Healthz)
+	e.GET("/readyz", chat.Readyz)
+	e.Use(chat.Drain, tracing.Handler, reloader.Auth)
 	openapi.NewRouterWithGinEngine(e, muxhandler)
+	e.GET("/status", chat.Status)
+	chat.RegisterAdmin(e)
 
-	e.Run(cfg.Addr)
+	if err = serve(ctx, e, chat, cfg.Addr, cfg.Drain); err != nil {
+		klog.Errorf("serve failed: %v", err)
+	}
+	backends.Close()
+	chat.limiter.Close()
+	chat.recorder.Close()
+	chat.cache.Close()
 }
 
 func SetupSignalHandler() context.Context {
@@ -90,7 +99,9 @@ func SetupSignalHandler() context.Context {
 	go func() {
 		<-c
 		cancel()
-		os.Exit(0)
+		// the second signal exit without drain
+		<-c
+		os.Exit(1)
 	}()
 
 	return ctx
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	api "github.com/yylt/gptmux/api/go"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/mux/merlin"
+	"github.com/yylt/gptmux/pkg"
+)
+
+const (
+	namespace = "gptmux"
+
+	// outcome class of a successful attempt
+	classOK = "ok"
+)
+
+var (
+	backendRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_requests_total",
+		Help:      "Backend attempts by outcome class.",
+	}, []string{"backend", "endpoint", "class"})
+
+	failovers = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "failovers_total",
+		Help:      "Attempts made after a failed backend, by the backend failed over to.",
+	}, []string{"backend", "endpoint"})
+
+	busyRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "busy_rejections_total",
+		Help:      "Attempts rejected because the backend is busy.",
+	}, []string{"backend"})
+
+	firstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "first_token_seconds",
+		Help:      "Time to the first streamed content of backend.",
+		Buckets:   []float64{.1, .25, .5, 1, 2, 4, 8, 15, 30},
+	}, []string{"backend", "endpoint"})
+
+	backendDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backend_duration_seconds",
+		Help:      "Total latency of backend attempts.",
+		Buckets:   []float64{.25, .5, 1, 2, 4, 8, 15, 30, 60, 120},
+	}, []string{"backend", "endpoint"})
+
+	tokenCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_total",
+		Help:      "Tokens of backend, direction is in (prompt) or out (completion).",
+	}, []string{"backend", "direction"})
+
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Chat requests by cache result, hit, miss or bypass.",
+	}, []string{"result"})
+
+	inflightStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "inflight_streams",
+		Help:      "Streamed requests in progress.",
+	})
+)
+
+// observeAttempt record the outcome and latency of one backend attempt
+func observeAttempt(endpoint string, m *mux.Candidate, start time.Time, g *gate, err error) {
+	class := classOK
+	if err != nil && !errors.Is(err, io.EOF) {
+		class = string(pkg.Classify(err))
+	}
+	backendRequests.WithLabelValues(m.Name(), endpoint, class).Inc()
+	backendDuration.WithLabelValues(m.Name(), endpoint).Observe(time.Since(start).Seconds())
+	if d := g.FirstToken(); d > 0 {
+		firstToken.WithLabelValues(m.Name(), endpoint).Observe(d.Seconds())
+	}
+	if class == string(pkg.ClassBusy) {
+		busyRejections.WithLabelValues(m.Name()).Inc()
+	}
+}
+
+// observeTokens record the tokens consumed on backend
+func observeTokens(backend string, u *api.V1ChatCompletionsPost200ResponseUsage) {
+	tokenCount.WithLabelValues(backend, "in").Add(float64(u.PromptTokens))
+	tokenCount.WithLabelValues(backend, "out").Add(float64(u.CompletionTokens))
+}
+
+// accountCollector export the merlin account usage at scrape time
+type accountCollector struct {
+	ca *Controller
+
+	used  *prometheus.Desc
+	limit *prometheus.Desc
+}
+
+func newAccountCollector(ca *Controller) *accountCollector {
+	labels := []string{"backend", "user"}
+	return &accountCollector{
+		ca:    ca,
+		used:  prometheus.NewDesc(namespace+"_merlin_used", "Used quota of merlin account.", labels, nil),
+		limit: prometheus.NewDesc(namespace+"_merlin_limit", "Quota limit of merlin account.", labels, nil),
+	}
+}
+
+func (ac *accountCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ac.used
+	ch <- ac.limit
+}
+
+func (ac *accountCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range ac.ca.Router().Models() {
+		ml, ok := m.(*merlin.Merlin)
+		if !ok {
+			continue
+		}
+		for _, a := range ml.Accounts() {
+			ch <- prometheus.MustNewConstMetric(ac.used, prometheus.GaugeValue, float64(a.Used), m.Name(), a.User)
+			ch <- prometheus.MustNewConstMetric(ac.limit, prometheus.GaugeValue, float64(a.Limit), m.Name(), a.User)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/mux/claude"
+	"github.com/yylt/gptmux/mux/deepseek"
+	"github.com/yylt/gptmux/mux/merlin"
+	"github.com/yylt/gptmux/mux/mock"
+	"github.com/yylt/gptmux/mux/ollama"
+	"github.com/yylt/gptmux/mux/openai"
+	"github.com/yylt/gptmux/mux/replay"
+	"github.com/yylt/gptmux/mux/rkllm"
+	"github.com/yylt/gptmux/mux/zhipu"
+	"gopkg.in/yaml.v3"
+	"k8s.io/klog/v2"
+)
+
+// factory decode the settings of one provider type and build the backend
+type factory struct {
+	conf  func() any
+	build func(ctx context.Context, conf any) mux.Model
+}
+
+var registry = map[string]*factory{}
+
+func init() {
+	register("openai", openai.New)
+	register("ollama", ollama.New)
+	register("claude", claude.New)
+	register("merlin", noCtx(merlin.NewMerlinIns))
+	register("deepseek", noCtx(deepseek.New))
+	register("zhipu", noCtx(zhipu.New))
+	register("rkllm", noCtx(rkllm.New))
+	register("replay", noCtx(replay.New))
+	register("mock", noCtx(mock.New))
+}
+
+func noCtx[T any, M mux.Model](fn func(*T) M) func(context.Context, *T) M {
+	return func(_ context.Context, c *T) M {
+		return fn(c)
+	}
+}
+
+// register add a provider type, constructors return nil when the config is invalid
+func register[T any, M mux.Model](typ string, fn func(context.Context, *T) M) {
+	registry[typ] = &factory{
+		conf: func() any {
+			return new(T)
+		},
+		build: func(ctx context.Context, conf any) mux.Model {
+			m := fn(ctx, conf.(*T))
+			if v := reflect.ValueOf(m); !v.IsValid() || v.IsNil() {
+				return nil
+			}
+			return m
+		},
+	}
+}
+
+// ProviderTypes return the registered provider types
+func ProviderTypes() []string {
+	var ret []string
+	for k := range registry {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Provider is one backend instance, other fields are the settings of its type.
+type Provider struct {
+	Type string
+	Name string
+
+	conf any
+}
+
+func (p *Provider) UnmarshalYAML(node *yaml.Node) error {
+	var meta struct {
+		Type string `yaml:"type"`
+		Name string `yaml:"name"`
+	}
+	if err := node.Decode(&meta); err != nil {
+		return err
+	}
+	f, ok := registry[meta.Type]
+	if !ok {
+		return fmt.Errorf("provider '%s' type '%s' is unknown, support %v", meta.Name, meta.Type, ProviderTypes())
+	}
+	conf := f.conf()
+	if err := node.Decode(conf); err != nil {
+		return fmt.Errorf("provider '%s' is invalid: %v", meta.Name, err)
+	}
+	p.Type = meta.Type
+	p.Name = meta.Name
+	p.conf = conf
+	return nil
+}
+
+// Build return the backend, or nil when the settings are invalid
+func (p *Provider) Build(ctx context.Context) mux.Model {
+	f, ok := registry[p.Type]
+	if !ok || p.conf == nil {
+		return nil
+	}
+	return f.build(ctx, p.conf)
+}
+
+// sum return the identity of provider settings, only the connection and
+// credential settings, the shared options except name and the index are
+// applied to the kept backend, so its login is not lost.
+func (p *Provider) sum() string {
+	conf := p.conf
+	if v := reflect.ValueOf(conf); v.Kind() == reflect.Pointer && v.Elem().Kind() == reflect.Struct {
+		cp := reflect.New(v.Elem().Type())
+		cp.Elem().Set(v.Elem())
+		opts, index := shared(cp.Interface())
+		if opts.IsValid() {
+			opts.Set(reflect.ValueOf(mux.Options{Name: opts.Interface().(mux.Options).Name}))
+		}
+		if index.IsValid() {
+			index.SetInt(0)
+		}
+		conf = cp.Interface()
+	}
+	bs, err := yaml.Marshal(conf)
+	if err != nil {
+		return ""
+	}
+	return p.Type + "\n" + string(bs)
+}
+
+// apply update the kept backend to the options and index of provider,
+// the name set by its constructor is kept. it return the func to undo.
+func (p *Provider) apply(kept mux.Model) func() {
+	cm, ok := kept.(mux.Configurable)
+	no, ni := shared(p.conf)
+	if !ok || !no.IsValid() || !ni.IsValid() {
+		return func() {}
+	}
+	old, index := cm.Options(), kept.Index()
+	opts := no.Interface().(mux.Options)
+	opts.Name = old.Name
+	cm.Update(&opts, int(ni.Int()))
+	return func() {
+		cm.Update(old, index)
+	}
+}
+
+// shared return the inline options and the index of provider settings
+func shared(conf any) (opts, index reflect.Value) {
+	v := reflect.ValueOf(conf)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	v = v.Elem()
+	if f := v.FieldByName("Options"); f.IsValid() && f.Type() == reflect.TypeOf(mux.Options{}) {
+		opts = f
+	}
+	if f := v.FieldByName("Index"); f.IsValid() && f.Kind() == reflect.Int {
+		index = f
+	}
+	return
+}
+
+// Backends keep the built backends by settings,
+// unchanged providers are reused when the config is reloaded.
+type Backends struct {
+	built map[string]mux.Model
+	// built by the last Build, used after Commit
+	next map[string]mux.Model
+	// undo the options applied to the kept backends by the last Build
+	undo []func()
+}
+
+// Build create backends of the providers list and the old top-level keys,
+// backend names must be unique. failed is the providers which can not be created.
+// the backends are kept after Commit, or closed by Discard.
+func (b *Backends) Build(ctx context.Context, cfg *Config) (ms []mux.Model, failed []string, err error) {
+	var (
+		names  = map[string]string{}
+		legacy = cfg.legacy()
+	)
+	b.next, b.undo = map[string]mux.Model{}, nil
+	for i, p := range append(legacy, cfg.Providers...) {
+		var (
+			m   mux.Model
+			sum = p.sum()
+		)
+		kept, reused := b.built[sum]
+		if reused && sum != "" {
+			m = kept
+			b.undo = append(b.undo, p.apply(kept))
+		} else {
+			m, reused = p.Build(ctx), false
+		}
+		if m == nil {
+			// the unset top-level keys are not failures
+			if i >= len(legacy) {
+				klog.Errorf("provider '%s' type '%s' create failed", cmp.Or(p.Name, p.Type), p.Type)
+				failed = append(failed, cmp.Or(p.Name, p.Type))
+			}
+			continue
+		}
+		if typ, ok := names[m.Name()]; ok {
+			if !reused {
+				closeModel(m)
+			}
+			b.Discard()
+			return nil, nil, fmt.Errorf("provider name '%s' is duplicated, type '%s' and '%s'", m.Name(), typ, p.Type)
+		}
+		names[m.Name()] = p.Type
+		if reused {
+			klog.Infof("provider '%s' type '%s' is unchanged", m.Name(), p.Type)
+		} else {
+			klog.Infof("provider '%s' type '%s' created", m.Name(), p.Type)
+		}
+		b.next[sum] = m
+		ms = append(ms, m)
+	}
+	return ms, failed, nil
+}
+
+// Commit use the backends of the last Build, the removed ones of old router
+// are closed in background after their requests in flight finish.
+func (b *Backends) Commit(old *mux.Router) {
+	removed := b.diff(b.built, b.next)
+	b.built, b.next, b.undo = b.next, nil, nil
+	for _, m := range removed {
+		go func() {
+			if old != nil && old.Health(m) != nil {
+				old.Health(m).Drain()
+			}
+			closeModel(m)
+		}()
+	}
+}
+
+// Discard close the backends created by the last Build,
+// the kept backends get their options back.
+func (b *Backends) Discard() {
+	created := b.diff(b.next, b.built)
+	for i := len(b.undo) - 1; i >= 0; i-- {
+		b.undo[i]()
+	}
+	b.next, b.undo = nil, nil
+	closeModels(created)
+}
+
+// Close close all backends
+func (b *Backends) Close() {
+	closeModels(b.diff(b.built, nil))
+	b.built = nil
+}
+
+// diff return the backends of a which are not in b
+func (b *Backends) diff(a, o map[string]mux.Model) []mux.Model {
+	keep := map[mux.Model]bool{}
+	for _, m := range o {
+		keep[m] = true
+	}
+	var ret []mux.Model
+	for _, m := range a {
+		if !keep[m] {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+func closeModels(ms []mux.Model) {
+	for _, m := range ms {
+		closeModel(m)
+	}
+}
+
+// closeModel release the resources of backend which implement io.Closer
+func closeModel(m mux.Model) {
+	c, ok := m.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := c.Close(); err != nil {
+		klog.Warningf("close backend '%s' failed: %v", m.Name(), err)
+		return
+	}
+	klog.Infof("backend '%s' closed", m.Name())
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/yylt/gptmux/mux"
+	"gopkg.in/yaml.v3"
+)
+
+func loadConfig(t *testing.T, s string) *Config {
+	t.Helper()
+	cfg := &Config{}
+	if err := yaml.Unmarshal([]byte(s), cfg); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestBackendsReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		b   = &Backends{}
+		old = loadConfig(t, `
+providers:
+  - {type: mock, name: a, index: 1, script: [hi], language: {mode: none}}
+  - {type: mock, name: b, script: [hi]}
+`)
+		next = loadConfig(t, `
+providers:
+  - {type: mock, name: a, index: 5, script: [hi], language: {mode: force, lang: english}, first_token_timeout: 1s}
+  - {type: mock, name: b, script: [bye]}
+`)
+	)
+	ms, _, err := b.Build(ctx, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Commit(nil)
+	a := ms[0]
+
+	// the requests read the options while they are updated
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_, _ = llms.GenerateFromSinglePrompt(ctx, a, "hello")
+		}
+	}()
+	nms, _, err := b.Build(ctx, next)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the options and index changed, the backend is kept
+	if nms[0] != a {
+		t.Fatal("backend 'a' is rebuilt when only its options changed")
+	}
+	if nms[1] == ms[1] {
+		t.Fatal("backend 'b' is kept when its script changed")
+	}
+	opts := a.(mux.Configurable).Options()
+	if a.Index() != 5 || opts.Language.Mode != mux.LangForce || opts.FirstToken == 0 || opts.Name != "a" {
+		t.Errorf("kept backend index %d options %+v, want the new ones", a.Index(), opts)
+	}
+
+	// the discarded build give back the old options
+	b.Discard()
+	opts = a.(mux.Configurable).Options()
+	if a.Index() != 1 || opts.Language.Mode != mux.LangNone || opts.FirstToken != 0 {
+		t.Errorf("discarded backend index %d options %+v, want the old ones", a.Index(), opts)
+	}
+}
+
+func TestProviderUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+		typ  string
+		// part of the error, empty when valid
+		err string
+	}{
+		{name: "mock", conf: "{type: mock, name: a, index: 2}", typ: "mock"},
+		{name: "unknown type", conf: "{type: gpt, name: a}", err: "type 'gpt' is unknown"},
+		{name: "invalid settings", conf: "{type: mock, name: a, index: two}", err: "provider 'a' is invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Provider{}
+			err := yaml.Unmarshal([]byte(tt.conf), p)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error '%v', want '%s'", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Type != tt.typ || p.Name != "a" || p.Build(context.Background()) == nil {
+				t.Errorf("provider type '%s' name '%s' is not built", p.Type, p.Name)
+			}
+		})
+	}
+	if types := ProviderTypes(); !slices.IsSorted(types) || !slices.Contains(types, "openai") {
+		t.Errorf("provider types %v", types)
+	}
+}
+
+func TestProviderSum(t *testing.T) {
+	sum := func(conf string) string {
+		p := &Provider{}
+		if err := yaml.Unmarshal([]byte(conf), p); err != nil {
+			t.Fatal(err)
+		}
+		return p.sum()
+	}
+	base := sum("{type: mock, name: a, script: [hi]}")
+	for conf, same := range map[string]bool{
+		"{type: mock, name: a, script: [hi]}":                                     true,
+		"{type: mock, name: a, script: [hi], index: 3}":                           true,
+		"{type: mock, name: a, script: [hi], language: {mode: force}}":            true,
+		"{type: mock, name: a, script: [hi], breaker: {failures: 1}}":             true,
+		"{type: mock, name: a, script: [hi], first_token_timeout: 1s}":            true,
+		"{type: mock, name: b, script: [hi]}":                                     false,
+		"{type: mock, name: a, script: [bye]}":                                    false,
+		"{type: openai, name: a, baseurl: http://localhost, apikey: k, model: m}": false,
+	} {
+		if got := sum(conf) == base; got != same {
+			t.Errorf("sum of %s same %v, want %v", conf, got, same)
+		}
+	}
+}
+
+func TestBackendsBuild(t *testing.T) {
+	ctx := context.Background()
+
+	b := &Backends{}
+	_, _, err := b.Build(ctx, loadConfig(t, `
+providers:
+  - {type: mock, name: a}
+  - {type: mock, name: a}
+`))
+	if err == nil || !strings.Contains(err.Error(), "duplicated") {
+		t.Errorf("duplicated names error '%v'", err)
+	}
+
+	// the invalid providers are failed, the unset top-level keys are not
+	ms, failed, err := b.Build(ctx, loadConfig(t, `
+providers:
+  - {type: mock, name: a}
+  - {type: openai, name: bad}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 1 || ms[0].Name() != "a" || !slices.Equal(failed, []string{"bad"}) {
+		t.Errorf("built %d backends, failed %v", len(ms), failed)
+	}
+}
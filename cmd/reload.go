@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gin-gonic/gin"
+	"k8s.io/klog/v2"
+)
+
+// debounce the writes of one config change
+const reloadDelay = 500 * time.Millisecond
+
+// Reloader apply the config file again when it changed or SIGHUP is received.
+// backends, routes and auth keys are reloaded, other settings need a restart.
+type Reloader struct {
+	mu sync.Mutex
+
+	path     string
+	ca       *Controller
+	backends *Backends
+	auth     atomic.Pointer[Auth]
+}
+
+func NewReloader(path string, ca *Controller, backends *Backends, auth *Auth) *Reloader {
+	r := &Reloader{
+		path:     path,
+		ca:       ca,
+		backends: backends,
+	}
+	r.auth.Store(auth)
+	return r
+}
+
+// Auth is the auth handler of the current keys
+func (r *Reloader) Auth(c *gin.Context) {
+	r.auth.Load().Handler(c)
+}
+
+// Reload validate the config and swap it in, the old one is kept on error
+func (r *Reloader) Reload(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cfg, err := LoadConfigmap(r.path)
+	if err != nil {
+		return err
+	}
+	auth, err := NewAuth(cfg.Auth)
+	if err != nil {
+		return err
+	}
+	ms, failed, err := r.backends.Build(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.FailFast && !usable(cfg.Routes, ms) {
+		r.backends.Discard()
+		return fmt.Errorf("no backend is usable, failed providers: %v", failed)
+	}
+	old := r.ca.Swap(cfg.Routes, failed, ms...)
+	r.backends.Commit(old)
+	r.auth.Store(auth)
+	klog.Infof("config %s reloaded, %d backends", r.path, len(ms))
+	return nil
+}
+
+// Run watch the config file and SIGHUP until ctx is done.
+// the directory is watched, so editors and configmaps which replace the file work.
+func (r *Reloader) Run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var (
+		events chan fsnotify.Event
+		errs   chan error
+	)
+	w, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = w.Add(filepath.Dir(r.path))
+	}
+	if err != nil {
+		klog.Warningf("watch config %s failed, reload on SIGHUP only: %v", r.path, err)
+	} else {
+		defer w.Close()
+		events, errs = w.Events, w.Errors
+	}
+
+	var (
+		timer = time.NewTimer(reloadDelay)
+		file  = filepath.Clean(r.path)
+	)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			klog.Infof("SIGHUP received, reload config")
+			r.reload(ctx)
+		case ev := <-events:
+			// configmap update the ..data link in the same directory
+			if filepath.Clean(ev.Name) != file && filepath.Base(ev.Name) != "..data" {
+				continue
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				timer.Reset(reloadDelay)
+			}
+		case err := <-errs:
+			klog.Warningf("watch config %s failed: %v", r.path, err)
+		case <-timer.C:
+			r.reload(ctx)
+		}
+	}
+}
+
+func (r *Reloader) reload(ctx context.Context) {
+	if err := r.Reload(ctx); err != nil {
+		klog.Errorf("reload config %s failed, keep the current one: %v", r.path, err)
+	}
+}
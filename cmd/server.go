@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yylt/gptmux/pkg"
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultDrain = 30 * time.Second
+	// wait the terminated streams to write the error frame
+	terminateGrace = 2 * time.Second
+
+	shuttingDown = "server_shutting_down"
+)
+
+// errShutdown is the error of requests terminated by the drain timeout
+var errShutdown = pkg.NewError(pkg.ClassUnavailable, "server is shutting down")
+
+// Drain count the requests in flight, new ones are refused when draining
+func (ca *Controller) Drain(c *gin.Context) {
+	if ca.draining.Load() {
+		c.Header("Connection", "close")
+		abortWithError(c, http.StatusServiceUnavailable, serverErr, shuttingDown, "The server is shutting down")
+		return
+	}
+	ca.inflight.Add(1)
+	defer ca.inflight.Add(-1)
+	c.Next()
+}
+
+// serve run the http server until ctx is done, then drain the requests
+// in flight. the listener is kept during drain, so new requests get 503
+// and readyz fails. the ones still running after drain timeout are terminated.
+func serve(ctx context.Context, e *gin.Engine, ca *Controller, addr string, drain time.Duration) error {
+	if drain <= 0 {
+		drain = defaultDrain
+	}
+	var (
+		srv  = &http.Server{Addr: addr, Handler: e}
+		errc = make(chan error, 1)
+	)
+	go func() {
+		klog.Infof("listen on %s", addr)
+		errc <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	klog.Infof("shutting down, drain %d requests in %s", ca.inflight.Load(), drain)
+	ca.draining.Store(true)
+	srv.SetKeepAlivesEnabled(false)
+	if !wait(&ca.inflight, drain) {
+		klog.Warningf("drain timeout, terminate %d requests", ca.inflight.Load())
+		ca.stop()
+		wait(&ca.inflight, terminateGrace)
+	}
+	sctx, cancel := context.WithTimeout(context.Background(), terminateGrace)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		klog.Warningf("shutdown server failed: %v", err)
+		return srv.Close()
+	}
+	klog.Infof("server stopped")
+	return nil
+}
+
+// wait until n is zero, false on timeout
+func wait(n *atomic.Int64, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for n.Load() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
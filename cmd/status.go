@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/mux/mock"
+)
+
+type backendStatus struct {
+	Name     string `json:"name"`
+	Index    int    `json:"index"`
+	Routable bool   `json:"routable"`
+	Disabled bool   `json:"disabled,omitempty"`
+	// login state of account backends
+	Credential *mux.Credential `json:"credential,omitempty"`
+	// recent calls of mock backend
+	Calls []*mock.Call `json:"calls,omitempty"`
+
+	*mux.HealthStatus
+}
+
+// Status Get /status
+// backends in routing order with circuit state
+func (ca *Controller) Status(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"backends": ca.backends(),
+		"failed":   ca.Failed(),
+	})
+}
+
+func (ca *Controller) backends() []*backendStatus {
+	var (
+		ret    []*backendStatus
+		router = ca.Router()
+	)
+	for _, m := range router.Models() {
+		st := &backendStatus{
+			Name:         m.Name(),
+			Index:        router.Index(m),
+			Routable:     router.Routable(m),
+			Disabled:     router.Disabled(m),
+			HealthStatus: router.Health(m).Status(),
+		}
+		if am, ok := m.(mux.Authenticator); ok {
+			st.Credential = am.Credential()
+		}
+		if mk, ok := m.(*mock.Mock); ok {
+			st.Calls = mk.Calls()
+		}
+		ret = append(ret, st)
+	}
+	return ret
+}
+
+// Healthz Get /healthz
+// the process is alive
+func (ca *Controller) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz Get /readyz
+// at least one routable backend can serve, and not draining
+func (ca *Controller) Readyz(c *gin.Context) {
+	if ca.draining.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+		return
+	}
+	if !ca.Ready() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// usable report whether any backend can be routed,
+// the backends with accounts need one logged in.
+func usable(routes []*mux.Route, ms []mux.Model) bool {
+	router := mux.NewRouter(routes, ms...)
+	for _, m := range ms {
+		if router.Routable(m) && loggedIn(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// loggedIn report whether any account of backend is logged in
+func loggedIn(m mux.Model) bool {
+	am, ok := m.(mux.Authenticator)
+	return !ok || am.Credential().LoggedIn > 0
+}
+
+// Ready report whether any routable backend is healthy
+func (ca *Controller) Ready() bool {
+	router := ca.Router()
+	for _, m := range router.Models() {
+		if router.Routable(m) && loggedIn(m) && router.Health(m).Ready() {
+			return true
+		}
+	}
+	return false
+}
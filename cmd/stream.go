@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tmc/langchaingo/llms"
+	api "github.com/yylt/gptmux/api/go"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/pkg/record"
+)
+
+const (
+	chatObject       = "chat.completion"
+	chatChunkObject  = "chat.completion.chunk"
+	completionObject = "text_completion"
+
+	finishStop = "stop"
+)
+
+var (
+	sseData = []byte("data: ")
+	sseEnd  = []byte("\n\n")
+	sseDone = []byte("data: [DONE]\n\n")
+)
+
+type chatChunk struct {
+	Id      string            `json:"id"`
+	Object  string            `json:"object"`
+	Created int64             `json:"created"`
+	Model   string            `json:"model"`
+	Choices []chatChunkChoice `json:"choices"`
+
+	Usage *api.V1ChatCompletionsPost200ResponseUsage `json:"usage,omitempty"`
+}
+
+type chatChunkChoice struct {
+	Index        int32                                                 `json:"index"`
+	Delta        api.V1ChatCompletionsPost200ResponseChoicesInnerDelta `json:"delta"`
+	FinishReason *string                                               `json:"finish_reason"`
+}
+
+type completionChunk struct {
+	Id      string                  `json:"id"`
+	Object  string                  `json:"object"`
+	Created int64                   `json:"created"`
+	Model   string                  `json:"model"`
+	Choices []completionChunkChoice `json:"choices"`
+
+	Usage *api.V1ChatCompletionsPost200ResponseUsage `json:"usage,omitempty"`
+}
+
+type completionChunkChoice struct {
+	Index        int32   `json:"index"`
+	Text         string  `json:"text"`
+	Logprobs     any     `json:"logprobs"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+// streamWriter write openai style data-only server-sent events,
+// headers are sent with the first frame.
+type streamWriter struct {
+	c       *gin.Context
+	id      string
+	object  string
+	model   string
+	created int64
+
+	started bool
+	// record the sent chunks, nil when recorder is off
+	rec *record.Record
+	// keep the sent contents for cache
+	keep   bool
+	chunks []string
+}
+
+func newStreamWriter(c *gin.Context, object, model string) *streamWriter {
+	return &streamWriter{
+		c:       c,
+		id:      newId(object),
+		object:  object,
+		model:   model,
+		created: time.Now().UTC().Unix(),
+	}
+}
+
+// newId return a request id, chatcmpl-xxx or cmpl-xxx
+func newId(object string) string {
+	prefix := "cmpl-"
+	if strings.HasPrefix(object, chatObject) {
+		prefix = "chatcmpl-"
+	}
+	return prefix + strings.ReplaceAll(uuid.NewString(), "-", "")
+}
+
+// Started report whether any frame had been sent
+func (s *streamWriter) Started() bool {
+	return s.started
+}
+
+// Write send content, the first chat frame only carries the role
+func (s *streamWriter) Write(content string) error {
+	if content == "" {
+		return nil
+	}
+	if s.object == completionObject {
+		s.rec.Chunk(content)
+		return s.send(s.completion(content, nil))
+	}
+	if err := s.begin(); err != nil {
+		return err
+	}
+	s.rec.Chunk(content)
+	if s.keep {
+		s.chunks = append(s.chunks, content)
+	}
+	return s.send(s.chat(api.V1ChatCompletionsPost200ResponseChoicesInnerDelta{
+		Content: content,
+	}, nil))
+}
+
+// ToolCalls send the assembled tool calls in one frame
+func (s *streamWriter) ToolCalls(calls []api.V1ChatCompletionsPost200ResponseChoicesInnerDeltaToolCallsInner) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	return s.send(s.chat(api.V1ChatCompletionsPost200ResponseChoicesInnerDelta{
+		ToolCalls: calls,
+	}, nil))
+}
+
+// begin send the first chat frame which only carries the role
+func (s *streamWriter) begin() error {
+	if s.started {
+		return nil
+	}
+	return s.send(s.chat(api.V1ChatCompletionsPost200ResponseChoicesInnerDelta{
+		Role: mux.RoleAssistant,
+	}, nil))
+}
+
+// Finish send the frame with finish reason, the usage frame with empty
+// choices if usage is not nil, and the [DONE] marker.
+func (s *streamWriter) Finish(reason string, usage *api.V1ChatCompletionsPost200ResponseUsage) error {
+	var err error
+	if s.object == completionObject {
+		err = s.send(s.completion("", &reason))
+	} else {
+		if err = s.begin(); err != nil {
+			return err
+		}
+		err = s.send(s.chat(api.V1ChatCompletionsPost200ResponseChoicesInnerDelta{}, &reason))
+	}
+	if err != nil {
+		return err
+	}
+	if usage != nil {
+		if err = s.send(s.usage(usage)); err != nil {
+			return err
+		}
+	}
+	return s.Done()
+}
+
+// Done send the [DONE] marker
+func (s *streamWriter) Done() error {
+	s.header()
+	_, err := s.c.Writer.Write(sseDone)
+	s.c.Writer.Flush()
+	return err
+}
+
+// Error send the error event and the [DONE] marker, used when
+// the backend failed after the stream started.
+func (s *streamWriter) Error(detail errorDetail) error {
+	if err := s.send(&errorResp{Error: detail}); err != nil {
+		return err
+	}
+	return s.Done()
+}
+
+func (s *streamWriter) chat(delta api.V1ChatCompletionsPost200ResponseChoicesInnerDelta, reason *string) *chatChunk {
+	return &chatChunk{
+		Id:      s.id,
+		Object:  chatChunkObject,
+		Created: s.created,
+		Model:   s.model,
+		Choices: []chatChunkChoice{
+			{Delta: delta, FinishReason: reason},
+		},
+	}
+}
+
+func (s *streamWriter) completion(text string, reason *string) *completionChunk {
+	return &completionChunk{
+		Id:      s.id,
+		Object:  completionObject,
+		Created: s.created,
+		Model:   s.model,
+		Choices: []completionChunkChoice{
+			{Text: text, FinishReason: reason},
+		},
+	}
+}
+
+func (s *streamWriter) usage(usage *api.V1ChatCompletionsPost200ResponseUsage) any {
+	if s.object == completionObject {
+		return &completionChunk{
+			Id:      s.id,
+			Object:  completionObject,
+			Created: s.created,
+			Model:   s.model,
+			Choices: []completionChunkChoice{},
+			Usage:   usage,
+		}
+	}
+	return &chatChunk{
+		Id:      s.id,
+		Object:  chatChunkObject,
+		Created: s.created,
+		Model:   s.model,
+		Choices: []chatChunkChoice{},
+		Usage:   usage,
+	}
+}
+
+func (s *streamWriter) send(v any) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.header()
+	w := s.c.Writer
+	if _, err = w.Write(sseData); err != nil {
+		return err
+	}
+	if _, err = w.Write(bs); err != nil {
+		return err
+	}
+	if _, err = w.Write(sseEnd); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+func (s *streamWriter) header() {
+	if s.started {
+		return
+	}
+	s.started = true
+	h := s.c.Writer.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Accel-Buffering", "no")
+	s.c.Status(http.StatusOK)
+	s.c.Writer.WriteHeaderNow()
+}
+
+// gate hold back the stream until the first real content, so the request
+// can fail over silently when the backend failed or timed out before it.
+type gate struct {
+	mu sync.Mutex
+
+	sw     *streamWriter
+	buf    *bytes.Buffer
+	cancel context.CancelFunc
+	timer  *time.Timer
+	start  time.Time
+	first  time.Duration
+
+	// whitespace chunks before the first content
+	pending []string
+	opened  bool
+	closed  bool
+	expired bool
+}
+
+// newGate return the gate of one attempt, cancel abort the attempt
+func newGate(sw *streamWriter, buf *bytes.Buffer, timeout time.Duration, cancel context.CancelFunc) *gate {
+	g := &gate{
+		sw:     sw,
+		buf:    buf,
+		cancel: cancel,
+		start:  time.Now(),
+	}
+	if timeout > 0 {
+		g.timer = time.AfterFunc(timeout, g.expire)
+	}
+	return g
+}
+
+// Write is the streaming func of backend, abort the backend when client gone
+func (g *gate) Write(ctx context.Context, chunk []byte) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return io.EOF
+	}
+	if len(chunk) == 0 {
+		return nil
+	}
+	if !g.opened {
+		if strings.TrimSpace(string(chunk)) == "" {
+			g.pending = append(g.pending, string(chunk))
+			return nil
+		}
+		g.open()
+		if err := g.flush(); err != nil {
+			return err
+		}
+	}
+	return g.write(string(chunk))
+}
+
+// Close end the attempt, success flush the held chunks.
+// it report whether the first token timed out.
+func (g *gate) Close(success bool) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	if success && !g.closed {
+		g.flush()
+	}
+	g.closed = true
+	return g.expired
+}
+
+func (g *gate) expire() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.opened || g.closed {
+		return
+	}
+	g.closed = true
+	g.expired = true
+	g.cancel()
+}
+
+// FirstToken return the time to the first content, 0 when none
+func (g *gate) FirstToken() time.Duration {
+	if g == nil {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.first
+}
+
+func (g *gate) open() {
+	g.opened = true
+	g.first = time.Since(g.start)
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+}
+
+func (g *gate) flush() error {
+	pending := g.pending
+	g.pending = nil
+	for _, p := range pending {
+		if err := g.write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *gate) write(content string) error {
+	g.buf.WriteString(content)
+	if err := g.sw.Write(content); err != nil {
+		g.cancel()
+		return io.EOF
+	}
+	select {
+	case <-g.sw.c.Request.Context().Done():
+		g.cancel()
+		return io.EOF
+	default:
+	}
+	return nil
+}
+
+// finishReason map the backend stop reason to openai finish_reason
+func finishReason(resp *llms.ContentResponse) string {
+	if resp == nil {
+		return finishStop
+	}
+	var reason string
+	for _, ch := range resp.Choices {
+		if ch != nil && len(ch.ToolCalls) != 0 {
+			return "tool_calls"
+		}
+		if ch != nil && ch.StopReason != "" {
+			reason = ch.StopReason
+		}
+	}
+	switch strings.ToLower(reason) {
+	case "length", "max_tokens":
+		return "length"
+	case "tool_calls", "function_call":
+		return "tool_calls"
+	case "content_filter":
+		return "content_filter"
+	}
+	return finishStop
+}
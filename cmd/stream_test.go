@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	api "github.com/yylt/gptmux/api/go"
+)
+
+func newTestStream(object string) (*streamWriter, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	return newStreamWriter(c, object, "gpt-4o"), w
+}
+
+// frames return the data of server-sent events
+func frames(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var (
+		ret     []string
+		scanner = bufio.NewScanner(w.Body)
+	)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			t.Fatalf("line '%s' is not a data frame", line)
+		}
+		ret = append(ret, data)
+	}
+	return ret
+}
+
+func TestStreamWriterChat(t *testing.T) {
+	sw, w := newTestStream(chatObject)
+	for _, s := range []string{"hel", "", "lo"} {
+		if err := sw.Write(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usage := &api.V1ChatCompletionsPost200ResponseUsage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5}
+	if err := sw.Finish(finishStop, usage); err != nil {
+		t.Fatal(err)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("content type '%s'", ct)
+	}
+
+	fs := frames(t, w)
+	if len(fs) != 6 || fs[5] != "[DONE]" {
+		t.Fatalf("frames %v, want role, 2 contents, finish, usage and [DONE]", fs)
+	}
+	var chunks []chatChunk
+	for _, f := range fs[:5] {
+		var ch chatChunk
+		if err := json.Unmarshal([]byte(f), &ch); err != nil {
+			t.Fatalf("decode frame %s failed: %v", f, err)
+		}
+		if ch.Id != sw.id || !strings.HasPrefix(ch.Id, "chatcmpl-") || ch.Object != chatChunkObject || ch.Model != "gpt-4o" {
+			t.Errorf("frame %s has wrong id, object or model", f)
+		}
+		chunks = append(chunks, ch)
+	}
+	if d := chunks[0].Choices[0].Delta; d.Role != "assistant" || d.Content != "" {
+		t.Errorf("first frame delta %+v, want the role only", d)
+	}
+	if got := chunks[1].Choices[0].Delta.Content + chunks[2].Choices[0].Delta.Content; got != "hello" {
+		t.Errorf("content '%s', want 'hello'", got)
+	}
+	if r := chunks[3].Choices[0].FinishReason; r == nil || *r != finishStop {
+		t.Errorf("finish frame reason %v, want stop", r)
+	}
+	if chunks[4].Choices == nil || len(chunks[4].Choices) != 0 || chunks[4].Usage == nil || chunks[4].Usage.TotalTokens != 5 {
+		t.Errorf("usage frame %s, want empty choices and the usage", fs[4])
+	}
+}
+
+func TestStreamWriterCompletion(t *testing.T) {
+	sw, w := newTestStream(completionObject)
+	sw.Write("def")
+	sw.Finish(finishStop, nil)
+
+	fs := frames(t, w)
+	if len(fs) != 3 || fs[2] != "[DONE]" {
+		t.Fatalf("frames %v, want content, finish and [DONE]", fs)
+	}
+	var ch completionChunk
+	if err := json.Unmarshal([]byte(fs[0]), &ch); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(ch.Id, "cmpl-") || ch.Object != completionObject || ch.Choices[0].Text != "def" {
+		t.Errorf("completion frame %s", fs[0])
+	}
+}
+
+func TestStreamWriterError(t *testing.T) {
+	sw, w := newTestStream(chatObject)
+	sw.Write("partial")
+	if !sw.Started() {
+		t.Fatal("stream is not started after content")
+	}
+	sw.Error(errorDetail{Message: "upstream failed", Type: "server_error", Code: "upstream_error"})
+
+	fs := frames(t, w)
+	if len(fs) != 4 || fs[3] != "[DONE]" {
+		t.Fatalf("frames %v, want role, content, error and [DONE]", fs)
+	}
+	var resp errorResp
+	if err := json.Unmarshal([]byte(fs[2]), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error.Code != "upstream_error" || resp.Error.Message != "upstream failed" {
+		t.Errorf("error frame %s", fs[2])
+	}
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d, the stream had started", w.Code)
+	}
+}
+
+func TestGate(t *testing.T) {
+	ctx := context.Background()
+
+	// the whitespace before content is held, and sent with the content
+	sw, w := newTestStream(chatObject)
+	buf := &bytes.Buffer{}
+	g := newGate(sw, buf, time.Second, func() {})
+	g.Write(ctx, []byte("\n"))
+	if sw.Started() {
+		t.Fatal("whitespace opened the stream")
+	}
+	g.Write(ctx, []byte("hi"))
+	if g.Close(true) {
+		t.Error("first token expired after content")
+	}
+	if buf.String() != "\nhi" || len(frames(t, w)) != 3 {
+		t.Errorf("gate sent '%s'", buf.String())
+	}
+
+	// no content before the timeout abort the attempt silently
+	sw, _ = newTestStream(chatObject)
+	canceled := make(chan struct{})
+	g = newGate(sw, &bytes.Buffer{}, 10*time.Millisecond, func() { close(canceled) })
+	g.Write(ctx, []byte(" "))
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("gate not canceled the attempt after the first token timeout")
+	}
+	if !g.Close(false) || sw.Started() {
+		t.Error("expired gate started the stream")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/tmc/langchaingo/llms"
+	api "github.com/yylt/gptmux/api/go"
+	"github.com/yylt/gptmux/mux"
+)
+
+// chatTools return the tools of request for backends which take call options
+func chatTools(body *api.V1ChatCompletionsPostRequest) []llms.Tool {
+	var ret []llms.Tool
+	for _, t := range body.Tools {
+		ret = append(ret, llms.Tool{
+			Type: t.Type,
+			Function: &llms.FunctionDefinition{
+				Name:        t.Function.Name,
+				Description: t.Function.Description,
+				Parameters:  t.Function.Parameters,
+			},
+		})
+	}
+	return ret
+}
+
+// toolCalling report whether the backend forward tools to upstream
+func toolCalling(m mux.Model) bool {
+	tc, ok := m.(mux.ToolCaller)
+	return ok && tc.ToolCalling()
+}
+
+// requestCalls return the tool calls of assistant message
+func requestCalls(calls []api.V1ChatCompletionsPostRequestMessagesInnerToolCallsInner) []llms.ToolCall {
+	var ret []llms.ToolCall
+	for _, tc := range calls {
+		ret = append(ret, llms.ToolCall{
+			ID:   tc.Id,
+			Type: tc.Type,
+			FunctionCall: &llms.FunctionCall{
+				Name:      tc.Function.Name,
+				Arguments: tc.Function.Arguments,
+			},
+		})
+	}
+	return ret
+}
+
+// responseCalls return the tool calls of all choices, indexed in order
+func responseCalls(resp *llms.ContentResponse) []api.V1ChatCompletionsPost200ResponseChoicesInnerDeltaToolCallsInner {
+	if resp == nil {
+		return nil
+	}
+	var ret []api.V1ChatCompletionsPost200ResponseChoicesInnerDeltaToolCallsInner
+	for _, ch := range resp.Choices {
+		if ch == nil {
+			continue
+		}
+		for _, tc := range ch.ToolCalls {
+			call := api.V1ChatCompletionsPost200ResponseChoicesInnerDeltaToolCallsInner{
+				Index: int32(len(ret)),
+				Id:    tc.ID,
+				Type:  tc.Type,
+			}
+			if tc.FunctionCall != nil {
+				call.Function.Name = tc.FunctionCall.Name
+				call.Function.Arguments = tc.FunctionCall.Arguments
+			}
+			ret = append(ret, call)
+		}
+	}
+	return ret
+}
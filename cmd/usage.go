@@ -0,0 +1,47 @@
+package main
+
+import (
+	api "github.com/yylt/gptmux/api/go"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/pkg/util"
+)
+
+const (
+	// chat format tokens of every message and the reply
+	messageTokens = 4
+	replyTokens   = 3
+)
+
+// tokenUsage return the upstream counts, the missing counts are estimated locally
+func tokenUsage(u *mux.Usage, prompt int, completion string) *api.V1ChatCompletionsPost200ResponseUsage {
+	ret := &api.V1ChatCompletionsPost200ResponseUsage{}
+	if u != nil {
+		ret.PromptTokens = int32(u.PromptTokens)
+		ret.CompletionTokens = int32(u.CompletionTokens)
+	}
+	if ret.PromptTokens == 0 {
+		ret.PromptTokens = int32(prompt)
+	}
+	if ret.CompletionTokens == 0 {
+		ret.CompletionTokens = int32(util.EstimateTokens(completion))
+	}
+	ret.TotalTokens = ret.PromptTokens + ret.CompletionTokens
+	return ret
+}
+
+// chatTokens estimate the prompt tokens of conversation
+func chatTokens(conv *mux.Conversation) int {
+	n := replyTokens
+	for _, t := range conv.Turns {
+		n += messageTokens + util.EstimateTokens(t.Content)
+	}
+	return n
+}
+
+// streamUsage return usage when the client asked for the usage chunk
+func streamUsage(o *api.V1ChatCompletionsPostRequestStreamOptions, usage *api.V1ChatCompletionsPost200ResponseUsage) *api.V1ChatCompletionsPost200ResponseUsage {
+	if o == nil || !o.IncludeUsage {
+		return nil
+	}
+	return usage
+}
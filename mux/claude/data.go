@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
-	"errors"
 	"io"
 
 	"github.com/yylt/gptmux/pkg"
@@ -45,7 +44,7 @@ func textProcess(er *eventResp) *pkg.BackResp {
 	case chunk:
 		if len(er.Stop) > 0 {
 			return &pkg.BackResp{
-				Err: errors.New("done"),
+				Done: true,
 			}
 		}
 		return &pkg.BackResp{
@@ -40,11 +40,14 @@ type Conf struct {
 	OrgId      string `yaml:"org_id,omitempty"`
 	SessionKey string `yaml:"session_key,omitempty"`
 	Index      int    `yaml:"index,omitempty"`
+
+	mux.Options `yaml:",inline"`
 }
 
 type web struct {
 	ctx context.Context
 	c   *Conf
+	mux.Live
 
 	mu sync.RWMutex
 
@@ -56,10 +59,14 @@ func New(ctx context.Context, cf *Conf) *web {
 		klog.Warningf("claude config is invalid: %v", cf)
 		return nil
 	}
+	if cf.Name == "" {
+		cf.Name = ClaudeName
+	}
 	s := &web{
 		c:   cf,
 		ctx: ctx,
 	}
+	s.Update(&cf.Options, cf.Index)
 	var (
 		opts = []tlsclient.HttpClientOption{
 			tlsclient.WithRandomTLSExtensionOrder(), // Chrome 107+
@@ -80,23 +87,25 @@ func New(ctx context.Context, cf *Conf) *web {
 }
 
 // 排序
-func (c *web) Index() int {
-	return c.c.Index
+func (c *web) Name() string {
+	return c.c.Name
 }
 
-func (c *web) Name() string {
-	return ClaudeName
+func (c *web) Models() []*mux.ModelInfo {
+	return []*mux.ModelInfo{
+		{Id: ClaudeName, OwnedBy: c.Name(), Capabilities: []string{mux.CapChat}},
+	}
 }
 
 func (c *web) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
 	if !c.mu.TryLock() {
-		return nil, fmt.Errorf("pending")
+		return nil, pkg.BusyErr
 	}
 	defer c.mu.Unlock()
-	prompt, model := mux.GeneraPrompt(messages)
+	prompt, model := mux.GeneraPrompt(mux.GetConversation(messages, c.Options().Language, options...))
 
 	if model != mux.TxtModel {
-		return nil, fmt.Errorf("not support model '%s'", model)
+		return nil, pkg.NewError(pkg.ClassUnsupported, "not support model '%s'", model)
 	}
 	var (
 		opt          = &llms.CallOptions{}
@@ -109,11 +118,11 @@ func (c *web) GenerateContent(ctx context.Context, messages []llms.MessageConten
 	defer cancle()
 	resp, err := c.chat(prompt)
 	if err != nil {
-		return nil, err
+		return nil, pkg.NewError(pkg.ClassUpstream, "chat claude failed: %w", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("chat claude failed: %s, code: %v", http.StatusText(resp.StatusCode), resp.StatusCode)
+		return nil, pkg.StatusError(resp.StatusCode, "chat claude failed: %s, code: %v", http.StatusText(resp.StatusCode), resp.StatusCode)
 	}
 	process(resp.Body, func(er *eventResp) error {
 		content, done := text(er)
@@ -134,7 +143,7 @@ func (c *web) GenerateContent(ctx context.Context, messages []llms.MessageConten
 }
 
 func (c *web) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
-	return "", fmt.Errorf("not implement")
+	return "", pkg.UnsupportedErr
 }
 
 func (c *web) chat(prompt string) (*fhttp.Response, error) {
@@ -182,7 +191,7 @@ func (c *web) Send(prompt string, t mux.ChatModel) (<-chan *pkg.BackResp, error)
 	if resp.StatusCode != 200 {
 		resp.Body.Close()
 		// newchat
-		return nil, fmt.Errorf("chat claude failed: %s, code: %v", http.StatusText(resp.StatusCode), resp.StatusCode)
+		return nil, pkg.StatusError(resp.StatusCode, "chat claude failed: %s, code: %v", http.StatusText(resp.StatusCode), resp.StatusCode)
 	}
 
 	var rsch = make(chan *pkg.BackResp, 16)
@@ -254,7 +263,7 @@ func (c *web) newchat() (string, error) {
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("newchat failed: %d, body: %v", resp.StatusCode, resp.Body)
+		return "", pkg.StatusError(resp.StatusCode, "newchat failed: %d", resp.StatusCode)
 	}
 	return id.String(), nil
 }
@@ -2,10 +2,8 @@ package mux
 
 import (
 	"context"
-	"unicode/utf8"
 
 	"github.com/tmc/langchaingo/llms"
-	"github.com/yylt/gptmux/pkg/util"
 )
 
 type ChatModel string
@@ -21,10 +19,12 @@ const (
 	TxtModel ChatModel = "text"
 
 	ReqBody = "req"
-)
 
-var (
-	hua, _ = utf8.DecodeRuneInString("画")
+	CapChat       = "chat"
+	CapCompletion = "completion"
+	CapImage      = "image"
+	CapEmbedding  = "embedding"
+	CapTools      = "tools"
 )
 
 type Model interface {
@@ -37,97 +37,49 @@ type FimModel interface {
 	Completion(ctx context.Context, prompt string, options ...llms.CallOption) (string, error)
 }
 
-// system and the last human
-func GeneraPrompt(messages []llms.MessageContent) (string, ChatModel) {
-	var (
-		m           = TxtModel
-		buf         = util.GetBuf()
-		txt, prefix llms.TextContent
-		iszh        bool
-	)
-	defer util.PutBuf(buf)
-	for _, msg := range messages {
-		switch msg.Role {
-		case llms.ChatMessageTypeHuman:
-			leng := len(msg.Parts)
-			if leng < 1 {
-				return "", NonModel
-			}
-			txt = msg.Parts[leng-1].(llms.TextContent)
-			first, _ := utf8.DecodeRuneInString(txt.Text)
-			if first == hua {
-				m = ImgModel
-			} else {
-				if util.HasChineseChar(txt.Text) {
-					iszh = true
-				}
-			}
-
-		case llms.ChatMessageTypeSystem:
-
-			leng := len(msg.Parts)
-			if leng < 1 {
-				continue
-			}
-			prefix = msg.Parts[leng-1].(llms.TextContent)
-			if util.HasChineseChar(prefix.Text) {
-				iszh = true
-			}
-		default:
-		}
-	}
-	if txt.Text == "" {
-		return "", NonModel
-	}
+// ToolCaller is implemented by backends which forward tools to upstream,
+// the calls are returned in the tool calls of choice.
+type ToolCaller interface {
+	ToolCalling() bool
+}
+
+// ModelInfo describe one upstream model served by a backend
+type ModelInfo struct {
+	Id           string
+	OwnedBy      string
+	Capabilities []string
+}
 
-	if prefix.Text != "" {
-		buf.WriteString(prefix.Text + "\r\n")
+// Lister is implemented by backends which know their upstream models
+type Lister interface {
+	Models() []*ModelInfo
+}
+
+// Infos return the models advertised by backend, the backends which
+// do not know their upstream models advertise their name.
+func Infos(m Model) []*ModelInfo {
+	if l, ok := m.(Lister); ok {
+		return l.Models()
 	}
-	buf.WriteString(txt.Text)
-	if m == TxtModel && !iszh {
-		if !util.HasChineseChar(txt.Text) {
-			buf.WriteString("\r\n请使用中文回答")
-		}
+	caps := []string{CapChat}
+	if _, ok := m.(FimModel); ok {
+		caps = append(caps, CapCompletion)
+	}
+	return []*ModelInfo{
+		{Id: m.Name(), OwnedBy: m.Name(), Capabilities: caps},
 	}
-
-	return buf.String(), m
 }
 
-// last system and the last human
-func NormalPrompt(messages []llms.MessageContent) []llms.MessageContent {
-	var (
-		ret []llms.MessageContent
-	)
-
-	for _, msg := range messages {
-		switch msg.Role {
-		case llms.ChatMessageTypeHuman:
-			leng := len(msg.Parts)
-			if leng < 1 {
-				return nil
-			}
-			ret = append(ret, llms.MessageContent{
-				Role:  llms.ChatMessageTypeHuman,
-				Parts: []llms.ContentPart{msg.Parts[leng-1].(llms.TextContent)},
-			})
-
-		case llms.ChatMessageTypeSystem:
-			leng := len(msg.Parts)
-			if leng < 1 {
-				continue
-			}
-			ret = append(ret, llms.MessageContent{
-				Role:  llms.ChatMessageTypeHuman,
-				Parts: []llms.ContentPart{msg.Parts[leng-1]},
-			})
-		}
+// GeneraPrompt fold the conversation into one prompt,
+// image mode only use the last human.
+func GeneraPrompt(conv *Conversation) (string, ChatModel) {
+	switch conv.Mode() {
+	case NonModel:
+		return "", NonModel
+	case ImgModel:
+		return conv.LastHuman().Content, ImgModel
 	}
-	ret = append(ret, llms.MessageContent{
-		Role: llms.ChatMessageTypeSystem,
-		Parts: []llms.ContentPart{llms.TextContent{
-			Text: "请使用中文回答",
-		}}})
-	return ret
+	return conv.Transcript(), TxtModel
 }
 
 // last system and the last human
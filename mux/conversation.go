@@ -0,0 +1,237 @@
+package mux
+
+import (
+	"context"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/yylt/gptmux/pkg/util"
+)
+
+const (
+	// metadata key of *Conversation
+	ConvKey = "conv"
+)
+
+// Turn is one message of the conversation, the assistant may call tools
+// and the tool turn answer the call of id.
+type Turn struct {
+	Role       llms.ChatMessageType
+	Name       string
+	Content    string
+	ToolCalls  []llms.ToolCall
+	ToolCallId string
+}
+
+// Conversation keep every turn in request order,
+// intent is the mode decided by the caller, empty use the default rules.
+type Conversation struct {
+	Turns  []*Turn
+	Intent ChatModel
+}
+
+// RoleType convert openai role to message type
+func RoleType(role string) llms.ChatMessageType {
+	switch role {
+	case string(llms.ChatMessageTypeAI), RoleAssistant:
+		return llms.ChatMessageTypeAI
+	case string(llms.ChatMessageTypeHuman), RoleUser:
+		return llms.ChatMessageTypeHuman
+	case string(llms.ChatMessageTypeSystem):
+		return llms.ChatMessageTypeSystem
+	case string(llms.ChatMessageTypeTool):
+		return llms.ChatMessageTypeTool
+	case string(llms.ChatMessageTypeFunction):
+		return llms.ChatMessageTypeFunction
+	}
+	return llms.ChatMessageTypeGeneric
+}
+
+// RoleName convert message type to openai role
+func RoleName(t llms.ChatMessageType) string {
+	switch t {
+	case llms.ChatMessageTypeAI:
+		return RoleAssistant
+	case llms.ChatMessageTypeSystem:
+		return RoleSystem
+	case llms.ChatMessageTypeTool:
+		return string(llms.ChatMessageTypeTool)
+	case llms.ChatMessageTypeFunction:
+		return string(llms.ChatMessageTypeFunction)
+	}
+	return RoleUser
+}
+
+// NewConversation build conversation from messages, one turn per message
+func NewConversation(messages []llms.MessageContent) *Conversation {
+	conv := &Conversation{}
+	for _, msg := range messages {
+		var (
+			parts []string
+			t     = &Turn{Role: msg.Role}
+		)
+		for _, p := range msg.Parts {
+			switch v := p.(type) {
+			case llms.TextContent:
+				parts = append(parts, v.Text)
+			case llms.ToolCall:
+				t.ToolCalls = append(t.ToolCalls, v)
+			case llms.ToolCallResponse:
+				t.Name, t.ToolCallId = v.Name, v.ToolCallID
+				parts = append(parts, v.Content)
+			}
+		}
+		t.Content = strings.Join(parts, "\n")
+		conv.Turns = append(conv.Turns, t)
+	}
+	return conv
+}
+
+// GetConversation return the conversation from metadata which keep names,
+// or build it from messages. the language policy of backend and caller is applied.
+func GetConversation(messages []llms.MessageContent, lang *Language, options ...llms.CallOption) *Conversation {
+	opt := &llms.CallOptions{}
+	for _, o := range options {
+		o(opt)
+	}
+	conv, ok := opt.Metadata[ConvKey].(*Conversation)
+	if !ok || conv == nil {
+		conv = NewConversation(messages)
+	}
+	return conv.Localize(GetLanguage(lang, options...))
+}
+
+func (c *Conversation) Add(role llms.ChatMessageType, name, content string) {
+	c.Turns = append(c.Turns, &Turn{
+		Role:    role,
+		Name:    name,
+		Content: content,
+	})
+}
+
+// Messages render all turns for backends which accept chat history
+func (c *Conversation) Messages() []llms.MessageContent {
+	ret := make([]llms.MessageContent, 0, len(c.Turns))
+	for _, t := range c.Turns {
+		switch {
+		case t.ToolCallId != "":
+			ret = append(ret, llms.MessageContent{
+				Role: t.Role,
+				Parts: []llms.ContentPart{llms.ToolCallResponse{
+					ToolCallID: t.ToolCallId,
+					Name:       t.Name,
+					Content:    t.Content,
+				}},
+			})
+		case len(t.ToolCalls) != 0:
+			msg := llms.TextParts(t.Role, t.Content)
+			for _, tc := range t.ToolCalls {
+				msg.Parts = append(msg.Parts, tc)
+			}
+			ret = append(ret, msg)
+		default:
+			ret = append(ret, llms.TextParts(t.Role, t.Content))
+		}
+	}
+	return ret
+}
+
+// LastHuman return the last human turn, or nil
+func (c *Conversation) LastHuman() *Turn {
+	for i := len(c.Turns) - 1; i >= 0; i-- {
+		if c.Turns[i].Role == llms.ChatMessageTypeHuman {
+			return c.Turns[i]
+		}
+	}
+	return nil
+}
+
+// Localize return a copy whose last human turn carry the language policy,
+// image prompt is not changed.
+func (c *Conversation) Localize(l *Language) *Conversation {
+	ret := &Conversation{
+		Turns:  append([]*Turn(nil), c.Turns...),
+		Intent: c.Intent,
+	}
+	if c.Mode() != TxtModel {
+		return ret
+	}
+	for i := len(ret.Turns) - 1; i >= 0; i-- {
+		if ret.Turns[i].Role == llms.ChatMessageTypeHuman {
+			t := *ret.Turns[i]
+			t.Content = l.Apply(t.Content)
+			ret.Turns[i] = &t
+			break
+		}
+	}
+	return ret
+}
+
+// Mode return the intent, or detect it by the default rules
+func (c *Conversation) Mode() ChatModel {
+	last := c.LastHuman()
+	if last == nil || last.Content == "" {
+		return NonModel
+	}
+	if c.Intent != NonModel {
+		return c.Intent
+	}
+	return defaultIntent.Detect(context.Background(), "", c)
+}
+
+// Transcript fold the conversation into one prompt for single-prompt backends.
+// system and one human turn keep the plain form.
+func (c *Conversation) Transcript() string {
+	var (
+		buf    = util.GetBuf()
+		system []string
+		turns  []*Turn
+	)
+	defer util.PutBuf(buf)
+	for _, t := range c.Turns {
+		if t.Content == "" {
+			continue
+		}
+		if t.Role == llms.ChatMessageTypeSystem {
+			system = append(system, t.Content)
+			continue
+		}
+		turns = append(turns, t)
+	}
+	if len(system) != 0 {
+		buf.WriteString(strings.Join(system, "\r\n"))
+		buf.WriteString("\r\n")
+	}
+	if len(turns) == 1 && turns[0].Role == llms.ChatMessageTypeHuman {
+		buf.WriteString(turns[0].Content)
+		return buf.String()
+	}
+	if len(system) != 0 {
+		buf.WriteString("\r\n")
+	}
+	for i, t := range turns {
+		if i > 0 {
+			buf.WriteString("\r\n\r\n")
+		}
+		buf.WriteString(speaker(t))
+		buf.WriteString(": ")
+		buf.WriteString(t.Content)
+	}
+	return buf.String()
+}
+
+func speaker(t *Turn) string {
+	var s string
+	switch t.Role {
+	case llms.ChatMessageTypeAI:
+		s = "Assistant"
+	case llms.ChatMessageTypeTool, llms.ChatMessageTypeFunction:
+		s = "Tool"
+	default:
+		s = "User"
+	}
+	if t.Name != "" {
+		s += "(" + t.Name + ")"
+	}
+	return s
+}
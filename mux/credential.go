@@ -0,0 +1,20 @@
+package mux
+
+import (
+	"context"
+	"time"
+)
+
+// Credential is the login state of backend accounts
+type Credential struct {
+	Accounts    int        `json:"accounts"`
+	LoggedIn    int        `json:"logged_in"`
+	RefreshedAt *time.Time `json:"refreshed_at,omitempty"`
+}
+
+// Authenticator is implemented by backends which login with accounts
+type Authenticator interface {
+	Credential() *Credential
+	// Login refresh the tokens of accounts
+	Login(ctx context.Context) error
+}
@@ -7,14 +7,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/tmc/langchaingo/llms"
 	"github.com/yylt/gptmux/mux"
 	"github.com/yylt/gptmux/pkg"
+	"github.com/yylt/gptmux/pkg/tracing"
 	"github.com/yylt/gptmux/pkg/util"
 	"k8s.io/klog/v2"
 )
@@ -28,7 +29,7 @@ var (
 		"User-Agent":   "Mozilla/5.0 (Linux; x64) Gecko/20100101 Firefox/128.0",
 	}
 	defaultClient = http.Client{
-		Transport: http.DefaultTransport,
+		Transport: tracing.Transport(http.DefaultTransport),
 	}
 )
 
@@ -48,6 +49,8 @@ type Conf struct {
 	DeviceId string `yaml:"deviceid"`
 	Debug    bool   `yaml:"debug,omitempty"`
 	Index    int    `yaml:"index,omitempty"`
+
+	mux.Options `yaml:",inline"`
 }
 
 type uuidResp struct {
@@ -60,24 +63,37 @@ type uuidResp struct {
 }
 
 type Dseek struct {
-	c  *Conf
+	c *Conf
+	mux.Live
+
 	mu sync.Mutex
 
 	rest *resty.Client
 
 	token string
+
+	// login state, mu is held by the chat
+	cmu       sync.Mutex
+	logged    bool
+	refreshed time.Time
 }
 
+var _ mux.Authenticator = &Dseek{}
+
 func New(c *Conf) *Dseek {
 	if c == nil || c.Email == "" || c.Password == "" {
 		klog.Warningf("deepseek config is invalid: %v", c)
 		return nil
 	}
+	if c.Name == "" {
+		c.Name = "deepseek"
+	}
 	seek := &Dseek{
 		c:    c,
-		rest: resty.New(),
+		rest: resty.New().SetTransport(tracing.Transport(http.DefaultTransport)),
 	}
-	err := seek.login()
+	seek.Update(&c.Options, c.Index)
+	err := seek.login(context.Background())
 	if err != nil {
 		klog.Errorf("%s: login failed: %v", seek.Name(), err)
 		return nil
@@ -86,11 +102,13 @@ func New(c *Conf) *Dseek {
 }
 
 func (d *Dseek) Name() string {
-	return "deepseek"
+	return d.c.Name
 }
 
-func (d *Dseek) Index() int {
-	return d.c.Index
+func (d *Dseek) Models() []*mux.ModelInfo {
+	return []*mux.ModelInfo{
+		{Id: "deepseek-chat", OwnedBy: d.Name(), Capabilities: []string{mux.CapChat}},
+	}
 }
 
 func (d *Dseek) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
@@ -98,21 +116,20 @@ func (d *Dseek) GenerateContent(ctx context.Context, messages []llms.MessageCont
 		return nil, pkg.BusyErr
 	}
 	defer d.mu.Unlock()
-	prompt, model := mux.GeneraPrompt(messages)
+	prompt, model := mux.GeneraPrompt(mux.GetConversation(messages, d.Options().Language.Default(mux.LangAuto), options...))
 
 	if model != mux.TxtModel {
-		return nil, fmt.Errorf("not support model '%s'", model)
+		return nil, pkg.NewError(pkg.ClassUnsupported, "not support model '%s'", model)
 	}
-	uuid, err := d.newChat(d.token)
+	uuid, err := d.newChat(ctx, d.token)
 	if err != nil {
-		if err := d.login(); err != nil {
+		if err := d.login(ctx); err != nil {
 			klog.Errorf("login failed: %s", err)
 			return nil, err
-		} else {
-			uuid, _ := d.newChat(d.token)
-			if uuid == "" {
-				return nil, fmt.Errorf("can not chat")
-			}
+		}
+		uuid, err = d.newChat(ctx, d.token)
+		if err != nil {
+			return nil, err
 		}
 	}
 
@@ -125,7 +142,7 @@ func (d *Dseek) GenerateContent(ctx context.Context, messages []llms.MessageCont
 		o(opt)
 	}
 	defer cancle()
-	resp, err := d.chat(prompt, uuid)
+	resp, err := d.chat(ctx, prompt, uuid)
 	if err != nil {
 		return nil, err
 	}
@@ -154,14 +171,17 @@ func (d *Dseek) GenerateContent(ctx context.Context, messages []llms.MessageCont
 			klog.Infof("data: %s", string(bytes.TrimPrefix(line, util.HeaderData)))
 		}
 		ret.Content = ""
-		ret.Err = nil
+		ret.Done = false
+		if respData.Usage != nil {
+			mux.GetUsage(options...).Set(respData.Usage.PromptTokens, respData.Usage.CompletionTokens)
+		}
 
 		for _, choci := range respData.Choices {
 			if choci == nil {
 				continue
 			}
 			if choci.Finish != "" {
-				ret.Err = fmt.Errorf("")
+				ret.Done = true
 			}
 			if choci.Delta == nil {
 				continue
@@ -172,7 +192,7 @@ func (d *Dseek) GenerateContent(ctx context.Context, messages []llms.MessageCont
 		data.Choices = append(data.Choices, &llms.ContentChoice{
 			Content: ret.Content,
 		})
-		if ret.Err != nil {
+		if ret.Done {
 			data.Choices = append(data.Choices, &llms.ContentChoice{
 				StopReason: "stop",
 			})
@@ -190,14 +210,18 @@ func (d *Dseek) GenerateContent(ctx context.Context, messages []llms.MessageCont
 }
 
 func (d *Dseek) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
-	return "", fmt.Errorf("not implement")
+	return "", pkg.UnsupportedErr
 }
 
-func (d *Dseek) login() error {
+func (d *Dseek) login(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "Dseek.login", tracing.BackendKey.String(d.Name()))
+	defer func() {
+		tracing.End(span, err)
+	}()
 	var (
 		url                 = "https://chat.deepseek.com/api/v0/users/login"
 		data                = &tokenResp{}
-		req  *resty.Request = d.rest.R()
+		req  *resty.Request = d.rest.R().SetContext(ctx)
 	)
 
 	if d.c.Debug {
@@ -209,16 +233,45 @@ func (d *Dseek) login() error {
 		"device_id": d.c.DeviceId, "os": "web",
 	}).SetHeaders(headers).SetResult(data).Post(url)
 	if err != nil {
-		return err
+		return pkg.NewError(pkg.ClassUpstream, "%s login failed: %w", d.Name(), err)
 	}
 	if !util.IsHttp20xCode(resp.StatusCode()) {
-		return errors.Join(http.ErrNotSupported, fmt.Errorf("%s freshToken failed, http code %v", d.Name(), resp.StatusCode()))
+		d.cmu.Lock()
+		d.logged = false
+		d.cmu.Unlock()
+		return errors.Join(pkg.AuthErr, fmt.Errorf("%s freshToken failed, http code %v", d.Name(), resp.StatusCode()))
 	}
 	d.token = data.Data.User.Token
+	d.cmu.Lock()
+	d.logged = d.token != ""
+	d.refreshed = time.Now()
+	d.cmu.Unlock()
 	return nil
 }
 
-func (d *Dseek) chat(prompt string, uuid string) (*http.Response, error) {
+// Login refresh the token, wait for the running chat
+func (d *Dseek) Login(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.login(ctx)
+}
+
+// Credential return the login state of account
+func (d *Dseek) Credential() *mux.Credential {
+	d.cmu.Lock()
+	defer d.cmu.Unlock()
+	c := &mux.Credential{Accounts: 1}
+	if d.logged {
+		c.LoggedIn = 1
+	}
+	if !d.refreshed.IsZero() {
+		refreshed := d.refreshed
+		c.RefreshedAt = &refreshed
+	}
+	return c
+}
+
+func (d *Dseek) chat(ctx context.Context, prompt string, uuid string) (*http.Response, error) {
 	var url = "https://chat.deepseek.com/api/v0/chat/completion"
 	// send prompt
 	body := map[string]any{
@@ -235,7 +288,7 @@ func (d *Dseek) chat(prompt string, uuid string) (*http.Response, error) {
 	if d.c.Debug {
 		klog.Infof("request body: %s", string(data))
 	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(data))
 	if err != nil {
 		return nil, err
 	}
@@ -249,22 +302,22 @@ func (d *Dseek) chat(prompt string, uuid string) (*http.Response, error) {
 
 	resp, err := defaultClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, pkg.NewError(pkg.ClassUpstream, "chat deepseek failed: %w", err)
 	}
 	if resp.StatusCode != 200 {
 		resp.Body.Close()
-		return nil, fmt.Errorf("chat deepseek failed: %s, code: %v", http.StatusText(resp.StatusCode), resp.StatusCode)
+		return nil, pkg.StatusError(resp.StatusCode, "chat deepseek failed: %s, code: %v", http.StatusText(resp.StatusCode), resp.StatusCode)
 	}
 	return resp, err
 }
 
-func (d *Dseek) newChat(token string) (string, error) {
+func (d *Dseek) newChat(ctx context.Context, token string) (string, error) {
 	var url = "https://chat.deepseek.com/api/v0/chat_session/create"
 	if token == "" {
-		return "", fmt.Errorf("token is null")
+		return "", pkg.NewError(pkg.ClassAuth, "token is null")
 	}
 	var (
-		req  *resty.Request = d.rest.R()
+		req  *resty.Request = d.rest.R().SetContext(ctx)
 		data                = &uuidResp{}
 	)
 
@@ -275,15 +328,13 @@ func (d *Dseek) newChat(token string) (string, error) {
 		"agent": "chat",
 	}).SetHeaders(headers).SetHeader("Authorization", fmt.Sprintf("Bearer %s", token)).SetResult(data).Post(url)
 	if err != nil {
-		return "", errors.Join(io.EOF, err)
+		return "", pkg.NewError(pkg.ClassUpstream, "create chat failed: %w", err)
 	}
 	if !util.IsHttp20xCode(resp.StatusCode()) {
-		if resp.StatusCode()/100 == 4 {
-			return "", errors.Join(http.ErrNotSupported, fmt.Errorf("http code %v", resp.StatusCode()))
-		}
+		return "", pkg.StatusError(resp.StatusCode(), "create chat failed, http code %v", resp.StatusCode())
 	}
 	if data.Data.BizData.Id == "" {
-		return "", fmt.Errorf("not found uuid")
+		return "", pkg.NewError(pkg.ClassUpstream, "not found uuid")
 	}
 	return data.Data.BizData.Id, nil
 }
@@ -0,0 +1,44 @@
+package mux
+
+import (
+	"context"
+)
+
+// EmbedRequest is the input of one backend, model is the routed
+// upstream model, empty means the backend default.
+type EmbedRequest struct {
+	Model      string
+	Input      []string
+	Dimensions int
+}
+
+// Embedding is the vectors in input order, tokens are the upstream count
+type Embedding struct {
+	Vectors      [][]float32
+	PromptTokens int
+}
+
+// Embedder is implemented by backends which can produce embeddings
+type Embedder interface {
+	Embed(ctx context.Context, req *EmbedRequest) (*Embedding, error)
+}
+
+// EmbedBatches split the input by size and join the results in order,
+// zero size send all in one batch.
+func EmbedBatches(ctx context.Context, req *EmbedRequest, size int, fn func(context.Context, *EmbedRequest) (*Embedding, error)) (*Embedding, error) {
+	if size <= 0 || len(req.Input) <= size {
+		return fn(ctx, req)
+	}
+	ret := &Embedding{}
+	for i := 0; i < len(req.Input); i += size {
+		batch := *req
+		batch.Input = req.Input[i:min(i+size, len(req.Input))]
+		e, err := fn(ctx, &batch)
+		if err != nil {
+			return nil, err
+		}
+		ret.Vectors = append(ret.Vectors, e.Vectors...)
+		ret.PromptTokens += e.PromptTokens
+	}
+	return ret, nil
+}
@@ -0,0 +1,65 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEmbedBatches(t *testing.T) {
+	input := []string{"a", "b", "c", "d", "e"}
+	tests := []struct {
+		name    string
+		size    int
+		batches []string
+	}{
+		{name: "no limit", size: 0, batches: []string{"abcde"}},
+		{name: "one batch", size: 5, batches: []string{"abcde"}},
+		{name: "batches", size: 2, batches: []string{"ab", "cd", "e"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var batches []string
+			ret, err := EmbedBatches(context.Background(), &EmbedRequest{Input: input}, tt.size,
+				func(_ context.Context, req *EmbedRequest) (*Embedding, error) {
+					batches = append(batches, strings.Join(req.Input, ""))
+					e := &Embedding{PromptTokens: len(req.Input)}
+					for _, in := range req.Input {
+						e.Vectors = append(e.Vectors, []float32{float32(in[0])})
+					}
+					return e, nil
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(batches, tt.batches) {
+				t.Errorf("batches %v, want %v", batches, tt.batches)
+			}
+			// the vectors are in input order, tokens are summed
+			if len(ret.Vectors) != len(input) || ret.PromptTokens != len(input) {
+				t.Fatalf("%d vectors %d tokens", len(ret.Vectors), ret.PromptTokens)
+			}
+			for i, v := range ret.Vectors {
+				if v[0] != float32(input[i][0]) {
+					t.Errorf("vector %d is of '%c'", i, rune(v[0]))
+				}
+			}
+		})
+	}
+
+	// a failed batch fail all
+	fail := errors.New("batch failed")
+	n := 0
+	_, err := EmbedBatches(context.Background(), &EmbedRequest{Input: input}, 2,
+		func(context.Context, *EmbedRequest) (*Embedding, error) {
+			if n++; n == 2 {
+				return nil, fail
+			}
+			return &Embedding{Vectors: [][]float32{{0}, {0}}}, nil
+		})
+	if !errors.Is(err, fail) {
+		t.Errorf("error '%v', want the failed batch", err)
+	}
+}
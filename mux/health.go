@@ -0,0 +1,257 @@
+package mux
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/yylt/gptmux/pkg"
+)
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half-open"
+
+	defaultFailures = 3
+	defaultCooldown = 30 * time.Second
+)
+
+// BreakerConf open the circuit after failures in a row,
+// and probe again after cooldown.
+type BreakerConf struct {
+	Failures int           `yaml:"failures,omitempty"`
+	Cooldown time.Duration `yaml:"cooldown,omitempty"`
+}
+
+// Configurable is implemented by backends which expose the shared options,
+// the kept backend get the options and index of new config by Update.
+type Configurable interface {
+	Options() *Options
+	Update(o *Options, index int)
+}
+
+// HealthStatus is the snapshot of a circuit
+type HealthStatus struct {
+	State     CircuitState `json:"state"`
+	Failures  int          `json:"failures"`
+	Auth      bool         `json:"auth_failed,omitempty"`
+	LastError string       `json:"last_error,omitempty"`
+	ErrorAt   *time.Time   `json:"last_error_at,omitempty"`
+	SuccessAt *time.Time   `json:"last_success_at,omitempty"`
+	OpenedAt  *time.Time   `json:"opened_at,omitempty"`
+	RetryAt   *time.Time   `json:"retry_at,omitempty"`
+}
+
+// Health is the circuit breaker of one backend
+type Health struct {
+	mu sync.Mutex
+
+	failures int
+	cooldown time.Duration
+
+	state    CircuitState
+	count    int
+	auth     bool
+	probing  bool
+	openedAt time.Time
+	lastErr  error
+	errAt    time.Time
+	okAt     time.Time
+
+	// attempts in flight, the closing backend refuse new ones
+	inflight int
+	closing  bool
+	idle     *sync.Cond
+
+	// login state of backend, the auth failure is probed again after refresh
+	credential func() *Credential
+}
+
+func NewHealth(c *BreakerConf) *Health {
+	h := &Health{
+		state: CircuitClosed,
+	}
+	h.idle = sync.NewCond(&h.mu)
+	h.configure(c)
+	return h
+}
+
+// configure set the breaker settings, the state is kept
+func (h *Health) configure(c *BreakerConf) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures, h.cooldown = defaultFailures, defaultCooldown
+	if c != nil {
+		if c.Failures > 0 {
+			h.failures = c.Failures
+		}
+		if c.Cooldown > 0 {
+			h.cooldown = c.Cooldown
+		}
+	}
+}
+
+// Allow report whether a request can be sent, after cooldown only
+// one probe is allowed until it is done.
+// auth failure keep the circuit open until the credentials are refreshed or Reset.
+func (h *Health) Allow() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch h.state {
+	case CircuitOpen:
+		if h.auth && h.refreshed() {
+			h.auth = false
+		}
+		if h.auth || time.Since(h.openedAt) < h.cooldown {
+			return false
+		}
+		h.state = CircuitHalfOpen
+		h.probing = true
+		return true
+	case CircuitHalfOpen:
+		if h.probing {
+			return false
+		}
+		h.probing = true
+		return true
+	}
+	return true
+}
+
+// Ready report whether a request can be sent now, the probe is not taken
+func (h *Health) Ready() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.state == CircuitOpen {
+		return (!h.auth || h.refreshed()) && time.Since(h.openedAt) >= h.cooldown
+	}
+	return true
+}
+
+// refreshed report whether the credentials are refreshed after the circuit opened
+func (h *Health) refreshed() bool {
+	if h.credential == nil {
+		return false
+	}
+	c := h.credential()
+	return c != nil && c.RefreshedAt != nil && c.RefreshedAt.After(h.openedAt)
+}
+
+func (h *Health) Success() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.state = CircuitClosed
+	h.count = 0
+	h.auth = false
+	h.probing = false
+	h.okAt = time.Now()
+}
+
+// Release give back the probe of an attempt which is neither success
+// nor failure, such as the client gone or the server shutting down.
+func (h *Health) Release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.probing = false
+}
+
+// Failure record err, busy, canceled and client errors are not counted
+func (h *Health) Failure(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.probing = false
+	switch pkg.Classify(err) {
+	case "", pkg.ClassBusy, pkg.ClassCanceled, pkg.ClassBadRequest, pkg.ClassUnsupported:
+		return
+	}
+	h.lastErr = err
+	h.errAt = time.Now()
+	h.count++
+	if errors.Is(err, pkg.AuthErr) {
+		h.auth = true
+		h.open()
+		return
+	}
+	if h.state == CircuitHalfOpen || h.count >= h.failures {
+		h.open()
+	}
+}
+
+func (h *Health) open() {
+	h.state = CircuitOpen
+	h.openedAt = time.Now()
+}
+
+// Reset close the circuit, used when credentials changed
+func (h *Health) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.state = CircuitClosed
+	h.count = 0
+	h.auth = false
+	h.probing = false
+	h.lastErr = nil
+}
+
+// Enter take the backend for an attempt until Leave,
+// false when the backend is removed by reload.
+func (h *Health) Enter() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closing {
+		return false
+	}
+	h.inflight++
+	return true
+}
+
+func (h *Health) Leave() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.inflight--
+	if h.inflight <= 0 {
+		h.idle.Broadcast()
+	}
+}
+
+// Drain refuse new attempts and wait for the ones in flight,
+// the backend can be closed after it.
+func (h *Health) Drain() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closing = true
+	for h.inflight > 0 {
+		h.idle.Wait()
+	}
+}
+
+func (h *Health) Status() *HealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := &HealthStatus{
+		State:    h.state,
+		Failures: h.count,
+		Auth:     h.auth,
+	}
+	if h.lastErr != nil {
+		st.LastError = h.lastErr.Error()
+		errAt := h.errAt
+		st.ErrorAt = &errAt
+	}
+	if !h.okAt.IsZero() {
+		okAt := h.okAt
+		st.SuccessAt = &okAt
+	}
+	if h.state != CircuitClosed {
+		opened := h.openedAt
+		st.OpenedAt = &opened
+		if !h.auth {
+			retry := opened.Add(h.cooldown)
+			st.RetryAt = &retry
+		}
+	}
+	return st
+}
@@ -0,0 +1,166 @@
+package mux
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/yylt/gptmux/pkg"
+)
+
+const testCooldown = 30 * time.Millisecond
+
+func TestHealthCircuit(t *testing.T) {
+	var (
+		h   = NewHealth(&BreakerConf{Failures: 2, Cooldown: testCooldown})
+		err = pkg.NewError(pkg.ClassUpstream, "upstream failed")
+	)
+	// closed, one failure is not enough
+	if !h.Allow() {
+		t.Fatal("closed circuit refuse")
+	}
+	h.Failure(err)
+	if st := h.Status(); st.State != CircuitClosed || st.Failures != 1 {
+		t.Fatalf("circuit %s failures %d after one failure", st.State, st.Failures)
+	}
+	h.Allow()
+	h.Failure(err)
+	if st := h.Status(); st.State != CircuitOpen {
+		t.Fatalf("circuit %s after two failures, want open", st.State)
+	}
+	if h.Allow() || h.Ready() {
+		t.Fatal("open circuit allow before cooldown")
+	}
+
+	// half-open allow a single probe
+	time.Sleep(testCooldown)
+	if !h.Ready() {
+		t.Fatal("open circuit is not ready after cooldown")
+	}
+	if !h.Allow() {
+		t.Fatal("open circuit refuse the probe after cooldown")
+	}
+	if st := h.Status(); st.State != CircuitHalfOpen {
+		t.Fatalf("circuit %s after cooldown, want half-open", st.State)
+	}
+	if h.Allow() {
+		t.Fatal("half-open circuit allow a second probe")
+	}
+
+	// a failed probe open again
+	h.Failure(err)
+	if st := h.Status(); st.State != CircuitOpen {
+		t.Fatalf("circuit %s after failed probe, want open", st.State)
+	}
+
+	// a success probe close
+	time.Sleep(testCooldown)
+	if !h.Allow() {
+		t.Fatal("probe refused after cooldown")
+	}
+	h.Success()
+	if st := h.Status(); st.State != CircuitClosed || st.Failures != 0 {
+		t.Fatalf("circuit %s failures %d after success probe", st.State, st.Failures)
+	}
+}
+
+func TestHealthRelease(t *testing.T) {
+	h := NewHealth(&BreakerConf{Failures: 1, Cooldown: testCooldown})
+	h.Failure(pkg.NewError(pkg.ClassUpstream, "upstream failed"))
+	time.Sleep(testCooldown)
+	if !h.Allow() {
+		t.Fatal("probe refused after cooldown")
+	}
+	// the probe ended by the client is given back, not judged
+	h.Release()
+	if st := h.Status(); st.State != CircuitHalfOpen {
+		t.Fatalf("circuit %s after release, want half-open", st.State)
+	}
+	if !h.Allow() {
+		t.Fatal("probe refused after release")
+	}
+}
+
+func TestHealthNotCounted(t *testing.T) {
+	h := NewHealth(&BreakerConf{Failures: 1, Cooldown: time.Hour})
+	for _, err := range []error{
+		pkg.BusyErr,
+		pkg.BadRequestErr,
+		pkg.UnsupportedErr,
+		pkg.NewError(pkg.ClassCanceled, "canceled"),
+		// backends wrap the canceled context as upstream error
+		pkg.NewError(pkg.ClassUpstream, "request failed: %w", context.Canceled),
+	} {
+		h.Allow()
+		h.Failure(err)
+		if st := h.Status(); st.State != CircuitClosed || st.Failures != 0 {
+			t.Errorf("circuit %s failures %d after '%v'", st.State, st.Failures, err)
+		}
+	}
+}
+
+func TestHealthAuth(t *testing.T) {
+	var (
+		h    = NewHealth(&BreakerConf{Failures: 3, Cooldown: testCooldown})
+		cred = &Credential{Accounts: 1}
+	)
+	h.credential = func() *Credential {
+		return cred
+	}
+	h.Failure(pkg.NewError(pkg.ClassAuth, "token expired: %w", pkg.AuthErr))
+	if st := h.Status(); st.State != CircuitOpen || !st.Auth {
+		t.Fatalf("circuit %s auth %v after auth failure, want open", st.State, st.Auth)
+	}
+
+	// the cooldown does not probe an auth failure
+	time.Sleep(testCooldown)
+	if h.Ready() || h.Allow() {
+		t.Fatal("auth failed circuit allow before the credentials are refreshed")
+	}
+
+	// the credentials refreshed before the failure do not count
+	before := time.Now().Add(-time.Hour)
+	cred.RefreshedAt = &before
+	if h.Allow() {
+		t.Fatal("auth failed circuit allow with old credentials")
+	}
+
+	now := time.Now()
+	cred.RefreshedAt = &now
+	if !h.Ready() {
+		t.Fatal("auth failed circuit is not ready after refresh")
+	}
+	if !h.Allow() {
+		t.Fatal("auth failed circuit refuse the probe after refresh")
+	}
+	if st := h.Status(); st.State != CircuitHalfOpen || st.Auth {
+		t.Fatalf("circuit %s auth %v after refresh, want half-open", st.State, st.Auth)
+	}
+}
+
+func TestHealthDrain(t *testing.T) {
+	h := NewHealth(nil)
+	if !h.Enter() {
+		t.Fatal("backend refuse the attempt before drain")
+	}
+	drained := make(chan struct{})
+	go func() {
+		h.Drain()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		t.Fatal("drain return with an attempt in flight")
+	case <-time.After(testCooldown):
+	}
+	// the draining backend refuse new attempts
+	if h.Enter() {
+		t.Fatal("draining backend allow a new attempt")
+	}
+	h.Leave()
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("drain not return after the attempt left")
+	}
+}
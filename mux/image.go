@@ -0,0 +1,30 @@
+package mux
+
+import (
+	"context"
+)
+
+// ImageRequest is the input of one backend, model is the routed
+// upstream model, empty means the backend default.
+// b64 ask for the image data, backends may still return urls.
+type ImageRequest struct {
+	Model   string
+	Prompt  string
+	N       int
+	Size    string
+	Quality string
+	Style   string
+	B64     bool
+}
+
+// Image is one generated image, the url or the base64 data
+type Image struct {
+	Url           string
+	B64           string
+	RevisedPrompt string
+}
+
+// ImageGenerator is implemented by backends which can generate images
+type ImageGenerator interface {
+	GenerateImage(ctx context.Context, req *ImageRequest) ([]*Image, error)
+}
@@ -0,0 +1,153 @@
+package mux
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// IntentConf decide whether a chat ask for image or text.
+// the requested model in image_models is image, then the rules are tried
+// in order, and the classifier backend is asked when no rule matched.
+type IntentConf struct {
+	Rules       []*IntentRule   `yaml:"rules,omitempty"`
+	ImageModels []string        `yaml:"image_models,omitempty"`
+	Classifier  *ClassifierConf `yaml:"classifier,omitempty"`
+}
+
+// IntentRule match the last human message by prefix or regex,
+// mode is image or text, default is image.
+type IntentRule struct {
+	Prefix []string  `yaml:"prefix,omitempty"`
+	Regex  string    `yaml:"regex,omitempty"`
+	Mode   ChatModel `yaml:"mode,omitempty"`
+}
+
+// ClassifierConf ask a cheap text backend, model is the upstream model
+type ClassifierConf struct {
+	Backend string        `yaml:"backend"`
+	Model   string        `yaml:"model,omitempty"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// Classifier return the intent of text, used when no rule matched
+type Classifier func(ctx context.Context, text string) (ChatModel, error)
+
+var (
+	// "画" with the words which are not drawing, such as "画面为什么卡"
+	DefaultIntentRules = []*IntentRule{
+		{Prefix: []string{"画面", "画质", "画家", "画风", "画展", "画廊", "画布", "画中"}, Mode: TxtModel},
+		{Prefix: []string{"画"}, Mode: ImgModel},
+		{Regex: `(?i)^\s*(draw|paint|sketch)\s+(me\s+)?(a|an|the|some|\d+)\b`, Mode: ImgModel},
+		{Regex: `(?i)^\s*(generate|create|make)\s+(me\s+)?(a|an|some|\d+)?\s*(image|picture|photo|drawing|painting|illustration)s?\b`, Mode: ImgModel},
+	}
+
+	defaultIntent, _ = NewIntent(nil, nil)
+)
+
+type intentRule struct {
+	prefix []string
+	re     *regexp.Regexp
+	mode   ChatModel
+}
+
+// Intent detect the mode of conversation
+type Intent struct {
+	models   []string
+	rules    []*intentRule
+	classify Classifier
+}
+
+// NewIntent compile the rules, the default rules are used without rules.
+// classify is nil when the classifier is not configured.
+func NewIntent(c *IntentConf, classify Classifier) (*Intent, error) {
+	if c == nil {
+		c = &IntentConf{}
+	}
+	rules := c.Rules
+	if len(rules) == 0 {
+		rules = DefaultIntentRules
+	}
+	in := &Intent{
+		models:   c.ImageModels,
+		classify: classify,
+	}
+	for i, r := range rules {
+		ir := &intentRule{
+			prefix: r.Prefix,
+			mode:   r.Mode,
+		}
+		switch ir.mode {
+		case NonModel:
+			ir.mode = ImgModel
+		case ImgModel, TxtModel:
+		default:
+			return nil, fmt.Errorf("intent rule %d: unknown mode '%s'", i, r.Mode)
+		}
+		if r.Regex != "" {
+			re, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("intent rule %d: %v", i, err)
+			}
+			ir.re = re
+		}
+		if len(ir.prefix) == 0 && ir.re == nil {
+			return nil, fmt.Errorf("intent rule %d: prefix or regex must set", i)
+		}
+		in.rules = append(in.rules, ir)
+	}
+	for _, m := range in.models {
+		if _, err := path.Match(m, ""); err != nil {
+			return nil, fmt.Errorf("intent image model '%s': %v", m, err)
+		}
+	}
+	return in, nil
+}
+
+// Detect return the mode of conversation requested as model
+func (in *Intent) Detect(ctx context.Context, model string, conv *Conversation) ChatModel {
+	if in == nil {
+		in = defaultIntent
+	}
+	last := conv.LastHuman()
+	if last == nil || last.Content == "" {
+		return NonModel
+	}
+	for _, m := range in.models {
+		if ok, _ := path.Match(m, model); ok {
+			return ImgModel
+		}
+	}
+	if mode, ok := in.match(last.Content); ok {
+		return mode
+	}
+	if in.classify == nil {
+		return TxtModel
+	}
+	mode, err := in.classify(ctx, last.Content)
+	if err != nil {
+		klog.Warningf("classify intent failed, use text: %v", err)
+		return TxtModel
+	}
+	return mode
+}
+
+// match return the mode of the first matched rule
+func (in *Intent) match(text string) (ChatModel, bool) {
+	for _, r := range in.rules {
+		for _, p := range r.prefix {
+			if strings.HasPrefix(text, p) {
+				return r.mode, true
+			}
+		}
+		if r.re != nil && r.re.MatchString(text) {
+			return r.mode, true
+		}
+	}
+	return NonModel, false
+}
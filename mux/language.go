@@ -0,0 +1,162 @@
+package mux
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/yylt/gptmux/pkg/util"
+)
+
+type LangMode string
+
+const (
+	// answer in chinese when the prompt is chinese
+	LangAuto LangMode = "auto"
+	// always answer in the configured language
+	LangForce LangMode = "force"
+	// no language instruction, the empty mode is none
+	LangNone LangMode = "none"
+
+	// metadata key of *Language, the caller policy
+	LangKey = "lang"
+
+	zhInstruction = "请使用中文回答"
+)
+
+// Language is the reply language policy, prefix and suffix
+// are extra instructions around the last human message.
+type Language struct {
+	Mode   LangMode `yaml:"mode,omitempty"`
+	Lang   string   `yaml:"lang,omitempty"`
+	Prefix string   `yaml:"prefix,omitempty"`
+	Suffix string   `yaml:"suffix,omitempty"`
+}
+
+// Options are settings shared by all backends
+type Options struct {
+	// Name is the unique backend name, default is the backend type
+	Name     string       `yaml:"name,omitempty"`
+	Language *Language    `yaml:"language,omitempty"`
+	Breaker  *BreakerConf `yaml:"breaker,omitempty"`
+	// FirstToken is the max wait of the first streamed token, zero means no limit
+	FirstToken time.Duration `yaml:"first_token_timeout,omitempty"`
+}
+
+// Live is the options and index of a running backend, the reload
+// replace them while the requests read them.
+type Live struct {
+	opts  atomic.Pointer[Options]
+	index atomic.Int64
+}
+
+// Options return the current options, empty before Update
+func (l *Live) Options() *Options {
+	if o := l.opts.Load(); o != nil {
+		return o
+	}
+	return &Options{}
+}
+
+func (l *Live) Index() int {
+	return int(l.index.Load())
+}
+
+// Update replace the options and index, o is not changed after it
+func (l *Live) Update(o *Options, index int) {
+	l.opts.Store(o)
+	l.index.Store(int64(index))
+}
+
+// Merge return a copy of l, overwritten by the non-empty fields of o
+func (l *Language) Merge(o *Language) *Language {
+	ret := &Language{}
+	if l != nil {
+		*ret = *l
+	}
+	if o == nil {
+		return ret
+	}
+	if o.Mode != "" {
+		ret.Mode = o.Mode
+	}
+	if o.Lang != "" {
+		ret.Lang = o.Lang
+	}
+	if o.Prefix != "" {
+		ret.Prefix = o.Prefix
+	}
+	if o.Suffix != "" {
+		ret.Suffix = o.Suffix
+	}
+	return ret
+}
+
+// Default return a copy of l whose empty mode is mode, the web
+// backends answer in chinese by default.
+func (l *Language) Default(mode LangMode) *Language {
+	ret := (*Language)(nil).Merge(l)
+	if ret.Mode == "" {
+		ret.Mode = mode
+	}
+	return ret
+}
+
+// Apply add the instructions to prompt, auto mode detect the language of prompt.
+// force mode without lang means chinese.
+func (l *Language) Apply(prompt string) string {
+	if l == nil {
+		l = &Language{}
+	}
+	var parts []string
+	if l.Prefix != "" {
+		parts = append(parts, l.Prefix)
+	}
+	parts = append(parts, prompt)
+	if ins := l.instruction(prompt); ins != "" {
+		parts = append(parts, ins)
+	}
+	if l.Suffix != "" {
+		parts = append(parts, l.Suffix)
+	}
+	return strings.Join(parts, "\r\n")
+}
+
+func (l *Language) instruction(prompt string) string {
+	iszh := util.HasChineseChar(prompt)
+	switch l.Mode {
+	case LangForce:
+		if isChinese(l.Lang) {
+			if iszh {
+				return ""
+			}
+			return zhInstruction
+		}
+		return fmt.Sprintf("Please answer in %s", l.Lang)
+	case LangAuto:
+		if iszh {
+			return zhInstruction
+		}
+	}
+	return ""
+}
+
+func isChinese(lang string) bool {
+	switch strings.ToLower(lang) {
+	case "", "zh", "zh-cn", "chinese", "中文":
+		return true
+	}
+	return false
+}
+
+// GetLanguage merge the backend policy with the caller policy in metadata
+func GetLanguage(base *Language, options ...llms.CallOption) *Language {
+	opt := &llms.CallOptions{}
+	for _, o := range options {
+		o(opt)
+	}
+	caller, _ := opt.Metadata[LangKey].(*Language)
+	return base.Merge(caller)
+}
@@ -0,0 +1,29 @@
+package mux
+
+import "testing"
+
+func TestLanguageApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		lang   *Language
+		prompt string
+		want   string
+	}{
+		{name: "nil", prompt: "你好", want: "你好"},
+		{name: "empty mode", lang: &Language{}, prompt: "你好", want: "你好"},
+		{name: "none", lang: &Language{Mode: LangNone, Suffix: "bye"}, prompt: "你好", want: "你好\r\nbye"},
+		{name: "auto chinese", lang: &Language{Mode: LangAuto}, prompt: "你好", want: "你好\r\n" + zhInstruction},
+		{name: "auto english", lang: &Language{Mode: LangAuto}, prompt: "hello", want: "hello"},
+		{name: "force chinese", lang: &Language{Mode: LangForce}, prompt: "hello", want: "hello\r\n" + zhInstruction},
+		{name: "force english", lang: &Language{Mode: LangForce, Lang: "English"}, prompt: "hi", want: "hi\r\nPlease answer in English"},
+		{name: "default auto", lang: (*Language)(nil).Default(LangAuto), prompt: "你好", want: "你好\r\n" + zhInstruction},
+		{name: "default kept", lang: (&Language{Mode: LangNone}).Default(LangAuto), prompt: "你好", want: "你好"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.lang.Apply(tt.prompt); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
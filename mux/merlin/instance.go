@@ -1,6 +1,7 @@
 package merlin
 
 import (
+	"context"
 	"fmt"
 
 	"k8s.io/klog/v2"
@@ -49,7 +50,7 @@ func NewInstance(m *Merlin, u *user) *instance {
 		user:     u.User,
 		password: u.Password,
 	}
-	err := m.access(ins)
+	err := m.access(context.Background(), ins)
 	if err != nil {
 		klog.Errorf("access user %s, error: %v", ins, err)
 		return nil
@@ -8,17 +8,23 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/emirpasic/gods/queues/priorityqueue"
 	"github.com/tmc/langchaingo/llms"
 	"github.com/yylt/gptmux/mux"
 	"github.com/yylt/gptmux/pkg"
+	"github.com/yylt/gptmux/pkg/tracing"
 	"github.com/yylt/gptmux/pkg/util"
 	"k8s.io/klog/v2"
 )
 
-var _ mux.Model = &Merlin{}
+var (
+	_ mux.Model         = &Merlin{}
+	_ mux.Authenticator = &Merlin{}
+)
 
 type modelfn func(er *EventResp) *pkg.BackResp
 
@@ -28,9 +34,7 @@ var (
 		"accept-language": "zh-CN,zh;q=0.9,en;q=0.8,zh-Hans;q=0.7",
 	}
 
-	defaultClient *http.Client
-
-	errAuth = errors.New("unauth")
+	errAuth = pkg.AuthErr
 
 	name = "merlin"
 )
@@ -69,6 +73,8 @@ type Config struct {
 	Appurl  string  `yaml:"appurl"`
 	Users   []*user `yaml:"users"`
 	Model   model   `yaml:"model,omitempty"`
+
+	mux.Options `yaml:",inline"`
 }
 
 func (c *Config) textModel() string {
@@ -85,10 +91,24 @@ func (c *Config) imageModel() string {
 	return c.Model.Img
 }
 
+// Account is the usage of one merlin user, busy is serving a chat
+type Account struct {
+	User  string `json:"user"`
+	Used  int    `json:"used"`
+	Limit int    `json:"limit"`
+	Busy  bool   `json:"busy"`
+}
+
 type Merlin struct {
 	cfg *Config
-
-	queue *priorityqueue.Queue
+	mux.Live
+	cli *http.Client
+
+	// mu protect the queue, the usage and tokens of instances
+	mu        sync.Mutex
+	queue     *priorityqueue.Queue
+	insts     []*instance
+	refreshed time.Time
 }
 
 func NewMerlinIns(cfg *Config) *Merlin {
@@ -96,17 +116,22 @@ func NewMerlinIns(cfg *Config) *Merlin {
 		klog.Errorf("merlin config is invalid: %v", cfg)
 		return nil
 	}
+	if cfg.Name == "" {
+		cfg.Name = name
+	}
 	ml := &Merlin{
 		cfg:   cfg,
+		cli:   util.NewDebugHTTPClient(cfg.Proxy, cfg.Debug),
 		queue: priorityqueue.NewWith(instCompare),
 	}
-	defaultClient = util.NewDebugHTTPClient(cfg.Proxy, cfg.Debug)
+	ml.Update(&cfg.Options, cfg.Index)
 
 	for _, user := range cfg.Users {
 		u := NewInstance(ml, user)
 		if u != nil {
 			klog.Infof("merlin instance %s created", u)
 			ml.queue.Enqueue(u)
+			ml.insts = append(ml.insts, u)
 		}
 	}
 
@@ -114,11 +139,14 @@ func NewMerlinIns(cfg *Config) *Merlin {
 }
 
 func (m *Merlin) Name() string {
-	return name
+	return m.cfg.Name
 }
 
-func (m *Merlin) Index() int {
-	return m.cfg.Index
+func (m *Merlin) Models() []*mux.ModelInfo {
+	return []*mux.ModelInfo{
+		{Id: m.cfg.textModel(), OwnedBy: m.Name(), Capabilities: []string{mux.CapChat, mux.CapCompletion}},
+		{Id: m.cfg.imageModel(), OwnedBy: m.Name(), Capabilities: []string{mux.CapImage}},
+	}
 }
 
 func (m *Merlin) Completion(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
@@ -132,7 +160,7 @@ func (m *Merlin) Completion(ctx context.Context, prompt string, options ...llms.
 		o(opt)
 	}
 	defer util.PutBuf(buf)
-	err = m.chat(prompt, mux.TxtModel, func(resp *http.Response, ins *instance) error {
+	err = m.chat(ctx, prompt, mux.TxtModel, opt.Model, func(resp *http.Response, ins *instance) error {
 		var (
 			respData = &EventResp{}
 
@@ -154,15 +182,14 @@ func (m *Merlin) Completion(ctx context.Context, prompt string, options ...llms.
 				continue
 			}
 			if respData.Data.Usage.Limit != 0 {
-				ins.used = respData.Data.Usage.Used
-				ins.limit = respData.Data.Usage.Limit
+				m.setUsage(ins, respData.Data.Usage.Used, respData.Data.Usage.Limit)
 			}
 			ret = textProcess(respData)
 			if ret == nil {
 				continue
 			}
 			buf.WriteString(ret.Content)
-			if ret.Err != nil {
+			if ret.Done {
 				once.Do(cancle)
 			}
 			if opt.StreamingFunc != nil {
@@ -187,9 +214,9 @@ func (m *Merlin) GenerateContent(ctx context.Context, messages []llms.MessageCon
 	for _, o := range options {
 		o(opt)
 	}
-	prompt, model := mux.GeneraPrompt(messages)
+	prompt, model := mux.GeneraPrompt(mux.GetConversation(messages, m.Options().Language.Default(mux.LangAuto), options...))
 
-	err := m.chat(prompt, model, func(resp *http.Response, ins *instance) error {
+	err := m.chat(ctx, prompt, model, opt.Model, func(resp *http.Response, ins *instance) error {
 		var (
 			respData = &EventResp{}
 
@@ -211,8 +238,7 @@ func (m *Merlin) GenerateContent(ctx context.Context, messages []llms.MessageCon
 				continue
 			}
 			if respData.Data.Usage.Limit != 0 {
-				ins.used = respData.Data.Usage.Used
-				ins.limit = respData.Data.Usage.Limit
+				m.setUsage(ins, respData.Data.Usage.Used, respData.Data.Usage.Limit)
 			}
 			if model == mux.TxtModel {
 				ret = textProcess(respData)
@@ -226,7 +252,7 @@ func (m *Merlin) GenerateContent(ctx context.Context, messages []llms.MessageCon
 			data.Choices = append(data.Choices, &llms.ContentChoice{
 				Content: ret.Content,
 			})
-			if ret.Err != nil {
+			if ret.Done {
 				data.Choices = append(data.Choices, &llms.ContentChoice{
 					StopReason: "stop",
 				})
@@ -246,11 +272,67 @@ func (m *Merlin) GenerateContent(ctx context.Context, messages []llms.MessageCon
 	return data, err
 }
 
+// GenerateImage use the image mode, n and size are mapped to numImages and aspectRatio
+func (m *Merlin) GenerateImage(ctx context.Context, req *mux.ImageRequest) ([]*mux.Image, error) {
+	var (
+		ret   []*mux.Image
+		model = req.Model
+		url   = fmt.Sprintf("%s/thread/image-generation", m.cfg.Appurl)
+	)
+	if model == "" {
+		model = m.cfg.imageModel()
+	}
+	body := imageBody(req.Prompt, model, max(req.N, 1), aspectRatio(req.Size))
+	err := m.send(ctx, url, body, func(resp *http.Response, ins *instance) error {
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if !bytes.HasPrefix(line, util.HeaderData) {
+				continue
+			}
+			respData := &EventResp{}
+			if err := json.Unmarshal(bytes.TrimPrefix(line, util.HeaderData), respData); err != nil {
+				klog.Warningf("parse event data failed: %v", err)
+				continue
+			}
+			if respData.Data == nil {
+				continue
+			}
+			if respData.Data.Usage.Limit != 0 {
+				m.setUsage(ins, respData.Data.Usage.Used, respData.Data.Usage.Limit)
+			}
+			switch respData.Data.Type {
+			case string(system):
+				for _, a := range respData.Data.Attachs {
+					if a.Url != "" {
+						ret = append(ret, &mux.Image{Url: a.Url})
+					}
+				}
+			case string(done):
+				return nil
+			}
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(ret) == 0 {
+		return nil, pkg.NewError(pkg.ClassUpstream, "%s: no image generated", m.Name())
+	}
+	return ret, nil
+}
+
 func (m *Merlin) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
-	return "", fmt.Errorf("not implement")
+	return "", pkg.UnsupportedErr
 }
 
-func (m *Merlin) access(ins *instance) error {
+func (m *Merlin) access(ctx context.Context, ins *instance) (err error) {
+	ctx, span := tracing.Start(ctx, "Merlin.access", tracing.BackendKey.String(m.Name()))
+	defer func() {
+		tracing.End(span, err)
+	}()
 	var (
 		status = &authResp{}
 		body   = map[string]interface{}{
@@ -263,7 +345,7 @@ func (m *Merlin) access(ins *instance) error {
 	)
 	// idtoken
 	bodys, _ := json.Marshal(body)
-	resp, err := request(surl, "POST", bodys, map[string]string{
+	resp, err := m.request(ctx, surl, "POST", bodys, map[string]string{
 		"accept":       "*/*",
 		"content-type": "application/json",
 	})
@@ -287,7 +369,7 @@ func (m *Merlin) access(ins *instance) error {
 
 	// accesstoken
 	bodys, _ = json.Marshal(tbody)
-	appresp, err := request(turl, "POST", bodys, map[string]string{
+	appresp, err := m.request(ctx, turl, "POST", bodys, map[string]string{
 		"accept":       "*/*",
 		"content-type": "application/json",
 	})
@@ -301,55 +383,66 @@ func (m *Merlin) access(ins *instance) error {
 		return err
 	}
 
+	m.mu.Lock()
 	ins.accesstoken = tstatus.Data.Access
 	ins.idtoken = status.IdToken
+	m.refreshed = time.Now()
+	m.mu.Unlock()
 
 	return nil
 }
 
-func (m *Merlin) chat(prompt string, mode mux.ChatModel, fn func(*http.Response, *instance) error) error {
-
-	var (
-		url  string
-		body map[string]any
-	)
+// chat send prompt, upstream overwrite the text model when not empty
+func (m *Merlin) chat(ctx context.Context, prompt string, mode mux.ChatModel, upstream string, fn func(*http.Response, *instance) error) error {
 	switch mode {
 	case mux.TxtModel:
-		url = fmt.Sprintf("%s/thread/unified?version=1.1", m.cfg.Appurl)
-		body = chatBody(prompt, m.cfg.textModel())
+		if upstream == "" {
+			upstream = m.cfg.textModel()
+		}
+		return m.send(ctx, fmt.Sprintf("%s/thread/unified?version=1.1", m.cfg.Appurl), chatBody(prompt, upstream), fn)
 	case mux.ImgModel:
-		url = fmt.Sprintf("%s/thread/image-generation", m.cfg.Appurl)
-		body = imageBody(prompt, m.cfg.imageModel())
-	default:
-		return fmt.Errorf("not support prompt type '%s'", mode)
+		return m.send(ctx, fmt.Sprintf("%s/thread/image-generation", m.cfg.Appurl), imageBody(prompt, m.cfg.imageModel(), 1, defaultAspect), fn)
 	}
+	return pkg.NewError(pkg.ClassUnsupported, "not support prompt type '%s'", mode)
+}
+
+// send post body with the least used account, the token is refreshed once on auth error
+func (m *Merlin) send(ctx context.Context, url string, body map[string]any, fn func(*http.Response, *instance) error) error {
+	m.mu.Lock()
 	cu, ok := m.queue.Dequeue()
+	m.mu.Unlock()
 	if !ok {
-		return fmt.Errorf("%s is busy", m.Name())
+		return fmt.Errorf("%s: %w", m.Name(), pkg.BusyErr)
 	}
 	ins := cu.(*instance)
 
 	defer func() {
 		klog.Infof("merlin chat done, %s", ins)
+		m.mu.Lock()
 		m.queue.Enqueue(ins)
+		m.mu.Unlock()
 	}()
+	// the least used instance is exhausted, so are the others
+	if ins.limit > 0 && ins.used >= ins.limit {
+		return fmt.Errorf("%s %s: %w", m.Name(), ins, pkg.QuotaErr)
+	}
 
 	bodystr, err := json.Marshal(body)
 	if err != nil {
-		return fmt.Errorf("marshal body failed :%v", err)
+		return pkg.NewError(pkg.ClassBadRequest, "marshal body failed :%v", err)
 	}
 	sendheader := map[string]string{
 		"Accept":        "text/event-stream",
 		"Connection":    "keep-alive",
 		"content-type":  "application/json",
-		"Authorization": "Bearer " + ins.idtoken,
+		"Authorization": "Bearer " + m.idtoken(ins),
 	}
-	resp, err := request(url, "post", bodystr, sendheader)
+	resp, err := m.request(ctx, url, "post", bodystr, sendheader)
 	if err != nil && errors.Is(err, errAuth) {
-		err = m.access(ins)
+		err = m.access(ctx, ins)
 		if err == nil {
-			sendheader["Authorization"] = "Bearer " + ins.idtoken
-			resp, err = request(url, "post", bodystr, sendheader)
+			sendheader["Authorization"] = "Bearer " + m.idtoken(ins)
+			resp, err = m.request(ctx, url, "post", bodystr, sendheader)
 		}
 	}
 	if err != nil {
@@ -358,13 +451,101 @@ func (m *Merlin) chat(prompt string, mode mux.ChatModel, fn func(*http.Response,
 	return fn(resp, ins)
 }
 
-func request(address, method string, body []byte, headers map[string]string) (*http.Response, error) {
+func (m *Merlin) idtoken(ins *instance) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return ins.idtoken
+}
+
+func (m *Merlin) setUsage(ins *instance, used, limit int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ins.used = used
+	ins.limit = limit
+}
+
+// Accounts return the usage of users, the idle ones first in dequeue order
+func (m *Merlin) Accounts() []*Account {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	idle := map[*instance]bool{}
+	for _, v := range m.queue.Values() {
+		idle[v.(*instance)] = true
+	}
+	var ret []*Account
+	for _, ins := range m.insts {
+		ret = append(ret, &Account{
+			User:  ins.user,
+			Used:  ins.used,
+			Limit: ins.limit,
+			Busy:  !idle[ins],
+		})
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Busy != ret[j].Busy {
+			return !ret[i].Busy
+		}
+		return ret[i].Used < ret[j].Used
+	})
+	return ret
+}
+
+// Login refresh the tokens of users, the users failed at startup are added
+func (m *Merlin) Login(ctx context.Context) error {
+	m.mu.Lock()
+	insts := map[string]*instance{}
+	for _, ins := range m.insts {
+		insts[ins.user] = ins
+	}
+	m.mu.Unlock()
+
+	var errs []error
+	for _, u := range m.cfg.Users {
+		ins, ok := insts[u.User]
+		if !ok {
+			ins = &instance{user: u.User, password: u.Password}
+		}
+		if err := m.access(ctx, ins); err != nil {
+			errs = append(errs, fmt.Errorf("user %s: %w", u.User, err))
+			continue
+		}
+		if !ok {
+			klog.Infof("merlin instance %s created", ins)
+			m.mu.Lock()
+			m.queue.Enqueue(ins)
+			m.insts = append(m.insts, ins)
+			m.mu.Unlock()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Credential return the login state of users
+func (m *Merlin) Credential() *mux.Credential {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := &mux.Credential{
+		Accounts: len(m.cfg.Users),
+	}
+	for _, ins := range m.insts {
+		if ins.idtoken != "" {
+			c.LoggedIn++
+		}
+	}
+	if !m.refreshed.IsZero() {
+		refreshed := m.refreshed
+		c.RefreshedAt = &refreshed
+	}
+	return c
+}
+
+func (m *Merlin) request(ctx context.Context, address, method string, body []byte, headers map[string]string) (*http.Response, error) {
 	// send prompt
 	var buf = &bytes.Buffer{}
 	if body != nil {
 		buf = bytes.NewBuffer(body)
 	}
-	req, err := http.NewRequest(method, address, buf)
+	req, err := http.NewRequestWithContext(ctx, method, address, buf)
 	if err != nil {
 		return nil, err
 	}
@@ -376,17 +557,14 @@ func request(address, method string, body []byte, headers map[string]string) (*h
 	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
-	resp, err := defaultClient.Do(req)
+	resp, err := m.cli.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, pkg.NewError(pkg.ClassUpstream, "request '%s' failed: %w", address, err)
 	}
 	if !util.IsHttp20xCode(resp.StatusCode) {
 		resp.Body.Close()
 		klog.Errorf("request '%s' failed: %v, code: %d", address, http.StatusText(resp.StatusCode), resp.StatusCode)
-		if resp.StatusCode == http.StatusUnauthorized {
-			return nil, errAuth
-		}
-		return nil, fmt.Errorf("request '%s' code: %s", address, http.StatusText(resp.StatusCode))
+		return nil, pkg.StatusError(resp.StatusCode, "request '%s' code: %s", address, http.StatusText(resp.StatusCode))
 	}
 	return resp, nil
 }
@@ -402,7 +580,7 @@ func textProcess(er *EventResp) *pkg.BackResp {
 		}
 	case string(done):
 		return &pkg.BackResp{
-			Err: errors.New("done"),
+			Done: true,
 		}
 	}
 	return nil
@@ -1,6 +1,9 @@
 package merlin
 
 import (
+	"fmt"
+	"math"
+
 	"github.com/google/uuid"
 )
 
@@ -12,8 +15,22 @@ const (
 	done   eventType = "DONE"
 
 	usageMerlin string = "merlin"
+
+	defaultAspect = "1:1"
 )
 
+// aspect ratios of merlin image
+var aspects = []struct {
+	name  string
+	ratio float64
+}{
+	{"1:1", 1},
+	{"4:3", 4.0 / 3},
+	{"3:4", 3.0 / 4},
+	{"16:9", 16.0 / 9},
+	{"9:16", 9.0 / 16},
+}
+
 type authResp struct {
 	LocalId string `json:"localId"`
 	IdToken string `json:"idToken"`
@@ -81,7 +98,8 @@ func chatBody(prompt string, model string) map[string]interface{} {
 	}
 }
 
-func imageBody(prompt string, model string) map[string]interface{} {
+// imageBody ask num images of the aspect ratio, such as 16:9
+func imageBody(prompt string, model string, num int, aspect string) map[string]interface{} {
 	return map[string]interface{}{
 		"action": map[string]interface{}{
 			"message": map[string]interface{}{
@@ -95,11 +113,29 @@ func imageBody(prompt string, model string) map[string]interface{} {
 			"type": "NEW",
 		},
 		"metadata": map[string]interface{}{
-			"aspectRatio": "1:1",
-			"numImages":   1,
+			"aspectRatio": aspect,
+			"numImages":   num,
 		},
 		"chatId": uuid.New().String(),
 		"mode":   "IMAGE_CHAT",
 		"model":  model,
 	}
 }
+
+// aspectRatio return the nearest merlin aspect ratio of size, such as 1792x1024
+func aspectRatio(size string) string {
+	var w, h float64
+	if _, err := fmt.Sscanf(size, "%fx%f", &w, &h); err != nil || w <= 0 || h <= 0 {
+		return defaultAspect
+	}
+	var (
+		ret  = defaultAspect
+		diff = math.MaxFloat64
+	)
+	for _, a := range aspects {
+		if d := math.Abs(math.Log(w / h / a.ratio)); d < diff {
+			ret, diff = a.name, d
+		}
+	}
+	return ret
+}
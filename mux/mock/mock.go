@@ -0,0 +1,302 @@
+package mock
+
+import (
+	"cmp"
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/pkg"
+	"k8s.io/klog/v2"
+)
+
+const (
+	name = "mock"
+
+	maxCalls = 100
+
+	defaultDimensions = 8
+)
+
+// Conf of mock, the script chunks are sent in order, without script
+// the last human message is echoed word by word.
+type Conf struct {
+	Models []string `yaml:"models,omitempty"`
+	Script []string `yaml:"script,omitempty"`
+	// delay before the first chunk and between chunks
+	FirstLatency time.Duration `yaml:"first_latency,omitempty"`
+	Latency      time.Duration `yaml:"latency,omitempty"`
+	// busy always return BusyErr, concurrency return BusyErr when exceeded
+	Busy        bool  `yaml:"busy,omitempty"`
+	Concurrency int   `yaml:"concurrency,omitempty"`
+	Fail        *Fail `yaml:"fail,omitempty"`
+	Index       int   `yaml:"index,omitempty"`
+	// size of embedding vectors, default 8
+	Dimensions int `yaml:"dimensions,omitempty"`
+
+	mux.Options `yaml:",inline"`
+}
+
+// Fail inject an error of class after some chunks, times limit
+// the failed calls, 0 means every call.
+type Fail struct {
+	Class   pkg.Class `yaml:"class"`
+	After   int       `yaml:"after,omitempty"`
+	Times   int       `yaml:"times,omitempty"`
+	Message string    `yaml:"message,omitempty"`
+}
+
+// Call is one request served by mock
+type Call struct {
+	Time   time.Time `json:"time"`
+	Model  string    `json:"model,omitempty"`
+	Prompt string    `json:"prompt"`
+	Chunks int       `json:"chunks"`
+	Err    string    `json:"error,omitempty"`
+}
+
+var (
+	_ mux.Model    = &Mock{}
+	_ mux.FimModel = &Mock{}
+	_ mux.Embedder = &Mock{}
+)
+
+type Mock struct {
+	c *Conf
+	mux.Live
+
+	mu      sync.Mutex
+	running int
+	failed  int
+	calls   []*Call
+}
+
+func New(c *Conf) *Mock {
+	if c == nil {
+		klog.Warningf("mock config is invalid: %v", c)
+		return nil
+	}
+	if c.Name == "" {
+		c.Name = name
+	}
+	m := &Mock{c: c}
+	m.Update(&c.Options, c.Index)
+	return m
+}
+
+func (m *Mock) Name() string {
+	return m.c.Name
+}
+
+func (m *Mock) Models() []*mux.ModelInfo {
+	ids := m.c.Models
+	if len(ids) == 0 {
+		ids = []string{m.Name()}
+	}
+	var ret []*mux.ModelInfo
+	for _, id := range ids {
+		ret = append(ret, &mux.ModelInfo{
+			Id:           id,
+			OwnedBy:      m.Name(),
+			Capabilities: []string{mux.CapChat, mux.CapCompletion, mux.CapEmbedding},
+		})
+	}
+	return ret
+}
+
+// Calls return the recent calls, the oldest first
+func (m *Mock) Calls() []*Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Call(nil), m.calls...)
+}
+
+func (m *Mock) Completion(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return m.serve(ctx, prompt, options...)
+}
+
+func (m *Mock) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	var (
+		conv   = mux.GetConversation(messages, m.Options().Language, options...)
+		prompt string
+	)
+	if last := conv.LastHuman(); last != nil {
+		prompt = last.Content
+	}
+	text, err := m.serve(ctx, prompt, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &llms.ContentResponse{
+		Choices: []*llms.ContentChoice{
+			{Content: text, StopReason: "stop"},
+		},
+	}, nil
+}
+
+func (m *Mock) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return "", pkg.UnsupportedErr
+}
+
+func (m *Mock) serve(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	opt := &llms.CallOptions{}
+	for _, o := range options {
+		o(opt)
+	}
+	call := &Call{
+		Time:   time.Now(),
+		Model:  opt.Model,
+		Prompt: prompt,
+	}
+	text, err := m.run(ctx, prompt, call, opt)
+	m.record(call, err)
+	return text, err
+}
+
+// Embed return vectors derived from the input, latency and failures
+// are injected as chat.
+func (m *Mock) Embed(ctx context.Context, req *mux.EmbedRequest) (*mux.Embedding, error) {
+	call := &Call{
+		Time:   time.Now(),
+		Model:  req.Model,
+		Prompt: strings.Join(req.Input, "\n"),
+	}
+	ret, err := m.embed(ctx, req, call)
+	m.record(call, err)
+	return ret, err
+}
+
+func (m *Mock) embed(ctx context.Context, req *mux.EmbedRequest, call *Call) (*mux.Embedding, error) {
+	if err := m.acquire(); err != nil {
+		return nil, err
+	}
+	defer m.release()
+	if m.c.Latency > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, pkg.NewError(pkg.ClassCanceled, "%s canceled: %w", m.Name(), ctx.Err())
+		case <-time.After(m.c.Latency):
+		}
+	}
+	if err := m.fail(); err != nil {
+		return nil, err
+	}
+	dims := cmp.Or(req.Dimensions, m.c.Dimensions, defaultDimensions)
+	ret := &mux.Embedding{}
+	for _, in := range req.Input {
+		h := fnv.New64a()
+		h.Write([]byte(in))
+		rnd := rand.New(rand.NewSource(int64(h.Sum64())))
+		vec := make([]float32, dims)
+		for i := range vec {
+			vec[i] = rnd.Float32()*2 - 1
+		}
+		ret.Vectors = append(ret.Vectors, vec)
+		ret.PromptTokens += len(strings.Fields(in))
+		call.Chunks++
+	}
+	return ret, nil
+}
+
+// record keep the recent calls
+func (m *Mock) record(call *Call, err error) {
+	if err != nil {
+		call.Err = err.Error()
+	}
+	klog.Infof("%s call model '%s', chunks %d, error: %v", m.Name(), call.Model, call.Chunks, err)
+
+	m.mu.Lock()
+	m.calls = append(m.calls, call)
+	if len(m.calls) > maxCalls {
+		m.calls = m.calls[len(m.calls)-maxCalls:]
+	}
+	m.mu.Unlock()
+}
+
+func (m *Mock) run(ctx context.Context, prompt string, call *Call, opt *llms.CallOptions) (string, error) {
+	if err := m.acquire(); err != nil {
+		return "", err
+	}
+	defer m.release()
+
+	var (
+		chunks = m.chunks(prompt)
+		fail   = m.fail()
+		buf    strings.Builder
+	)
+	for i, ch := range chunks {
+		if fail != nil && i == m.c.Fail.After {
+			return "", fail
+		}
+		delay := m.c.Latency
+		if i == 0 {
+			delay = m.c.FirstLatency
+		}
+		if delay > 0 {
+			select {
+			case <-ctx.Done():
+				return "", pkg.NewError(pkg.ClassCanceled, "%s canceled: %w", m.Name(), ctx.Err())
+			case <-time.After(delay):
+			}
+		}
+		buf.WriteString(ch)
+		call.Chunks++
+		if opt.StreamingFunc != nil {
+			if err := opt.StreamingFunc(ctx, []byte(ch)); err != nil {
+				return buf.String(), err
+			}
+		}
+	}
+	if fail != nil {
+		return "", fail
+	}
+	return buf.String(), nil
+}
+
+func (m *Mock) acquire() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.c.Busy || (m.c.Concurrency > 0 && m.running >= m.c.Concurrency) {
+		return pkg.BusyErr
+	}
+	m.running++
+	return nil
+}
+
+func (m *Mock) release() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.running--
+}
+
+// fail return the injected error of this call, or nil
+func (m *Mock) fail() error {
+	f := m.c.Fail
+	if f == nil || f.Class == "" {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f.Times > 0 && m.failed >= f.Times {
+		return nil
+	}
+	m.failed++
+	msg := f.Message
+	if msg == "" {
+		msg = "injected failure"
+	}
+	return pkg.NewError(f.Class, "%s: %s", m.Name(), msg)
+}
+
+// chunks return the script, or the prompt split by words
+func (m *Mock) chunks(prompt string) []string {
+	if len(m.c.Script) != 0 {
+		return m.c.Script
+	}
+	return strings.SplitAfter(prompt, " ")
+}
@@ -2,15 +2,21 @@ package ollama
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 
+	"github.com/google/uuid"
 	"github.com/ollama/ollama/api"
 	"github.com/tmc/langchaingo/llms"
 	"github.com/yylt/gptmux/mux"
 	"github.com/yylt/gptmux/pkg"
+	"github.com/yylt/gptmux/pkg/tracing"
 	"k8s.io/klog/v2"
 )
 
@@ -22,7 +28,7 @@ var (
 		"content-type": "application/json",
 	}
 	defaultClient = &http.Client{
-		Transport: http.DefaultTransport,
+		Transport: tracing.Transport(http.DefaultTransport),
 	}
 )
 
@@ -30,6 +36,11 @@ type Config struct {
 	Model  string `yaml:"model_name"`
 	Server string `yaml:"server"`
 	Index  int    `yaml:"index,omitempty"`
+	// embedding model and the max inputs of one request, 0 means no limit
+	EmbedModel string `yaml:"embedding_model,omitempty"`
+	EmbedBatch int    `yaml:"embedding_batch,omitempty"`
+
+	mux.Options `yaml:",inline"`
 }
 type ollamaResp struct {
 	Resp string `yaml:"response,omitempty"`
@@ -41,9 +52,8 @@ type ollm struct {
 
 	mu sync.RWMutex
 
-	index int
-
 	c *Config
+	mux.Live
 
 	cli *api.Client
 }
@@ -53,26 +63,49 @@ func New(ctx context.Context, cfg *Config) *ollm {
 		klog.Warningf("ollama config is invalid: %v", cfg)
 		return nil
 	}
+	if cfg.Name == "" {
+		cfg.Name = "ollama"
+	}
 	u, err := url.Parse(cfg.Server)
 	if err != nil {
 		klog.Errorf("ollama server failed: %s", err)
 		return nil
 	}
 
-	return &ollm{
-		ctx:   ctx,
-		c:     cfg,
-		index: cfg.Index,
-		cli:   api.NewClient(u, defaultClient),
+	d := &ollm{
+		ctx: ctx,
+		c:   cfg,
+		cli: api.NewClient(u, defaultClient),
 	}
+	d.Update(&cfg.Options, cfg.Index)
+	return d
 }
 
 func (d *ollm) Name() string {
-	return "ollama"
+	return d.c.Name
+}
+
+func (d *ollm) Models() []*mux.ModelInfo {
+	ret := []*mux.ModelInfo{
+		{Id: d.c.Model, OwnedBy: d.Name(), Capabilities: []string{mux.CapChat, mux.CapTools}},
+	}
+	if d.c.EmbedModel != "" {
+		ret = append(ret, &mux.ModelInfo{Id: d.c.EmbedModel, OwnedBy: d.Name(), Capabilities: []string{mux.CapEmbedding}})
+	}
+	return ret
+}
+
+// ToolCalling report the tools are forwarded to the chat api
+func (d *ollm) ToolCalling() bool {
+	return true
 }
 
-func (d *ollm) Index() int {
-	return d.index
+// model return the routed upstream model, or the configured one
+func (d *ollm) model(opt *llms.CallOptions) string {
+	if opt.Model != "" {
+		return opt.Model
+	}
+	return d.c.Model
 }
 
 func (d *ollm) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
@@ -80,38 +113,61 @@ func (d *ollm) GenerateContent(ctx context.Context, messages []llms.MessageConte
 		return nil, pkg.BusyErr
 	}
 	defer d.mu.Unlock()
-	prompt, model := mux.GeneraPrompt(messages)
+	conv := mux.GetConversation(messages, d.Options().Language, options...)
 
-	if model != mux.TxtModel {
-		return nil, fmt.Errorf("not support model '%s'", model)
+	if model := conv.Mode(); model != mux.TxtModel {
+		return nil, pkg.NewError(pkg.ClassUnsupported, "not support model '%s'", model)
 	}
 	var (
+		done         bool
+		msgs         []api.Message
 		opt          = &llms.CallOptions{}
 		bctx, cancle = context.WithCancel(ctx)
 		data         = &llms.ContentResponse{}
 
 		once sync.Once
 	)
+	defer cancle()
 
 	for _, o := range options {
 		o(opt)
 	}
 
-	d.cli.Generate(bctx, &api.GenerateRequest{
-		Model:  d.c.Model,
-		Prompt: prompt,
-	}, func(gr api.GenerateResponse) error {
+	for _, t := range conv.Turns {
+		msg := api.Message{
+			Role:    mux.RoleName(t.Role),
+			Content: t.Content,
+		}
+		calls, err := toolCalls(t.ToolCalls)
+		if err != nil {
+			return nil, err
+		}
+		msg.ToolCalls = calls
+		msgs = append(msgs, msg)
+	}
+	tools, err := convertTools(opt.Tools)
+	if err != nil {
+		return nil, err
+	}
+	err = d.cli.Chat(bctx, &api.ChatRequest{
+		Model:    d.model(opt),
+		Messages: msgs,
+		Tools:    tools,
+	}, func(gr api.ChatResponse) error {
 		data.Choices = append(data.Choices, &llms.ContentChoice{
-			Content: gr.Response,
+			Content:   gr.Message.Content,
+			ToolCalls: fromToolCalls(gr.Message.ToolCalls),
 		})
 		if gr.Done {
+			done = true
+			mux.GetUsage(options...).Set(gr.PromptEvalCount, gr.EvalCount)
 			data.Choices = append(data.Choices, &llms.ContentChoice{
 				StopReason: "stop",
 			})
 			once.Do(cancle)
 		}
 		if opt.StreamingFunc != nil {
-			err := opt.StreamingFunc(bctx, []byte(gr.Response))
+			err := opt.StreamingFunc(bctx, []byte(gr.Message.Content))
 			if err != nil {
 				once.Do(cancle)
 				return err
@@ -119,10 +175,107 @@ func (d *ollm) GenerateContent(ctx context.Context, messages []llms.MessageConte
 		}
 		return nil
 	})
-
+	if err != nil && !done {
+		if errors.Is(err, io.EOF) {
+			return data, err
+		}
+		return nil, classify(err)
+	}
+	if !done {
+		return nil, pkg.NewError(pkg.ClassUpstream, "ollama stream closed before done")
+	}
 	return data, nil
 }
 
+// convertTools return the tools of ollama, the parameters are json schema
+func convertTools(tools []llms.Tool) (api.Tools, error) {
+	if len(tools) == 0 {
+		return nil, nil
+	}
+	bs, err := json.Marshal(tools)
+	if err != nil {
+		return nil, err
+	}
+	var ret api.Tools
+	if err = json.Unmarshal(bs, &ret); err != nil {
+		return nil, pkg.NewError(pkg.ClassBadRequest, "tools are not supported by ollama: %w", err)
+	}
+	return ret, nil
+}
+
+// toolCalls return the calls of assistant, ollama take the arguments as object
+func toolCalls(calls []llms.ToolCall) ([]api.ToolCall, error) {
+	var ret []api.ToolCall
+	for _, tc := range calls {
+		if tc.FunctionCall == nil {
+			continue
+		}
+		call := api.ToolCall{}
+		call.Function.Name = tc.FunctionCall.Name
+		if args := strings.TrimSpace(tc.FunctionCall.Arguments); args != "" {
+			if err := json.Unmarshal([]byte(args), &call.Function.Arguments); err != nil {
+				return nil, pkg.NewError(pkg.ClassBadRequest, "arguments of tool call '%s' is invalid: %w", tc.ID, err)
+			}
+		}
+		ret = append(ret, call)
+	}
+	return ret, nil
+}
+
+// fromToolCalls return the calls of ollama, which has no id
+func fromToolCalls(calls []api.ToolCall) []llms.ToolCall {
+	var ret []llms.ToolCall
+	for _, tc := range calls {
+		args, _ := json.Marshal(tc.Function.Arguments)
+		ret = append(ret, llms.ToolCall{
+			ID:   fmt.Sprintf("call_%s", strings.ReplaceAll(uuid.NewString(), "-", "")[:24]),
+			Type: "function",
+			FunctionCall: &llms.FunctionCall{
+				Name:      tc.Function.Name,
+				Arguments: string(args),
+			},
+		})
+	}
+	return ret
+}
+
+// Embed use the embed api, the input is sent in batches
+func (d *ollm) Embed(ctx context.Context, req *mux.EmbedRequest) (*mux.Embedding, error) {
+	if req.Model == "" {
+		req.Model = d.c.EmbedModel
+	}
+	if req.Model == "" {
+		return nil, pkg.NewError(pkg.ClassUnsupported, "embedding model is not set")
+	}
+	return mux.EmbedBatches(ctx, req, d.c.EmbedBatch, func(ctx context.Context, req *mux.EmbedRequest) (*mux.Embedding, error) {
+		resp, err := d.cli.Embed(ctx, &api.EmbedRequest{
+			Model: req.Model,
+			Input: req.Input,
+		})
+		if err != nil {
+			return nil, classify(err)
+		}
+		if len(resp.Embeddings) != len(req.Input) {
+			return nil, pkg.NewError(pkg.ClassUpstream, "ollama return %d embeddings of %d inputs", len(resp.Embeddings), len(req.Input))
+		}
+		return &mux.Embedding{
+			Vectors:      resp.Embeddings,
+			PromptTokens: resp.PromptEvalCount,
+		}, nil
+	})
+}
+
 func (d *ollm) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
-	return "", fmt.Errorf("not implement")
+	return "", pkg.UnsupportedErr
+}
+
+func classify(err error) error {
+	var se api.StatusError
+	switch {
+	case errors.As(err, &se):
+		return pkg.StatusError(se.StatusCode, "ollama failed: %w", err)
+	case errors.Is(err, context.Canceled):
+		return pkg.NewError(pkg.ClassCanceled, "ollama canceled: %w", err)
+	}
+	return pkg.NewError(pkg.ClassUpstream, "ollama failed: %w", err)
 }
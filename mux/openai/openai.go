@@ -28,10 +28,12 @@ var (
 		"accept-language": "zh-CN,zh;q=0.9,en;q=0.8,zh-Hans;q=0.7",
 		"Content-Type":    "application/json",
 	}
+
+	// ask upstream for the usage chunk
+	includeUsage = &api.V1ChatCompletionsPostRequestStreamOptions{IncludeUsage: true}
 )
 
 type Conf struct {
-	Name string `yaml:"name,omitempty"`
 	// https://api.deepseek.com + deepseek-chat
 	// https://api.siliconflow.com + Qwen/Qwen2.5-Coder-7B-Instruct
 	Baseurl string `yaml:"baseurl"`
@@ -39,6 +41,12 @@ type Conf struct {
 	Model   string `yaml:"model"`
 	Debug   bool   `yaml:"debug,omitempty"`
 	Index   int    `yaml:"index,omitempty"`
+	// embedding model and the max inputs of one request, 0 means no limit
+	EmbedModel string `yaml:"embedding_model,omitempty"`
+	EmbedBatch int    `yaml:"embedding_batch,omitempty"`
+	ImageModel string `yaml:"image_model,omitempty"`
+
+	mux.Options `yaml:",inline"`
 }
 
 func (c *Conf) valid() error {
@@ -48,14 +56,15 @@ func (c *Conf) valid() error {
 	if c.Apikey == "" {
 		return fmt.Errorf("apikey is empty")
 	}
-	if c.Model == "" {
-		return fmt.Errorf("model is empty")
+	if c.Model == "" && c.EmbedModel == "" && c.ImageModel == "" {
+		return fmt.Errorf("model, embedding_model and image_model are empty")
 	}
 	return nil
 }
 
 type Openai struct {
 	c *Conf
+	mux.Live
 
 	aa  *openai.LLM
 	cli *http.Client
@@ -74,6 +83,7 @@ func New(ctx context.Context, c *Conf) *Openai {
 		c:   c,
 		cli: util.NewDebugHTTPClient("", c.Debug),
 	}
+	slicon.Update(&c.Options, c.Index)
 	return slicon
 }
 
@@ -81,8 +91,31 @@ func (d *Openai) Name() string {
 	return d.c.Name
 }
 
-func (d *Openai) Index() int {
-	return d.c.Index
+func (d *Openai) Models() []*mux.ModelInfo {
+	var ret []*mux.ModelInfo
+	if d.c.Model != "" {
+		ret = append(ret, &mux.ModelInfo{Id: d.c.Model, OwnedBy: d.c.Name, Capabilities: []string{mux.CapChat, mux.CapCompletion, mux.CapTools}})
+	}
+	if d.c.EmbedModel != "" {
+		ret = append(ret, &mux.ModelInfo{Id: d.c.EmbedModel, OwnedBy: d.c.Name, Capabilities: []string{mux.CapEmbedding}})
+	}
+	if d.c.ImageModel != "" {
+		ret = append(ret, &mux.ModelInfo{Id: d.c.ImageModel, OwnedBy: d.c.Name, Capabilities: []string{mux.CapImage}})
+	}
+	return ret
+}
+
+// ToolCalling report the tools are forwarded, the request body is sent as is
+func (d *Openai) ToolCalling() bool {
+	return d.c.Model != ""
+}
+
+// model return the routed upstream model, or the configured one
+func (d *Openai) model(opt *llms.CallOptions) string {
+	if opt.Model != "" {
+		return opt.Model
+	}
+	return d.c.Model
 }
 
 func (d *Openai) Completion(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
@@ -101,8 +134,12 @@ func (d *Openai) Completion(ctx context.Context, prompt string, options ...llms.
 	)
 
 	pkg.Trans(req, newreq)
-	newreq.Model = d.c.Model
+	newreq.Model = d.model(opt)
+	if newreq.Model == "" {
+		return "", pkg.NewError(pkg.ClassUnsupported, "chat model is not set")
+	}
 	newreq.Stream = true
+	newreq.StreamOptions = includeUsage
 	newreq.Messages = []api.V1ChatCompletionsPostRequestMessagesInner{
 		{
 			Role:    mux.RoleUser,
@@ -113,41 +150,57 @@ func (d *Openai) Completion(ctx context.Context, prompt string, options ...llms.
 	if err != nil {
 		return "", err
 	}
-	resp, err := d.chat(d.c.Baseurl+"/v1/chat/completions", bs)
+	resp, err := d.chat(bctx, d.c.Baseurl+"/v1/chat/completions", bs)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
-	var (
-		buf      = util.GetBuf()
-		respData api.V1CompletionsPost200Response
-	)
+	buf := util.GetBuf()
 
 	defer util.PutBuf(buf)
 
-	scanner := bufio.NewScanner(resp.Body)
+	var (
+		scanner  = bufio.NewScanner(resp.Body)
+		finished bool
+	)
 	for scanner.Scan() {
 		line := scanner.Bytes()
 		if !bytes.HasPrefix(line, util.HeaderData) {
 			continue
 		}
+		if isDone(line) {
+			finished = true
+			continue
+		}
+		var respData api.V1ChatCompletionsPost200Response
 		err = json.Unmarshal(bytes.TrimPrefix(line, util.HeaderData), &respData)
 		if err != nil {
 			continue
 		}
+		reportUsage(&respData.Usage, options...)
+		// completion is sent as chat, the content is in delta
 		for _, choci := range respData.Choices {
-			if choci.Text == "" {
+			if choci.FinishReason != "" {
+				finished = true
+			}
+			if choci.Delta.Content == "" {
 				continue
 			}
 			if opt.StreamingFunc != nil {
-				err = opt.StreamingFunc(bctx, []byte(choci.Text))
+				err = opt.StreamingFunc(bctx, []byte(choci.Delta.Content))
 				if err != nil {
-					break
+					return buf.String(), err
 				}
 			}
-			buf.WriteString(choci.Text)
+			buf.WriteString(choci.Delta.Content)
 		}
 	}
+	if ctx.Err() != nil {
+		return buf.String(), io.EOF
+	}
+	if err = streamErr(scanner, finished); err != nil {
+		return "", err
+	}
 	return buf.String(), nil
 }
 
@@ -163,28 +216,55 @@ func (d *Openai) GenerateContent(ctx context.Context, messages []llms.MessageCon
 		o(opt)
 	}
 	defer cancle()
-	req := opt.Metadata[mux.ReqBody].(*api.V1ChatCompletionsPostRequest)
-	req.Model = d.c.Model
+	// copy, the request body is shared by all backends
+	req := *opt.Metadata[mux.ReqBody].(*api.V1ChatCompletionsPostRequest)
+	req.Model = d.model(opt)
+	if req.Model == "" {
+		return nil, pkg.NewError(pkg.ClassUnsupported, "chat model is not set")
+	}
 	req.Stream = true
+	req.StreamOptions = includeUsage
+	req.Messages = nil
+	for _, t := range mux.GetConversation(messages, d.Options().Language, options...).Turns {
+		msg := api.V1ChatCompletionsPostRequestMessagesInner{
+			Role:       mux.RoleName(t.Role),
+			Name:       t.Name,
+			Content:    t.Content,
+			ToolCallId: t.ToolCallId,
+		}
+		for _, tc := range t.ToolCalls {
+			call := api.V1ChatCompletionsPostRequestMessagesInnerToolCallsInner{Id: tc.ID, Type: tc.Type}
+			if tc.FunctionCall != nil {
+				call.Function.Name = tc.FunctionCall.Name
+				call.Function.Arguments = tc.FunctionCall.Arguments
+			}
+			msg.ToolCalls = append(msg.ToolCalls, call)
+		}
+		req.Messages = append(req.Messages, msg)
+	}
 
-	bs, err := json.Marshal(req)
+	bs, err := json.Marshal(&req)
 	if err != nil {
 		return nil, err
 	}
-	resp, err := d.chat(d.c.Baseurl+"/v1/chat/completions", bs)
+	resp, err := d.chat(bctx, d.c.Baseurl+"/v1/chat/completions", bs)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 	var (
-		buf      = util.GetBuf()
-		respData api.V1ChatCompletionsPost200Response
-		ret      = new(llms.ContentResponse)
+		buf   = util.GetBuf()
+		ret   = new(llms.ContentResponse)
+		calls = &toolCalls{}
 	)
 
 	defer util.PutBuf(buf)
+	defer calls.appendTo(ret)
 
-	scanner := bufio.NewScanner(resp.Body)
+	var (
+		scanner  = bufio.NewScanner(resp.Body)
+		finished bool
+	)
 	for scanner.Scan() {
 		select {
 		case <-ctx.Done():
@@ -199,22 +279,33 @@ func (d *Openai) GenerateContent(ctx context.Context, messages []llms.MessageCon
 		if !bytes.HasPrefix(line, util.HeaderData) {
 			continue
 		}
+		if isDone(line) {
+			finished = true
+			continue
+		}
+		// the delta of each chunk must not inherit the previous one
+		var respData api.V1ChatCompletionsPost200Response
 		err = json.Unmarshal(bytes.TrimPrefix(line, util.HeaderData), &respData)
 		if err != nil {
 			continue
 		}
+		reportUsage(&respData.Usage, options...)
 		for _, choci := range respData.Choices {
 			ret.Choices = append(ret.Choices, &llms.ContentChoice{
 				Content:    choci.Delta.Content,
 				StopReason: choci.FinishReason,
 			})
+			calls.add(choci.Delta.ToolCalls)
+			if choci.FinishReason != "" {
+				finished = true
+			}
 			if choci.Delta.Content == "" {
 				continue
 			}
 			if opt.StreamingFunc != nil {
 				err = opt.StreamingFunc(bctx, []byte(choci.Delta.Content))
 				if err != nil {
-					break
+					return ret, err
 				}
 			}
 			buf.WriteString(choci.Delta.Content)
@@ -224,17 +315,198 @@ func (d *Openai) GenerateContent(ctx context.Context, messages []llms.MessageCon
 	if opt.StreamingFunc != nil {
 		opt.StreamingFunc(bctx, nil)
 	}
+	if ctx.Err() != nil {
+		return ret, io.EOF
+	}
+	if err = streamErr(scanner, finished); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// isDone report whether the line is the [DONE] marker
+func isDone(line []byte) bool {
+	return bytes.Equal(bytes.TrimSpace(bytes.TrimPrefix(line, util.HeaderData)), []byte("[DONE]"))
+}
+
+// streamErr return the error of stream which is cut off,
+// a complete stream end with finish_reason or [DONE].
+func streamErr(scanner *bufio.Scanner, finished bool) error {
+	if err := scanner.Err(); err != nil {
+		return pkg.NewError(pkg.ClassUpstream, "read stream failed: %w", err)
+	}
+	if !finished {
+		return pkg.NewError(pkg.ClassUpstream, "stream closed before finish")
+	}
+	return nil
+}
+
+// toolCalls assemble the streamed tool call deltas by index,
+// the id, type and name come first and the arguments are appended.
+type toolCalls struct {
+	calls []*llms.ToolCall
+}
+
+func (t *toolCalls) add(deltas []api.V1ChatCompletionsPost200ResponseChoicesInnerDeltaToolCallsInner) {
+	for _, d := range deltas {
+		i := int(d.Index)
+		if i < 0 {
+			continue
+		}
+		for len(t.calls) <= i {
+			t.calls = append(t.calls, &llms.ToolCall{Type: "function", FunctionCall: &llms.FunctionCall{}})
+		}
+		call := t.calls[i]
+		if d.Id != "" {
+			call.ID = d.Id
+		}
+		if d.Type != "" {
+			call.Type = d.Type
+		}
+		call.FunctionCall.Name += d.Function.Name
+		call.FunctionCall.Arguments += d.Function.Arguments
+	}
+}
+
+// appendTo add the assembled calls as the last choice
+func (t *toolCalls) appendTo(ret *llms.ContentResponse) {
+	if len(t.calls) == 0 {
+		return
+	}
+	choice := &llms.ContentChoice{}
+	for _, call := range t.calls {
+		choice.ToolCalls = append(choice.ToolCalls, *call)
+	}
+	ret.Choices = append(ret.Choices, choice)
+}
+
+func reportUsage(u *api.V1ChatCompletionsPost200ResponseUsage, options ...llms.CallOption) {
+	if u.TotalTokens == 0 {
+		return
+	}
+	mux.GetUsage(options...).Set(int(u.PromptTokens), int(u.CompletionTokens))
+}
+
+// embedResp is the embeddings response of upstream
+type embedResp struct {
+	Data []struct {
+		Embedding []float32 `json:"embedding"`
+		Index     int       `json:"index"`
+	} `json:"data"`
+	Usage struct {
+		PromptTokens int `json:"prompt_tokens"`
+	} `json:"usage"`
+}
+
+// Embed use the embeddings api, the input is sent in batches
+func (d *Openai) Embed(ctx context.Context, req *mux.EmbedRequest) (*mux.Embedding, error) {
+	if req.Model == "" {
+		req.Model = d.c.EmbedModel
+	}
+	if req.Model == "" {
+		return nil, pkg.NewError(pkg.ClassUnsupported, "embedding model is not set")
+	}
+	return mux.EmbedBatches(ctx, req, d.c.EmbedBatch, func(ctx context.Context, req *mux.EmbedRequest) (*mux.Embedding, error) {
+		bs, err := json.Marshal(&api.V1EmbeddingsPostRequest{
+			Model:          req.Model,
+			Input:          req.Input,
+			EncodingFormat: "float",
+			Dimensions:     int32(req.Dimensions),
+		})
+		if err != nil {
+			return nil, err
+		}
+		resp, err := d.chat(ctx, d.c.Baseurl+"/v1/embeddings", bs)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		var data embedResp
+		if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+			return nil, pkg.NewError(pkg.ClassUpstream, "decode embeddings failed: %w", err)
+		}
+		ret := &mux.Embedding{
+			Vectors:      make([][]float32, len(req.Input)),
+			PromptTokens: data.Usage.PromptTokens,
+		}
+		for _, v := range data.Data {
+			if v.Index < 0 || v.Index >= len(ret.Vectors) {
+				return nil, pkg.NewError(pkg.ClassUpstream, "embedding index %d out of %d inputs", v.Index, len(req.Input))
+			}
+			ret.Vectors[v.Index] = v.Embedding
+		}
+		for i, v := range ret.Vectors {
+			if v == nil {
+				return nil, pkg.NewError(pkg.ClassUpstream, "embedding of input %d is missing", i)
+			}
+		}
+		return ret, nil
+	})
+}
+
+// imageResp is the images response of upstream
+type imageResp struct {
+	Data []struct {
+		Url           string `json:"url"`
+		B64           string `json:"b64_json"`
+		RevisedPrompt string `json:"revised_prompt"`
+	} `json:"data"`
+}
+
+// GenerateImage use the images api
+func (d *Openai) GenerateImage(ctx context.Context, req *mux.ImageRequest) ([]*mux.Image, error) {
+	if req.Model == "" {
+		req.Model = d.c.ImageModel
+	}
+	if req.Model == "" {
+		return nil, pkg.NewError(pkg.ClassUnsupported, "image model is not set")
+	}
+	body := &api.V1ImagesGenerationsPostRequest{
+		Prompt:  req.Prompt,
+		Model:   req.Model,
+		N:       int32(req.N),
+		Quality: req.Quality,
+		Style:   req.Style,
+		Size:    req.Size,
+	}
+	if req.B64 {
+		body.ResponseFormat = "b64_json"
+	}
+	bs, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.chat(ctx, d.c.Baseurl+"/v1/images/generations", bs)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var data imageResp
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, pkg.NewError(pkg.ClassUpstream, "decode images failed: %w", err)
+	}
+	var ret []*mux.Image
+	for _, v := range data.Data {
+		if v.Url == "" && v.B64 == "" {
+			continue
+		}
+		ret = append(ret, &mux.Image{Url: v.Url, B64: v.B64, RevisedPrompt: v.RevisedPrompt})
+	}
+	if len(ret) == 0 {
+		return nil, pkg.NewError(pkg.ClassUpstream, "no image generated")
+	}
 	return ret, nil
 }
+
 func (d *Openai) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
-	return "", fmt.Errorf("not implement")
+	return "", pkg.UnsupportedErr
 }
-func (d *Openai) chat(addr string, body []byte) (*http.Response, error) {
+func (d *Openai) chat(ctx context.Context, addr string, body []byte) (*http.Response, error) {
 	var buf = &bytes.Buffer{}
 	if body != nil {
 		buf = bytes.NewBuffer(body)
 	}
-	req, err := http.NewRequest(http.MethodPost, addr, buf)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, addr, buf)
 	if err != nil {
 		return nil, err
 	}
@@ -245,11 +517,11 @@ func (d *Openai) chat(addr string, body []byte) (*http.Response, error) {
 
 	resp, err := d.cli.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, pkg.NewError(pkg.ClassUpstream, "request '%s' failed: %w", addr, err)
 	}
 	if !util.IsHttp20xCode(resp.StatusCode) {
 		resp.Body.Close()
-		return nil, fmt.Errorf("request '%s' failed: %v, code: %d", addr, http.StatusText(resp.StatusCode), resp.StatusCode)
+		return nil, pkg.StatusError(resp.StatusCode, "request '%s' failed: %v, code: %d", addr, http.StatusText(resp.StatusCode), resp.StatusCode)
 	}
 	return resp, nil
 }
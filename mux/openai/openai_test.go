@@ -0,0 +1,158 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/tmc/langchaingo/llms"
+	api "github.com/yylt/gptmux/api/go"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/pkg"
+)
+
+func TestEmbed(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		batches [][]string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string   `json:"model"`
+			Input []string `json:"input"`
+		}
+		if r.URL.Path != "/v1/embeddings" || r.Header.Get("Authorization") != "Bearer sk-test" ||
+			json.NewDecoder(r.Body).Decode(&req) != nil || req.Model != "bge-m3" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		batches = append(batches, req.Input)
+		mu.Unlock()
+		// the data is in reverse order, placed by index
+		resp := map[string]any{"usage": map[string]int{"prompt_tokens": len(req.Input)}}
+		var data []map[string]any
+		for i := len(req.Input) - 1; i >= 0; i-- {
+			data = append(data, map[string]any{"index": i, "embedding": []float32{float32(req.Input[i][0])}})
+		}
+		resp["data"] = data
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	d := New(context.Background(), &Conf{Baseurl: srv.URL, Apikey: "sk-test", EmbedModel: "bge-m3", EmbedBatch: 2})
+	input := []string{"a", "b", "c"}
+	ret, err := d.Embed(context.Background(), &mux.EmbedRequest{Input: input})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 2 || !slices.Equal(batches[0], []string{"a", "b"}) || !slices.Equal(batches[1], []string{"c"}) {
+		t.Errorf("batches %v, want [a b] [c]", batches)
+	}
+	if ret.PromptTokens != 3 || len(ret.Vectors) != 3 {
+		t.Fatalf("%d vectors %d tokens", len(ret.Vectors), ret.PromptTokens)
+	}
+	for i, v := range ret.Vectors {
+		if v[0] != float32(input[i][0]) {
+			t.Errorf("vector %d is of '%c', want '%s'", i, rune(v[0]), input[i])
+		}
+	}
+
+	// the routed model is sent, an upstream 400 is a bad request
+	_, err = d.Embed(context.Background(), &mux.EmbedRequest{Model: "other", Input: input})
+	if pkg.Classify(err) != pkg.ClassBadRequest {
+		t.Errorf("embed with unknown model error '%v', want bad request", err)
+	}
+}
+func TestToolCalls(t *testing.T) {
+	delta := func(index int32, id, name, args string) []api.V1ChatCompletionsPost200ResponseChoicesInnerDeltaToolCallsInner {
+		d := api.V1ChatCompletionsPost200ResponseChoicesInnerDeltaToolCallsInner{Index: index, Id: id}
+		d.Function.Name = name
+		d.Function.Arguments = args
+		return []api.V1ChatCompletionsPost200ResponseChoicesInnerDeltaToolCallsInner{d}
+	}
+	calls := &toolCalls{}
+	calls.add(delta(0, "call_1", "get_weather", ""))
+	calls.add(delta(0, "", "", `{"city":`))
+	calls.add(delta(1, "call_2", "get_time", `{}`))
+	calls.add(delta(0, "", "", `"paris"}`))
+	calls.add(delta(-1, "call_x", "ignored", ""))
+
+	ret := &llms.ContentResponse{Choices: []*llms.ContentChoice{{Content: ""}}}
+	calls.appendTo(ret)
+	if len(ret.Choices) != 2 {
+		t.Fatalf("%d choices, want the calls in a new choice", len(ret.Choices))
+	}
+	got := ret.Choices[1].ToolCalls
+	if len(got) != 2 {
+		t.Fatalf("%d tool calls, want 2", len(got))
+	}
+	for i, want := range []llms.ToolCall{
+		{ID: "call_1", Type: "function", FunctionCall: &llms.FunctionCall{Name: "get_weather", Arguments: `{"city":"paris"}`}},
+		{ID: "call_2", Type: "function", FunctionCall: &llms.FunctionCall{Name: "get_time", Arguments: `{}`}},
+	} {
+		if got[i].ID != want.ID || got[i].Type != want.Type || *got[i].FunctionCall != *want.FunctionCall {
+			t.Errorf("tool call %d is %+v %+v, want %+v", i, got[i], got[i].FunctionCall, want.FunctionCall)
+		}
+	}
+
+	// no call add no choice
+	ret = &llms.ContentResponse{}
+	(&toolCalls{}).appendTo(ret)
+	if len(ret.Choices) != 0 {
+		t.Errorf("%d choices without tool calls", len(ret.Choices))
+	}
+}
+
+func TestGenerateToolCalls(t *testing.T) {
+	frames := []string{
+		`{"choices":[{"index":0,"delta":{"role":"assistant","tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"get_weather","arguments":""}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"city\":"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"paris\"}"}}]}}]}`,
+		`{"choices":[{"index":0,"delta":{},"finish_reason":"tool_calls"}]}`,
+		`{"choices":[],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`,
+	}
+	var sent api.V1ChatCompletionsPostRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, f := range frames {
+			fmt.Fprintf(w, "data: %s\n\n", f)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer srv.Close()
+
+	d := New(context.Background(), &Conf{Baseurl: srv.URL, Apikey: "sk-test", Model: "gpt-4o"})
+	body := &api.V1ChatCompletionsPostRequest{
+		Model:    "gpt-4o",
+		Messages: []api.V1ChatCompletionsPostRequestMessagesInner{{Role: "user", Content: "weather of paris"}},
+		Tools:    []api.V1ChatCompletionsPostRequestToolsInner{{Type: "function"}},
+	}
+	usage := &mux.Usage{}
+	resp, err := d.GenerateContent(context.Background(),
+		[]llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "weather of paris")},
+		llms.WithMetadata(map[string]any{mux.ReqBody: body, mux.UsageKey: usage}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tools of request body are forwarded
+	if len(sent.Tools) != 1 || !sent.Stream {
+		t.Errorf("upstream request tools %d stream %v", len(sent.Tools), sent.Stream)
+	}
+	last := resp.Choices[len(resp.Choices)-1]
+	if len(last.ToolCalls) != 1 {
+		t.Fatalf("%d tool calls, want 1", len(last.ToolCalls))
+	}
+	if call := last.ToolCalls[0]; call.ID != "call_1" || call.FunctionCall.Name != "get_weather" || call.FunctionCall.Arguments != `{"city":"paris"}` {
+		t.Errorf("tool call %+v %+v", call, call.FunctionCall)
+	}
+	if usage.PromptTokens != 10 || usage.CompletionTokens != 5 {
+		t.Errorf("usage %+v, want the upstream usage", usage)
+	}
+}
@@ -0,0 +1,186 @@
+package replay
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/pkg"
+	"github.com/yylt/gptmux/pkg/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	name = "replay"
+)
+
+// Conf of replay, records are found by the prompt.
+// sequential serve records in file order when no prompt matched,
+// speed scale the recorded chunk timings, 0 means no delay.
+type Conf struct {
+	File       string  `yaml:"file"`
+	Sequential bool    `yaml:"sequential,omitempty"`
+	Speed      float64 `yaml:"speed,omitempty"`
+	Index      int     `yaml:"index,omitempty"`
+
+	mux.Options `yaml:",inline"`
+}
+
+var (
+	_ mux.Model    = &Replay{}
+	_ mux.FimModel = &Replay{}
+)
+
+// Replay serve the exchanges recorded by gptmux
+type Replay struct {
+	c *Conf
+	mux.Live
+
+	mu      sync.Mutex
+	records []*record.Record
+	prompts map[string][]*record.Record
+	next    int
+}
+
+func New(c *Conf) *Replay {
+	if c == nil || c.File == "" {
+		klog.Warningf("replay config is invalid: %v", c)
+		return nil
+	}
+	rs, err := record.Load(c.File)
+	if err != nil {
+		klog.Errorf("replay load %s failed: %v", c.File, err)
+		return nil
+	}
+	if c.Name == "" {
+		c.Name = name
+	}
+	r := &Replay{
+		c:       c,
+		records: rs,
+		prompts: map[string][]*record.Record{},
+	}
+	r.Update(&c.Options, c.Index)
+	for _, rec := range rs {
+		r.prompts[rec.Endpoint+rec.Prompt] = append(r.prompts[rec.Endpoint+rec.Prompt], rec)
+	}
+	klog.Infof("replay %s loaded %d records", c.File, len(rs))
+	return r
+}
+
+func (r *Replay) Name() string {
+	return r.c.Name
+}
+
+// Models list the recorded models
+func (r *Replay) Models() []*mux.ModelInfo {
+	var (
+		ret  []*mux.ModelInfo
+		seen = map[string]bool{}
+	)
+	for _, rec := range r.records {
+		if seen[rec.Model] {
+			continue
+		}
+		seen[rec.Model] = true
+		ret = append(ret, &mux.ModelInfo{
+			Id:           rec.Model,
+			OwnedBy:      r.Name(),
+			Capabilities: []string{mux.CapChat, mux.CapCompletion},
+		})
+	}
+	return ret
+}
+
+func (r *Replay) Completion(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	rec, err := r.find(record.Completion, prompt)
+	if err != nil {
+		return "", err
+	}
+	return r.play(ctx, rec, options...)
+}
+
+func (r *Replay) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	opt := &llms.CallOptions{}
+	for _, o := range options {
+		o(opt)
+	}
+	// the recorded prompt is not localized
+	conv, ok := opt.Metadata[mux.ConvKey].(*mux.Conversation)
+	if !ok || conv == nil {
+		conv = mux.NewConversation(messages)
+	}
+	rec, err := r.find(record.Chat, conv.Transcript())
+	if err != nil {
+		return nil, err
+	}
+	text, err := r.play(ctx, rec, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &llms.ContentResponse{
+		Choices: []*llms.ContentChoice{
+			{Content: text, StopReason: rec.FinishReason},
+		},
+	}, nil
+}
+
+func (r *Replay) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return "", pkg.UnsupportedErr
+}
+
+// find return the record of prompt, the same prompt is served in turn
+func (r *Replay) find(endpoint, prompt string) (*record.Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rs := r.prompts[endpoint+prompt]; len(rs) > 0 {
+		rec := rs[0]
+		r.prompts[endpoint+prompt] = append(rs[1:], rec)
+		return rec, nil
+	}
+	if !r.c.Sequential || len(r.records) == 0 {
+		return nil, pkg.NewError(pkg.ClassUnavailable, "no record of prompt")
+	}
+	rec := r.records[r.next%len(r.records)]
+	r.next++
+	return rec, nil
+}
+
+// play stream the recorded chunks, a failed exchange return its last error
+func (r *Replay) play(ctx context.Context, rec *record.Record, options ...llms.CallOption) (string, error) {
+	if rec.Backend == "" {
+		if n := len(rec.Errors); n > 0 {
+			last := rec.Errors[n-1]
+			return "", pkg.NewError(last.Class, "%s: recorded %s failed: %s", r.Name(), last.Backend, last.Message)
+		}
+		return "", pkg.NewError(pkg.ClassUpstream, "%s: record %s has no answer", r.Name(), rec.Id)
+	}
+	opt := &llms.CallOptions{}
+	for _, o := range options {
+		o(opt)
+	}
+	if opt.StreamingFunc == nil {
+		return rec.Text, nil
+	}
+	chunks := rec.Chunks
+	if len(chunks) == 0 {
+		chunks = []*record.Chunk{{Text: rec.Text}}
+	}
+	var last int64
+	for _, ch := range chunks {
+		if d := time.Duration(float64(ch.Ms-last)*r.c.Speed) * time.Millisecond; d > 0 {
+			select {
+			case <-ctx.Done():
+				return "", pkg.NewError(pkg.ClassCanceled, "%s canceled: %w", r.Name(), ctx.Err())
+			case <-time.After(d):
+			}
+		}
+		last = ch.Ms
+		if err := opt.StreamingFunc(ctx, []byte(ch.Text)); err != nil {
+			return rec.Text, err
+		}
+	}
+	return rec.Text, nil
+}
@@ -0,0 +1,111 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tmc/langchaingo/llms"
+	"github.com/yylt/gptmux/mux"
+	"github.com/yylt/gptmux/pkg"
+	"github.com/yylt/gptmux/pkg/record"
+)
+
+// recorded write the exchanges as the handlers do, and return the file
+func recorded(t *testing.T, fn func(rc *record.Recorder)) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "records.jsonl")
+	rc, err := record.New(&record.Conf{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn(rc)
+	if err = rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func conversation(text string) *mux.Conversation {
+	conv := &mux.Conversation{}
+	conv.Add(llms.ChatMessageTypeHuman, "", text)
+	return conv
+}
+
+func TestReplayRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	file := recorded(t, func(rc *record.Recorder) {
+		r := rc.Start("1", record.Chat, "gpt-4o", true, conversation("hi").Transcript(), nil)
+		r.Chunk("hel")
+		r.Chunk("lo")
+		r.Done("a", "hello", "stop")
+		rc.Write(r)
+
+		r = rc.Start("2", record.Completion, "qwen", false, "def", nil)
+		r.Done("a", "def main():", "length")
+		rc.Write(r)
+
+		r = rc.Start("3", record.Chat, "gpt-4o", false, conversation("fail").Transcript(), nil)
+		r.Fail("a", pkg.NewError(pkg.ClassRateLimit, "rate limited"))
+		rc.Write(r)
+	})
+	rp := New(&Conf{File: file})
+	if rp == nil {
+		t.Fatal("replay is not created")
+	}
+	if models := rp.Models(); len(models) != 2 || models[0].Id != "gpt-4o" || models[1].Id != "qwen" {
+		t.Errorf("replay models %v", models)
+	}
+
+	// the chunks are streamed as recorded
+	var chunks []string
+	resp, err := rp.GenerateContent(ctx, conversation("hi").Messages(), llms.WithStreamingFunc(func(_ context.Context, b []byte) error {
+		chunks = append(chunks, string(b))
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(chunks, "|") != "hel|lo" || resp.Choices[0].Content != "hello" || resp.Choices[0].StopReason != "stop" {
+		t.Errorf("replay chat chunks %v answer %+v", chunks, resp.Choices[0])
+	}
+
+	text, err := rp.Completion(ctx, "def")
+	if err != nil || text != "def main():" {
+		t.Errorf("replay completion '%s', %v", text, err)
+	}
+
+	// the failed exchange return the recorded class
+	_, err = rp.GenerateContent(ctx, conversation("fail").Messages())
+	if !errors.Is(err, pkg.RateLimitErr) {
+		t.Errorf("replay failed exchange error '%v', want rate limit", err)
+	}
+	_, err = rp.GenerateContent(ctx, conversation("unknown").Messages())
+	if pkg.Classify(err) != pkg.ClassUnavailable {
+		t.Errorf("replay unknown prompt error '%v', want unavailable", err)
+	}
+}
+
+func TestReplaySequential(t *testing.T) {
+	file := recorded(t, func(rc *record.Recorder) {
+		for _, text := range []string{"one", "two"} {
+			r := rc.Start(text, record.Chat, "gpt-4o", false, text, nil)
+			r.Done("a", text, "stop")
+			rc.Write(r)
+		}
+	})
+	rp := New(&Conf{File: file, Sequential: true})
+	var got []string
+	for i := 0; i < 3; i++ {
+		resp, err := rp.GenerateContent(context.Background(), conversation("anything").Messages())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, resp.Choices[0].Content)
+	}
+	if strings.Join(got, ",") != "one,two,one" {
+		t.Errorf("sequential replay %v, want one, two, one", got)
+	}
+}
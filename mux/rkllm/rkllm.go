@@ -3,6 +3,8 @@ package rkllm
 import (
 	"context"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"sync"
 	"unsafe"
 
@@ -17,10 +19,16 @@ type Conf struct {
 	Lib       string `yaml:"lib"`
 	ModelPath string `yaml:"model_path"`
 	Index     int    `yaml:"index,omitempty"`
+
+	mux.Options `yaml:",inline"`
 }
 type rkllm struct {
-	c  *Conf
+	c *Conf
+	mux.Live
+
 	mu sync.Mutex
+	// destroyed, protected by mu
+	closed bool
 }
 
 type token struct {
@@ -72,6 +80,9 @@ func New(c *Conf) *rkllm {
 		klog.Warningf("rkllm config is invalid: %v", c)
 		return nil
 	}
+	if c.Name == "" {
+		c.Name = "rkllm"
+	}
 	libc, err := purego.Dlopen(c.Lib, purego.RTLD_DEFAULT|purego.RTLD_NOW|purego.RTLD_GLOBAL)
 	if err != nil {
 		panic(err)
@@ -106,15 +117,20 @@ func New(c *Conf) *rkllm {
 	}
 	klog.Infof("rkllm init success")
 
-	return &rkllm{c: c}
+	d := &rkllm{c: c}
+	d.Update(&c.Options, c.Index)
+	return d
 }
 
 func (d *rkllm) Name() string {
-	return "rkllm"
+	return d.c.Name
 }
 
-func (d *rkllm) Index() int {
-	return d.c.Index
+func (d *rkllm) Models() []*mux.ModelInfo {
+	id := strings.TrimSuffix(filepath.Base(d.c.ModelPath), filepath.Ext(d.c.ModelPath))
+	return []*mux.ModelInfo{
+		{Id: id, OwnedBy: d.Name(), Capabilities: []string{mux.CapChat}},
+	}
 }
 
 func (d *rkllm) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
@@ -122,14 +138,17 @@ func (d *rkllm) GenerateContent(ctx context.Context, messages []llms.MessageCont
 		return nil, pkg.BusyErr
 	}
 	defer d.mu.Unlock()
-	prompt, model := mux.GeneraPrompt(messages)
+	if d.closed {
+		return nil, pkg.UnavailableErr
+	}
+	prompt, model := mux.GeneraPrompt(mux.GetConversation(messages, d.Options().Language, options...))
 
 	if model != mux.TxtModel {
-		return nil, fmt.Errorf("not support model '%s'", model)
+		return nil, pkg.NewError(pkg.ClassUnsupported, "not support model '%s'", model)
 	}
 	ret := rkllm_run(voidfn, prompt, unsafe.Pointer(nil))
 	if ret != 0 {
-		return nil, fmt.Errorf("run failed, exit code: %v", ret)
+		return nil, pkg.NewError(pkg.ClassUpstream, "run failed, exit code: %v", ret)
 	}
 
 	var (
@@ -147,7 +166,7 @@ func (d *rkllm) GenerateContent(ctx context.Context, messages []llms.MessageCont
 
 	for v := range tokench {
 		if v.err != nil {
-			return nil, fmt.Errorf("run failed: %v", v.err)
+			return nil, pkg.NewError(pkg.ClassUpstream, "run failed: %v", v.err)
 		}
 		data.Choices = append(data.Choices, &llms.ContentChoice{
 			Content: v.content,
@@ -167,7 +186,25 @@ func (d *rkllm) GenerateContent(ctx context.Context, messages []llms.MessageCont
 }
 
 func (d *rkllm) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
-	return "", fmt.Errorf("not implement")
+	return "", pkg.UnsupportedErr
+}
+
+// Close abort the running generation and destroy the model
+func (d *rkllm) Close() error {
+	if !d.mu.TryLock() {
+		rkllm_abort(voidfn)
+		d.mu.Lock()
+	}
+	defer d.mu.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	ret := rkllm_destroy(voidfn)
+	if ret != 0 {
+		return fmt.Errorf("rkllm destroy failed, exit code: %v", ret)
+	}
+	return nil
 }
 
 func callback(r *result, a uintptr, state int) {
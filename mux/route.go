@@ -0,0 +1,302 @@
+package mux
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Route maps a public model name (or a glob pattern such as "glm-*")
+// to an ordered list of backends.
+type Route struct {
+	Model    string    `yaml:"model"`
+	Backends []*Target `yaml:"backends"`
+}
+
+// Target is one backend of a route, model is the upstream model name
+// sent to the backend, empty means the backend default.
+type Target struct {
+	Name  string `yaml:"name"`
+	Model string `yaml:"model,omitempty"`
+}
+
+// IsPattern report whether the route model is a glob pattern
+func (rt *Route) IsPattern() bool {
+	return strings.ContainsAny(rt.Model, "*?[\\")
+}
+
+// Candidate is a backend chosen for a request, with the rewritten model name.
+type Candidate struct {
+	Model
+
+	Upstream string
+	Health   *Health
+}
+
+// FirstToken return the first token timeout of backend, zero means no limit
+func (c *Candidate) FirstToken() time.Duration {
+	if cm, ok := c.Model.(Configurable); ok && cm.Options() != nil {
+		return cm.Options().FirstToken
+	}
+	return 0
+}
+
+// Setting overwrite a backend at runtime, nil index keep the configured one
+type Setting struct {
+	Disabled bool `json:"disabled"`
+	Index    *int `json:"index,omitempty"`
+}
+
+func (s *Setting) String() string {
+	if s.Index == nil {
+		return fmt.Sprintf("disabled: %v", s.Disabled)
+	}
+	return fmt.Sprintf("disabled: %v, index: %d", s.Disabled, *s.Index)
+}
+
+type Router struct {
+	routes []*Route
+
+	// sorted by index
+	models []Model
+
+	health map[Model]*Health
+
+	// runtime settings by backend name
+	settings map[string]*Setting
+}
+
+func NewRouter(routes []*Route, ms ...Model) *Router {
+	r := &Router{
+		models: append([]Model(nil), ms...),
+		health: map[Model]*Health{},
+	}
+	for _, m := range ms {
+		var bc *BreakerConf
+		if cm, ok := m.(Configurable); ok {
+			bc = cm.Options().Breaker
+		}
+		r.health[m] = NewHealth(bc)
+		if am, ok := m.(Authenticator); ok {
+			r.health[m].credential = am.Credential
+		}
+	}
+	r.sort()
+	for _, rt := range routes {
+		if rt == nil || rt.Model == "" || len(rt.Backends) == 0 {
+			klog.Warningf("route %v is invalid, skip", rt)
+			continue
+		}
+		if _, err := path.Match(rt.Model, ""); err != nil {
+			klog.Warningf("route '%s' pattern is invalid: %v", rt.Model, err)
+			continue
+		}
+		for _, t := range rt.Backends {
+			if r.lookup(t.Name) == nil {
+				klog.Warningf("route '%s' backend '%s' not found", rt.Model, t.Name)
+			}
+		}
+		r.routes = append(r.routes, rt)
+	}
+	return r
+}
+
+// With return a router of the same backends and circuits, the settings are applied
+func (r *Router) With(settings map[string]*Setting) *Router {
+	nr := &Router{
+		routes:   r.routes,
+		models:   append([]Model(nil), r.models...),
+		health:   r.health,
+		settings: settings,
+	}
+	nr.sort()
+	return nr
+}
+
+// Inherit keep the circuits of the same backends in old,
+// and the settings of the backend names still present.
+func (r *Router) Inherit(old *Router) *Router {
+	if old == nil {
+		return r
+	}
+	for _, m := range r.models {
+		if h, ok := old.health[m]; ok {
+			// the breaker settings of kept backend may be changed
+			if cm, ok := m.(Configurable); ok {
+				h.configure(cm.Options().Breaker)
+			}
+			r.health[m] = h
+		}
+	}
+	settings := map[string]*Setting{}
+	for name, s := range old.Settings() {
+		if r.lookup(name) != nil {
+			settings[name] = s
+		}
+	}
+	r.settings = settings
+	r.sort()
+	return r
+}
+
+func (r *Router) sort() {
+	sort.SliceStable(r.models, func(i, j int) bool {
+		return r.Index(r.models[i]) > r.Index(r.models[j])
+	})
+}
+
+// Models return all backends, sorted by index
+func (r *Router) Models() []Model {
+	return r.models
+}
+
+// Settings return a copy of the runtime settings
+func (r *Router) Settings() map[string]*Setting {
+	ret := map[string]*Setting{}
+	for k, v := range r.settings {
+		s := *v
+		ret[k] = &s
+	}
+	return ret
+}
+
+// Index return the index of backend, the setting win
+func (r *Router) Index(m Model) int {
+	if s := r.settings[m.Name()]; s != nil && s.Index != nil {
+		return *s.Index
+	}
+	return m.Index()
+}
+
+// Disabled report whether backend is disabled at runtime
+func (r *Router) Disabled(m Model) bool {
+	s := r.settings[m.Name()]
+	return s != nil && s.Disabled
+}
+
+// Lookup return the backend of name, nil when not found
+func (r *Router) Lookup(name string) Model {
+	return r.lookup(name)
+}
+
+// Health return the circuit of backend
+func (r *Router) Health(m Model) *Health {
+	return r.health[m]
+}
+
+// Routes return the valid routes
+func (r *Router) Routes() []*Route {
+	return r.routes
+}
+
+// Routable report whether backend is used by any route, all are without routes.
+// disabled backends are not routable.
+func (r *Router) Routable(m Model) bool {
+	if r.Disabled(m) {
+		return false
+	}
+	if len(r.routes) == 0 {
+		return true
+	}
+	for _, rt := range r.routes {
+		for _, t := range rt.Backends {
+			if t.Name == m.Name() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Routed report whether any route is configured
+func (r *Router) Routed() bool {
+	return len(r.routes) > 0
+}
+
+// Match return the backends for model in order, exact names win over patterns.
+// the backends of route are in the route order, until an index is set at runtime.
+// without any route, the backends which advertise the model are returned by index,
+// a catch-all route "*" is needed to send any model. disabled backends are skipped,
+// so the backends can be empty when the model is found.
+func (r *Router) Match(model string) ([]*Candidate, bool) {
+	if len(r.routes) == 0 {
+		var (
+			ret   []*Candidate
+			found bool
+		)
+		for _, m := range r.models {
+			if !advertised(m, model) {
+				continue
+			}
+			found = true
+			if r.Disabled(m) {
+				continue
+			}
+			ret = append(ret, &Candidate{Model: m, Health: r.health[m]})
+		}
+		return ret, found
+	}
+	rt := r.route(model)
+	if rt == nil {
+		return nil, false
+	}
+	var ret []*Candidate
+	for _, t := range rt.Backends {
+		m := r.lookup(t.Name)
+		if m == nil || r.Disabled(m) {
+			continue
+		}
+		ret = append(ret, &Candidate{Model: m, Upstream: t.Model, Health: r.health[m]})
+	}
+	// the index patched at runtime reorder the backends of route
+	if slices.ContainsFunc(ret, r.reindexed) {
+		sort.SliceStable(ret, func(i, j int) bool {
+			return r.Index(ret[i]) > r.Index(ret[j])
+		})
+	}
+	return ret, true
+}
+
+// reindexed report whether the index of backend is set at runtime
+func (r *Router) reindexed(c *Candidate) bool {
+	s := r.settings[c.Name()]
+	return s != nil && s.Index != nil
+}
+
+// advertised report whether backend list the model
+func advertised(m Model, model string) bool {
+	for _, info := range Infos(m) {
+		if info.Id == model {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Router) route(model string) *Route {
+	for _, rt := range r.routes {
+		if rt.Model == model {
+			return rt
+		}
+	}
+	for _, rt := range r.routes {
+		if ok, _ := path.Match(rt.Model, model); ok {
+			return rt
+		}
+	}
+	return nil
+}
+
+func (r *Router) lookup(name string) Model {
+	for _, m := range r.models {
+		if m.Name() == name {
+			return m
+		}
+	}
+	return nil
+}
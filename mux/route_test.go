@@ -0,0 +1,93 @@
+package mux
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// backend of router tests, it advertise the models
+type backend struct {
+	name   string
+	index  int
+	models []string
+}
+
+func (b *backend) Name() string { return b.name }
+func (b *backend) Index() int   { return b.index }
+
+func (b *backend) Models() []*ModelInfo {
+	var ret []*ModelInfo
+	for _, id := range b.models {
+		ret = append(ret, &ModelInfo{Id: id, OwnedBy: b.name, Capabilities: []string{CapChat}})
+	}
+	return ret
+}
+
+func (b *backend) GenerateContent(context.Context, []llms.MessageContent, ...llms.CallOption) (*llms.ContentResponse, error) {
+	return nil, nil
+}
+
+func (b *backend) Call(context.Context, string, ...llms.CallOption) (string, error) {
+	return "", nil
+}
+
+func names(cands []*Candidate) []string {
+	var ret []string
+	for _, c := range cands {
+		ret = append(ret, c.Name()+":"+c.Upstream)
+	}
+	return ret
+}
+
+func TestRouterMatch(t *testing.T) {
+	var (
+		a = &backend{name: "a", index: 1, models: []string{"gpt-4o"}}
+		b = &backend{name: "b", index: 3, models: []string{"gpt-4o", "glm-4"}}
+		c = &backend{name: "c", index: 2, models: []string{"qwen"}}
+
+		routes = []*Route{
+			{Model: "glm-*", Backends: []*Target{{Name: "b"}}},
+			{Model: "glm-4", Backends: []*Target{{Name: "c", Model: "glm-4-plus"}, {Name: "b"}}},
+			{Model: "deepseek-chat", Backends: []*Target{{Name: "a"}, {Name: "missing"}}},
+		}
+		disabled = map[string]*Setting{"b": {Disabled: true}}
+		one      = 1
+		reindex  = map[string]*Setting{"c": {Index: &one}}
+	)
+	tests := []struct {
+		name     string
+		routes   []*Route
+		settings map[string]*Setting
+		model    string
+		want     []string
+		found    bool
+	}{
+		{name: "advertised by index", model: "gpt-4o", want: []string{"b:", "a:"}, found: true},
+		{name: "advertised by one", model: "qwen", want: []string{"c:"}, found: true},
+		{name: "unknown without routes", model: "claude-3"},
+		{name: "disabled without routes", settings: disabled, model: "glm-4", found: true},
+		{name: "exact beat pattern", routes: routes, model: "glm-4", want: []string{"c:glm-4-plus", "b:"}, found: true},
+		{name: "glob", routes: routes, model: "glm-4-flash", want: []string{"b:"}, found: true},
+		{name: "missing backend skipped", routes: routes, model: "deepseek-chat", want: []string{"a:"}, found: true},
+		{name: "disabled backend skipped", routes: routes, settings: disabled, model: "glm-4", want: []string{"c:glm-4-plus"}, found: true},
+		{name: "disabled all", routes: routes, settings: disabled, model: "glm-4-flash", found: true},
+		{name: "runtime index reorder route", routes: routes, settings: reindex, model: "glm-4", want: []string{"b:", "c:glm-4-plus"}, found: true},
+		// the advertised models are not routed when routes are configured
+		{name: "unknown with routes", routes: routes, model: "gpt-4o"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(tt.routes, a, b, c).With(tt.settings)
+			cands, found := r.Match(tt.model)
+			if found != tt.found {
+				t.Errorf("match '%s' found %v, want %v", tt.model, found, tt.found)
+			}
+			if got := names(cands); !slices.Equal(got, tt.want) {
+				t.Errorf("match '%s' got %v, want %v", tt.model, got, tt.want)
+			}
+		})
+	}
+}
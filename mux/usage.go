@@ -0,0 +1,39 @@
+package mux
+
+import (
+	"github.com/tmc/langchaingo/llms"
+)
+
+const (
+	// metadata key of *Usage, backends fill it with the upstream counts
+	UsageKey = "usage"
+)
+
+// Usage is the token count reported by upstream
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// GetUsage return the usage in metadata, or nil
+func GetUsage(options ...llms.CallOption) *Usage {
+	opt := &llms.CallOptions{}
+	for _, o := range options {
+		o(opt)
+	}
+	u, _ := opt.Metadata[UsageKey].(*Usage)
+	return u
+}
+
+// Set record the counts, zero keep the old value
+func (u *Usage) Set(prompt, completion int) {
+	if u == nil {
+		return
+	}
+	if prompt > 0 {
+		u.PromptTokens = prompt
+	}
+	if completion > 0 {
+		u.CompletionTokens = completion
+	}
+}
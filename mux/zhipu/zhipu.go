@@ -5,7 +5,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
 	"sync"
 
 	"github.com/swxctx/goai/zhipu"
@@ -16,14 +15,23 @@ import (
 	"k8s.io/klog/v2"
 )
 
+const (
+	defaultModel = "glm-4-flash"
+)
+
 type Conf struct {
 	ApiKey string `yaml:"apikey"`
+	Model  string `yaml:"model,omitempty"`
 	Debug  bool   `yaml:"debug,omitempty"`
 	Index  int    `yaml:"index,omitempty"`
+
+	mux.Options `yaml:",inline"`
 }
 
 type Zp struct {
-	c  *Conf
+	c *Conf
+	mux.Live
+
 	mu sync.RWMutex
 }
 
@@ -37,20 +45,39 @@ func New(c *Conf) *Zp {
 		klog.Infof("zhipu login failed: %s", err)
 		return nil
 	}
-	return &Zp{
+	if c.Name == "" {
+		c.Name = "zhipu"
+	}
+	d := &Zp{
 		c: c,
 	}
+	d.Update(&c.Options, c.Index)
+	return d
 }
 
 func (d *Zp) Name() string {
-	return "zhipu"
+	return d.c.Name
 }
 
-func (d *Zp) Index() int {
-	return d.c.Index
-}
 func (d *Zp) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
-	return "", fmt.Errorf("not implement")
+	return "", pkg.UnsupportedErr
+}
+
+func (d *Zp) Models() []*mux.ModelInfo {
+	return []*mux.ModelInfo{
+		{Id: d.model(&llms.CallOptions{}), OwnedBy: d.Name(), Capabilities: []string{mux.CapChat}},
+	}
+}
+
+// model return the routed upstream model, or the configured one
+func (d *Zp) model(opt *llms.CallOptions) string {
+	if opt.Model != "" {
+		return opt.Model
+	}
+	if d.c.Model != "" {
+		return d.c.Model
+	}
+	return defaultModel
 }
 
 func (d *Zp) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
@@ -58,32 +85,39 @@ func (d *Zp) GenerateContent(ctx context.Context, messages []llms.MessageContent
 		return nil, pkg.BusyErr
 	}
 	defer d.mu.Unlock()
-	prompt, model := mux.GeneraPrompt(messages)
+	conv := mux.GetConversation(messages, d.Options().Language, options...)
 
-	if model != mux.TxtModel {
-		return nil, fmt.Errorf("not support model '%s'", model)
+	if model := conv.Mode(); model != mux.TxtModel {
+		return nil, pkg.NewError(pkg.ClassUnsupported, "not support model '%s'", model)
+	}
+	var (
+		opt  = &llms.CallOptions{}
+		msgs []zhipu.MessageInfo
+	)
+	for _, o := range options {
+		o(opt)
+	}
+	for _, t := range conv.Turns {
+		msgs = append(msgs, zhipu.MessageInfo{
+			Role:    mux.RoleName(t.Role),
+			Content: t.Content,
+		})
 	}
 	read, err := zhipu.ChatStream(&zhipu.ChatRequest{
-		Model: "glm-4-flash",
-		Messages: []zhipu.MessageInfo{
-			{Role: "user", Content: prompt},
-		},
+		Model:    d.model(opt),
+		Messages: msgs,
 	})
 	if err != nil {
-		return nil, err
+		return nil, pkg.NewError(pkg.ClassUpstream, "zhipu chat failed: %w", err)
 	}
 
 	var (
 		respData     = &pkg.ChatResp{}
-		opt          = &llms.CallOptions{}
 		bctx, cancle = context.WithCancel(ctx)
 		data         = &llms.ContentResponse{}
 		ret          = &pkg.BackResp{}
 		body         = read.Response().Body
 	)
-	for _, o := range options {
-		o(opt)
-	}
 	defer cancle()
 
 	defer body.Close()
@@ -102,14 +136,17 @@ func (d *Zp) GenerateContent(ctx context.Context, messages []llms.MessageContent
 			klog.Infof("data: %s", string(bytes.TrimPrefix(line, util.HeaderData)))
 		}
 		ret.Content = ""
-		ret.Err = err
+		ret.Done = false
+		if respData.Usage != nil {
+			mux.GetUsage(options...).Set(respData.Usage.PromptTokens, respData.Usage.CompletionTokens)
+		}
 
 		for _, choci := range respData.Choices {
 			if choci == nil {
 				continue
 			}
 			if choci.Finish != "" {
-				ret.Err = fmt.Errorf("")
+				ret.Done = true
 			}
 			if choci.Delta == nil {
 				continue
@@ -120,7 +157,7 @@ func (d *Zp) GenerateContent(ctx context.Context, messages []llms.MessageContent
 		data.Choices = append(data.Choices, &llms.ContentChoice{
 			Content: ret.Content,
 		})
-		if ret.Err != nil {
+		if ret.Done {
 			data.Choices = append(data.Choices, &llms.ContentChoice{
 				StopReason: "stop",
 			})
@@ -128,7 +165,7 @@ func (d *Zp) GenerateContent(ctx context.Context, messages []llms.MessageContent
 		}
 		if opt.StreamingFunc != nil {
 			err = opt.StreamingFunc(bctx, []byte(ret.Content))
-			if err != nil || ret.Err != nil {
+			if err != nil || ret.Done {
 				break
 			}
 		}
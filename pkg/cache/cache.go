@@ -0,0 +1,239 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	defaultSize  = 1000
+	defaultTTL   = time.Hour
+	defaultFlush = time.Minute
+)
+
+// Conf of response cache, answers are kept in memory up to size entries,
+// and saved to file every flush when file is set.
+// requests with temperature above max_temperature are not cached.
+type Conf struct {
+	Size           int           `yaml:"size,omitempty"`
+	TTL            time.Duration `yaml:"ttl,omitempty"`
+	MaxTemperature float64       `yaml:"max_temperature,omitempty"`
+	File           string        `yaml:"file,omitempty"`
+	Flush          time.Duration `yaml:"flush,omitempty"`
+}
+
+// Entry is a cached answer, chunks are the streamed contents to replay
+type Entry struct {
+	Key              string    `json:"key"`
+	Time             time.Time `json:"time"`
+	Backend          string    `json:"backend"`
+	Text             string    `json:"text"`
+	Chunks           []string  `json:"chunks,omitempty"`
+	FinishReason     string    `json:"finish_reason"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+}
+
+// Cache is a lru of answers with ttl
+type Cache struct {
+	mu sync.Mutex
+	// serialize the writes of file
+	smu sync.Mutex
+
+	c     *Conf
+	ll    *list.List
+	items map[string]*list.Element
+	dirty bool
+}
+
+// New return nil when cache is not configured
+func New(ctx context.Context, c *Conf) *Cache {
+	if c == nil {
+		return nil
+	}
+	if c.Size <= 0 {
+		c.Size = defaultSize
+	}
+	if c.TTL <= 0 {
+		c.TTL = defaultTTL
+	}
+	if c.Flush <= 0 {
+		c.Flush = defaultFlush
+	}
+	ca := &Cache{
+		c:     c,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+	if c.File != "" {
+		if err := ca.load(); err != nil {
+			klog.Warningf("load cache %s failed: %v", c.File, err)
+		}
+		go ca.run(ctx)
+	}
+	klog.Infof("response cache enabled, size %d, ttl %s", c.Size, c.TTL)
+	return ca
+}
+
+// Key return the digest of v, v must be json encodable
+func Key(v any) string {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:])
+}
+
+// Allow report whether the request of temperature can be cached
+func (ca *Cache) Allow(temperature float64) bool {
+	return ca != nil && temperature <= ca.c.MaxTemperature
+}
+
+// Get return the entry of key, the expired one is removed
+func (ca *Cache) Get(key string) (*Entry, bool) {
+	if ca == nil || key == "" {
+		return nil, false
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	el, ok := ca.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*Entry)
+	if time.Since(e.Time) > ca.c.TTL {
+		ca.remove(el)
+		return nil, false
+	}
+	ca.ll.MoveToFront(el)
+	return e, true
+}
+
+// Put add or replace the entry, the least used ones are evicted over size
+func (ca *Cache) Put(e *Entry) {
+	if ca == nil || e == nil || e.Key == "" {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.put(e)
+}
+
+// Len return the number of entries
+func (ca *Cache) Len() int {
+	if ca == nil {
+		return 0
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.ll.Len()
+}
+
+// Close save the entries to file
+func (ca *Cache) Close() {
+	if ca == nil || ca.c.File == "" {
+		return
+	}
+	ca.save()
+}
+
+func (ca *Cache) put(e *Entry) {
+	if el, ok := ca.items[e.Key]; ok {
+		el.Value = e
+		ca.ll.MoveToFront(el)
+	} else {
+		ca.items[e.Key] = ca.ll.PushFront(e)
+	}
+	for ca.ll.Len() > ca.c.Size {
+		ca.remove(ca.ll.Back())
+	}
+	ca.dirty = true
+}
+
+func (ca *Cache) remove(el *list.Element) {
+	ca.ll.Remove(el)
+	delete(ca.items, el.Value.(*Entry).Key)
+	ca.dirty = true
+}
+
+func (ca *Cache) run(ctx context.Context) {
+	tk := time.NewTicker(ca.c.Flush)
+	defer tk.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			ca.save()
+			return
+		case <-tk.C:
+			ca.save()
+		}
+	}
+}
+
+// load read the entries saved in recent order, the expired are dropped
+func (ca *Cache) load() error {
+	bs, err := os.ReadFile(ca.c.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var es []*Entry
+	if err = json.Unmarshal(bs, &es); err != nil {
+		return err
+	}
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	for i := len(es) - 1; i >= 0; i-- {
+		if es[i] == nil || time.Since(es[i].Time) > ca.c.TTL {
+			continue
+		}
+		ca.put(es[i])
+	}
+	ca.dirty = false
+	return nil
+}
+
+// save write the unexpired entries to a temp file and rename it
+func (ca *Cache) save() {
+	ca.smu.Lock()
+	defer ca.smu.Unlock()
+	ca.mu.Lock()
+	if !ca.dirty {
+		ca.mu.Unlock()
+		return
+	}
+	var es []*Entry
+	for el := ca.ll.Front(); el != nil; el = el.Next() {
+		if e := el.Value.(*Entry); time.Since(e.Time) <= ca.c.TTL {
+			es = append(es, e)
+		}
+	}
+	bs, err := json.Marshal(es)
+	ca.dirty = false
+	ca.mu.Unlock()
+	if err != nil {
+		klog.Errorf("marshal cache failed: %v", err)
+		return
+	}
+	tmp := ca.c.File + ".tmp"
+	if err = os.WriteFile(tmp, bs, 0600); err == nil {
+		err = os.Rename(tmp, ca.c.File)
+	}
+	if err != nil {
+		klog.Errorf("save cache failed: %v", err)
+	}
+}
@@ -1,8 +1,130 @@
 package pkg
 
-import "errors"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Class is the kind of a backend error, it decide failover and http status
+type Class string
+
+const (
+	ClassAuth        Class = "authentication_error"
+	ClassQuota       Class = "insufficient_quota"
+	ClassRateLimit   Class = "rate_limit_exceeded"
+	ClassBusy        Class = "backend_busy"
+	ClassUnavailable Class = "backend_unavailable"
+	ClassUnsupported Class = "unsupported_mode"
+	ClassUpstream    Class = "upstream_error"
+	ClassBadRequest  Class = "invalid_request_error"
+	ClassCanceled    Class = "request_canceled"
+)
+
+// Error is a classified error
+type Error struct {
+	Class Class
+	Err   error
+}
 
 var (
 	NotFoundErr = errors.New("not found")
-	BusyErr     = errors.New("busy now")
+
+	BusyErr        = &Error{Class: ClassBusy, Err: errors.New("busy now")}
+	AuthErr        = &Error{Class: ClassAuth, Err: errors.New("unauthorized")}
+	QuotaErr       = &Error{Class: ClassQuota, Err: errors.New("quota exhausted")}
+	RateLimitErr   = &Error{Class: ClassRateLimit, Err: errors.New("rate limited")}
+	UnavailableErr = &Error{Class: ClassUnavailable, Err: errors.New("unavailable")}
+	UnsupportedErr = &Error{Class: ClassUnsupported, Err: errors.New("not support")}
+	UpstreamErr    = &Error{Class: ClassUpstream, Err: errors.New("upstream failed")}
+	BadRequestErr  = &Error{Class: ClassBadRequest, Err: errors.New("bad request")}
+	CanceledErr    = &Error{Class: ClassCanceled, Err: errors.New("canceled")}
 )
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return string(e.Class)
+	}
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is match any error of the same class
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Class == e.Class
+}
+
+// NewError return an error of class
+func NewError(class Class, format string, a ...any) error {
+	return &Error{
+		Class: class,
+		Err:   fmt.Errorf(format, a...),
+	}
+}
+
+// StatusError classify an upstream http status code.
+// only the request itself is a bad request, other 4xx such as 404 of
+// a missing model or 403 of a blocked region fail over as upstream errors.
+func StatusError(code int, format string, a ...any) error {
+	var class Class
+	switch code {
+	case http.StatusUnauthorized:
+		class = ClassAuth
+	case http.StatusPaymentRequired:
+		class = ClassQuota
+	case http.StatusTooManyRequests:
+		class = ClassRateLimit
+	case http.StatusServiceUnavailable:
+		class = ClassBusy
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		class = ClassBadRequest
+	default:
+		class = ClassUpstream
+	}
+	return NewError(class, format, a...)
+}
+
+// Classify return the class of err, unknown errors are upstream errors.
+// a canceled context is canceled, even wrapped as an upstream error by backend.
+func Classify(err error) Class {
+	var e *Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, context.Canceled):
+		return ClassCanceled
+	case errors.As(err, &e):
+		return e.Class
+	}
+	return ClassUpstream
+}
+
+// Failover report whether the next backend should be tried
+func (c Class) Failover() bool {
+	switch c {
+	case ClassBadRequest, ClassCanceled:
+		return false
+	}
+	return true
+}
+
+// Status return the http status code for client
+func (c Class) Status() int {
+	switch c {
+	case ClassQuota, ClassRateLimit:
+		return http.StatusTooManyRequests
+	case ClassBusy, ClassUnavailable:
+		return http.StatusServiceUnavailable
+	case ClassUnsupported, ClassBadRequest:
+		return http.StatusBadRequest
+	case ClassCanceled:
+		return 499
+	}
+	// upstream and upstream credential failure
+	return http.StatusBadGateway
+}
@@ -0,0 +1,100 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want Class
+	}{
+		{name: "nil", want: ""},
+		{name: "unknown", err: errors.New("connection reset"), want: ClassUpstream},
+		{name: "class", err: BusyErr, want: ClassBusy},
+		{name: "wrapped class", err: fmt.Errorf("login: %w", AuthErr), want: ClassAuth},
+		{name: "new error", err: NewError(ClassQuota, "no credit"), want: ClassQuota},
+		{name: "canceled context", err: context.Canceled, want: ClassCanceled},
+		{name: "canceled as upstream", err: NewError(ClassUpstream, "read: %w", context.Canceled), want: ClassCanceled},
+		{name: "deadline", err: context.DeadlineExceeded, want: ClassUpstream},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Classify(tt.err); got != tt.want {
+				t.Errorf("classify '%v' is '%s', want '%s'", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	err := NewError(ClassAuth, "token expired")
+	if !errors.Is(err, AuthErr) {
+		t.Error("auth error is not AuthErr")
+	}
+	if errors.Is(err, QuotaErr) {
+		t.Error("auth error is QuotaErr")
+	}
+	if !errors.Is(fmt.Errorf("retry: %w", err), AuthErr) {
+		t.Error("wrapped auth error is not AuthErr")
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		code int
+		want Class
+	}{
+		{http.StatusUnauthorized, ClassAuth},
+		{http.StatusPaymentRequired, ClassQuota},
+		{http.StatusTooManyRequests, ClassRateLimit},
+		{http.StatusServiceUnavailable, ClassBusy},
+		{http.StatusBadRequest, ClassBadRequest},
+		{http.StatusRequestEntityTooLarge, ClassBadRequest},
+		{http.StatusUnprocessableEntity, ClassBadRequest},
+		// a missing model or a blocked region fail over
+		{http.StatusNotFound, ClassUpstream},
+		{http.StatusForbidden, ClassUpstream},
+		{http.StatusInternalServerError, ClassUpstream},
+	}
+	for _, tt := range tests {
+		err := StatusError(tt.code, "status %d", tt.code)
+		if got := Classify(err); got != tt.want {
+			t.Errorf("status %d is '%s', want '%s'", tt.code, got, tt.want)
+		}
+		if err.Error() != fmt.Sprintf("status %d", tt.code) {
+			t.Errorf("status %d message '%s'", tt.code, err)
+		}
+	}
+}
+
+func TestClassStatus(t *testing.T) {
+	tests := []struct {
+		class    Class
+		status   int
+		failover bool
+	}{
+		{ClassAuth, http.StatusBadGateway, true},
+		{ClassQuota, http.StatusTooManyRequests, true},
+		{ClassRateLimit, http.StatusTooManyRequests, true},
+		{ClassBusy, http.StatusServiceUnavailable, true},
+		{ClassUnavailable, http.StatusServiceUnavailable, true},
+		{ClassUnsupported, http.StatusBadRequest, true},
+		{ClassUpstream, http.StatusBadGateway, true},
+		{ClassBadRequest, http.StatusBadRequest, false},
+		{ClassCanceled, 499, false},
+	}
+	for _, tt := range tests {
+		if got := tt.class.Status(); got != tt.status {
+			t.Errorf("class '%s' status %d, want %d", tt.class, got, tt.status)
+		}
+		if got := tt.class.Failover(); got != tt.failover {
+			t.Errorf("class '%s' failover %v, want %v", tt.class, got, tt.failover)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 // backend response
 type BackResp struct {
 	Err     error
+	Done    bool
 	Content string
 	Cookie  map[string]string
 }
@@ -33,6 +34,13 @@ type ChatResp struct {
 	Object  string    `json:"object,omitempty"`
 	Model   string    `json:"model,omitempty"`
 	Choices []*Choice `json:"choices,omitempty"`
+	Usage   *Usage    `json:"usage,omitempty"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
 }
 
 // gpt request
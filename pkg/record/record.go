@@ -0,0 +1,219 @@
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yylt/gptmux/pkg"
+	"k8s.io/klog/v2"
+)
+
+const (
+	Chat       = "chat"
+	Completion = "completion"
+
+	maxLine = 16 * 1024 * 1024
+)
+
+// secretFields of request are not saved, the end-user identifier and
+// the credentials which clients may put in body
+var secretFields = []string{"user", "api_key", "apikey", "key", "token", "access_token", "password", "secret", "authorization"}
+
+// Conf of recorder, the exchanges are appended to file
+type Conf struct {
+	File string `yaml:"file,omitempty"`
+}
+
+// Record is one chat or completion exchange
+type Record struct {
+	Id       string          `json:"id"`
+	Time     time.Time       `json:"time"`
+	Endpoint string          `json:"endpoint"`
+	Model    string          `json:"model"`
+	Stream   bool            `json:"stream,omitempty"`
+	Request  json.RawMessage `json:"request,omitempty"`
+	// Prompt is the text sent to backend, used by replay to find the record
+	Prompt string `json:"prompt"`
+
+	Backend      string     `json:"backend,omitempty"`
+	Chunks       []*Chunk   `json:"chunks,omitempty"`
+	Text         string     `json:"text,omitempty"`
+	FinishReason string     `json:"finish_reason,omitempty"`
+	Errors       []*Failure `json:"errors,omitempty"`
+	Duration     int64      `json:"duration_ms"`
+
+	mu sync.Mutex
+}
+
+// Chunk is a streamed content, ms is the offset from the request start
+type Chunk struct {
+	Ms   int64  `json:"ms"`
+	Text string `json:"text"`
+}
+
+// Failure is a failed backend attempt
+type Failure struct {
+	Backend string    `json:"backend"`
+	Class   pkg.Class `json:"type"`
+	Message string    `json:"message"`
+}
+
+// Chunk record a streamed content
+func (r *Record) Chunk(text string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Chunks = append(r.Chunks, &Chunk{
+		Ms:   time.Since(r.Time).Milliseconds(),
+		Text: text,
+	})
+}
+
+// Fail record a failed backend, chunks of it are dropped,
+// so the replay does not serve a partial answer.
+func (r *Record) Fail(backend string, err error) {
+	if r == nil || err == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Chunks = nil
+	r.Errors = append(r.Errors, &Failure{
+		Backend: backend,
+		Class:   pkg.Classify(err),
+		Message: err.Error(),
+	})
+}
+
+// Done record the backend which answered
+func (r *Record) Done(backend, text, reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Backend = backend
+	r.Text = text
+	r.FinishReason = reason
+}
+
+// Recorder append records to a jsonl file
+type Recorder struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// New return nil when file is not configured
+func New(c *Conf) (*Recorder, error) {
+	if c == nil || c.File == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(c.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open record file failed: %v", err)
+	}
+	klog.Infof("record exchanges to %s", c.File)
+	return &Recorder{f: f}, nil
+}
+
+// Start return a record of request, or nil when recorder is off.
+// req is saved without the user and credential fields.
+func (rc *Recorder) Start(id, endpoint, model string, stream bool, prompt string, req any) *Record {
+	if rc == nil {
+		return nil
+	}
+	r := &Record{
+		Id:       id,
+		Time:     time.Now(),
+		Endpoint: endpoint,
+		Model:    model,
+		Stream:   stream,
+		Prompt:   prompt,
+	}
+	if bs, err := json.Marshal(req); err == nil {
+		r.Request = sanitize(bs)
+	}
+	return r
+}
+
+// Write append the record as one line
+func (rc *Recorder) Write(r *Record) {
+	if rc == nil || r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.Duration = time.Since(r.Time).Milliseconds()
+	bs, err := json.Marshal(r)
+	r.mu.Unlock()
+	if err != nil {
+		klog.Errorf("marshal record failed: %v", err)
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if _, err = rc.f.Write(append(bs, '\n')); err != nil {
+		klog.Errorf("write record failed: %v", err)
+	}
+}
+
+func (rc *Recorder) Close() error {
+	if rc == nil {
+		return nil
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.f.Close()
+}
+
+// Load read records of file, bad lines are skipped
+func Load(file string) ([]*Record, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var (
+		ret     []*Record
+		scanner = bufio.NewScanner(f)
+	)
+	scanner.Buffer(make([]byte, 64*1024), maxLine)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		r := &Record{}
+		if err = json.Unmarshal(scanner.Bytes(), r); err != nil {
+			klog.Warningf("record %s:%d is invalid: %v", file, n, err)
+			continue
+		}
+		ret = append(ret, r)
+	}
+	return ret, scanner.Err()
+}
+
+// sanitize drop the top-level secret fields of request, case insensitive,
+// the messages are saved as is.
+func sanitize(bs []byte) json.RawMessage {
+	var m map[string]any
+	if err := json.Unmarshal(bs, &m); err != nil {
+		return bs
+	}
+	for k := range m {
+		if slices.Contains(secretFields, strings.ToLower(k)) {
+			delete(m, k)
+		}
+	}
+	ret, err := json.Marshal(m)
+	if err != nil {
+		return bs
+	}
+	return ret
+}
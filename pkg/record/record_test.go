@@ -0,0 +1,85 @@
+package record
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yylt/gptmux/pkg"
+)
+
+func TestRecorder(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "records.jsonl")
+	rc, err := New(&Conf{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := map[string]any{"model": "gpt-4o", "user": "alice", "API_Key": "sk-x", "messages": []string{"hi"}}
+	r := rc.Start("chatcmpl-1", Chat, "gpt-4o", true, "hi", req)
+	r.Chunk("partial")
+	r.Fail("a", pkg.NewError(pkg.ClassUpstream, "a failed"))
+	r.Chunk("hel")
+	r.Chunk("lo")
+	r.Done("b", "hello", "stop")
+	rc.Write(r)
+	rc.Close()
+
+	// a bad line is skipped
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("{bad\n")
+	f.Close()
+
+	rs, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 {
+		t.Fatalf("loaded %d records, want 1", len(rs))
+	}
+	got := rs[0]
+	if got.Id != "chatcmpl-1" || got.Backend != "b" || got.Text != "hello" || got.FinishReason != "stop" || !got.Stream {
+		t.Errorf("loaded record %+v", got)
+	}
+	// the chunks of failed backend are dropped
+	if len(got.Chunks) != 2 || got.Chunks[0].Text != "hel" || got.Chunks[1].Text != "lo" {
+		t.Errorf("loaded chunks %v, want the chunks of b", got.Chunks)
+	}
+	if len(got.Errors) != 1 || got.Errors[0].Backend != "a" || got.Errors[0].Class != pkg.ClassUpstream {
+		t.Errorf("loaded errors %v", got.Errors)
+	}
+
+	// the user and credentials are not saved
+	var body map[string]any
+	if err = json.Unmarshal(got.Request, &body); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"user", "API_Key"} {
+		if _, ok := body[k]; ok {
+			t.Errorf("request field '%s' is saved", k)
+		}
+	}
+	if body["model"] != "gpt-4o" || body["messages"] == nil {
+		t.Errorf("request %s lost fields", got.Request)
+	}
+}
+
+func TestRecorderOff(t *testing.T) {
+	rc, err := New(nil)
+	if err != nil || rc != nil {
+		t.Fatalf("recorder without file %v, %v", rc, err)
+	}
+	// the nil recorder and record are no-op
+	r := rc.Start("id", Chat, "gpt-4o", false, "hi", nil)
+	r.Chunk("hi")
+	r.Fail("a", errors.New("failed"))
+	r.Done("a", "hi", "stop")
+	rc.Write(r)
+	if r != nil || rc.Close() != nil {
+		t.Error("nil recorder is not no-op")
+	}
+}
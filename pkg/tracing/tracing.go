@@ -0,0 +1,159 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yylt/gptmux/pkg"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
+)
+
+const (
+	ExporterOtlp   = "otlp"
+	ExporterStdout = "stdout"
+
+	defaultService = "gptmux"
+	scope          = "github.com/yylt/gptmux"
+
+	ModelKey    = attribute.Key("gptmux.model")
+	BackendKey  = attribute.Key("gptmux.backend")
+	UpstreamKey = attribute.Key("gptmux.upstream_model")
+	ClassKey    = attribute.Key("gptmux.error_class")
+)
+
+// Conf of tracing, endpoint is the host:port of an otlp http collector.
+// sample is the ratio of traced requests, 0 means all.
+type Conf struct {
+	Exporter string            `yaml:"exporter"`
+	Endpoint string            `yaml:"endpoint,omitempty"`
+	Insecure bool              `yaml:"insecure,omitempty"`
+	Headers  map[string]string `yaml:"headers,omitempty"`
+	Service  string            `yaml:"service,omitempty"`
+	Sample   float64           `yaml:"sample,omitempty"`
+}
+
+// Setup install the global tracer provider and propagator.
+// without config the tracer is noop, shutdown flush the pending spans.
+func Setup(ctx context.Context, c *Conf) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if c == nil || c.Exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	var exp sdktrace.SpanExporter
+	switch c.Exporter {
+	case ExporterOtlp:
+		opts := []otlptracehttp.Option{}
+		if c.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(c.Headers) != 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(c.Headers))
+		}
+		exp, err = otlptracehttp.New(ctx, opts...)
+	case ExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter '%s'", c.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create trace exporter failed: %v", err)
+	}
+	service := c.Service
+	if service == "" {
+		service = defaultService
+	}
+	sampler := sdktrace.AlwaysSample()
+	if c.Sample > 0 && c.Sample < 1 {
+		sampler = sdktrace.TraceIDRatioBased(c.Sample)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(service))),
+	)
+	otel.SetTracerProvider(tp)
+	klog.Infof("tracing enabled, exporter %s", c.Exporter)
+	return tp.Shutdown, nil
+}
+
+// Start a span of the global tracer
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(scope).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End the span, a failed one is marked with the error class.
+// io.EOF is the client gone after success.
+func End(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, io.EOF) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(ClassKey.String(string(pkg.Classify(err))))
+	}
+	span.End()
+}
+
+// Handler start the root span of request, the incoming trace context is continued
+func Handler(c *gin.Context) {
+	var (
+		ctx   = otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		route = c.FullPath()
+	)
+	if route == "" {
+		route = c.Request.URL.Path
+	}
+	ctx, span := otel.Tracer(scope).Start(ctx, c.Request.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(c.Request.Method),
+			semconv.HTTPRoute(route),
+		),
+	)
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// Transport inject the trace context into outbound requests
+func Transport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &transport{rt: rt}
+}
+
+type transport struct {
+	rt http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !trace.SpanContextFromContext(req.Context()).IsValid() {
+		return t.rt.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+	return t.rt.RoundTrip(req)
+}
@@ -0,0 +1,280 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yylt/gptmux/pkg"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	parentTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentSpan  = "00f067aa0ba902b7"
+)
+
+// setupTest install a tracer provider which keep the ended spans in memory
+func setupTest(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	if _, err := Setup(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	old := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(old)
+		tp.Shutdown(context.Background())
+	})
+	return exp
+}
+
+func attrs(s tracetest.SpanStub) map[attribute.Key]attribute.Value {
+	ret := map[attribute.Key]attribute.Value{}
+	for _, kv := range s.Attributes {
+		ret[kv.Key] = kv.Value
+	}
+	return ret
+}
+
+func TestRequestAndBackendSpans(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	exp := setupTest(t)
+
+	e := gin.New()
+	e.Use(Handler)
+	e.POST("/v1/chat/completions", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		trace.SpanFromContext(ctx).SetAttributes(ModelKey.String("gpt-4o"))
+
+		_, span := Start(ctx, "backend a", BackendKey.String("a"), UpstreamKey.String("qwen"))
+		End(span, pkg.NewError(pkg.ClassUpstream, "a failed"))
+		_, span = Start(ctx, "backend b", BackendKey.String("b"), UpstreamKey.String("gpt-4o"))
+		End(span, nil)
+		c.Status(http.StatusBadGateway)
+	})
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	req.Header.Set("traceparent", "00-"+parentTrace+"-"+parentSpan+"-01")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exp.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans, want 3", len(spans))
+	}
+	spanA, spanB, root := spans[0], spans[1], spans[2]
+
+	// the root span continue the incoming trace
+	if root.Name != "POST /v1/chat/completions" || root.SpanKind != trace.SpanKindServer {
+		t.Errorf("root span is '%s' kind %v", root.Name, root.SpanKind)
+	}
+	if got := root.SpanContext.TraceID().String(); got != parentTrace {
+		t.Errorf("root trace id %s, want %s", got, parentTrace)
+	}
+	if got := root.Parent.SpanID().String(); got != parentSpan {
+		t.Errorf("root parent span id %s, want %s", got, parentSpan)
+	}
+	ra := attrs(root)
+	for k, want := range map[attribute.Key]string{
+		ModelKey:                     "gpt-4o",
+		semconv.HTTPRouteKey:         "/v1/chat/completions",
+		semconv.HTTPRequestMethodKey: http.MethodPost,
+	} {
+		if got := ra[k].AsString(); got != want {
+			t.Errorf("root attribute %s is '%s', want '%s'", k, got, want)
+		}
+	}
+	if got := ra[semconv.HTTPResponseStatusCodeKey].AsInt64(); got != http.StatusBadGateway {
+		t.Errorf("root status code %d, want %d", got, http.StatusBadGateway)
+	}
+	if root.Status.Code != codes.Error {
+		t.Errorf("root status %v, want error", root.Status.Code)
+	}
+
+	// the backend spans are children of root, the failed one has the class
+	tests := []struct {
+		span     tracetest.SpanStub
+		backend  string
+		upstream string
+		class    string
+		code     codes.Code
+	}{
+		{spanA, "a", "qwen", string(pkg.ClassUpstream), codes.Error},
+		{spanB, "b", "gpt-4o", "", codes.Unset},
+	}
+	for _, tt := range tests {
+		if tt.span.Name != "backend "+tt.backend {
+			t.Errorf("backend span is '%s', want 'backend %s'", tt.span.Name, tt.backend)
+		}
+		if tt.span.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("backend '%s' parent %s, want %s", tt.backend, tt.span.Parent.SpanID(), root.SpanContext.SpanID())
+		}
+		a := attrs(tt.span)
+		if got := a[BackendKey].AsString(); got != tt.backend {
+			t.Errorf("backend attribute '%s', want '%s'", got, tt.backend)
+		}
+		if got := a[UpstreamKey].AsString(); got != tt.upstream {
+			t.Errorf("backend '%s' upstream '%s', want '%s'", tt.backend, got, tt.upstream)
+		}
+		if got := a[ClassKey].AsString(); got != tt.class {
+			t.Errorf("backend '%s' class '%s', want '%s'", tt.backend, got, tt.class)
+		}
+		if tt.span.Status.Code != tt.code {
+			t.Errorf("backend '%s' status %v, want %v", tt.backend, tt.span.Status.Code, tt.code)
+		}
+	}
+}
+
+func TestEndClientGone(t *testing.T) {
+	exp := setupTest(t)
+
+	_, span := Start(context.Background(), "backend a")
+	End(span, io.EOF)
+
+	spans := exp.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	if spans[0].Status.Code != codes.Unset || len(spans[0].Events) != 0 {
+		t.Errorf("span of client gone is marked failed: %v", spans[0].Status)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	setupTest(t)
+
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+
+	ctx, span := Start(context.Background(), "backend a")
+	defer span.End()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: Transport(nil)}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	sc := span.SpanContext()
+	want := "00-" + sc.TraceID().String() + "-" + sc.SpanID().String() + "-01"
+	if got != want {
+		t.Errorf("traceparent '%s', want '%s'", got, want)
+	}
+}
+
+// collector is an otlp http receiver which keep the exported spans
+type collector struct {
+	mu       sync.Mutex
+	spans    []*tracepb.Span
+	services []string
+}
+
+func (col *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	req := &coltracepb.ExportTraceServiceRequest{}
+	if err == nil {
+		err = proto.Unmarshal(body, req)
+	}
+	if r.URL.Path != "/v1/traces" || err != nil {
+		http.Error(w, "bad export", http.StatusBadRequest)
+		return
+	}
+	col.mu.Lock()
+	for _, rs := range req.ResourceSpans {
+		for _, kv := range rs.GetResource().GetAttributes() {
+			if kv.Key == string(semconv.ServiceNameKey) {
+				col.services = append(col.services, kv.GetValue().GetStringValue())
+			}
+		}
+		for _, ss := range rs.ScopeSpans {
+			col.spans = append(col.spans, ss.Spans...)
+		}
+	}
+	col.mu.Unlock()
+	bs, _ := proto.Marshal(&coltracepb.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(bs)
+}
+
+func TestSetupOtlp(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	col := &collector{}
+	srv := httptest.NewServer(col)
+	defer srv.Close()
+
+	old := otel.GetTracerProvider()
+	defer otel.SetTracerProvider(old)
+	shutdown, err := Setup(context.Background(), &Conf{
+		Exporter: ExporterOtlp,
+		Endpoint: strings.TrimPrefix(srv.URL, "http://"),
+		Insecure: true,
+		Service:  "gptmux-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := gin.New()
+	e.Use(Handler)
+	e.POST("/v1/chat/completions", func(c *gin.Context) {
+		_, span := Start(c.Request.Context(), "backend a", BackendKey.String("a"))
+		End(span, pkg.NewError(pkg.ClassUpstream, "a failed"))
+		c.Status(http.StatusBadGateway)
+	})
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil))
+	// shutdown flush the batched spans to the collector
+	if err = shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	if len(col.services) == 0 || col.services[0] != "gptmux-test" {
+		t.Errorf("exported services %v, want gptmux-test", col.services)
+	}
+	spans := map[string]*tracepb.Span{}
+	for _, s := range col.spans {
+		spans[s.Name] = s
+	}
+	root, backend := spans["POST /v1/chat/completions"], spans["backend a"]
+	if root == nil || backend == nil {
+		t.Fatalf("exported spans %v, want the root and backend spans", col.spans)
+	}
+	if root.Kind != tracepb.Span_SPAN_KIND_SERVER {
+		t.Errorf("root span kind %v, want server", root.Kind)
+	}
+	if string(backend.ParentSpanId) != string(root.SpanId) || string(backend.TraceId) != string(root.TraceId) {
+		t.Error("backend span is not the child of root span")
+	}
+	if backend.GetStatus().GetCode() != tracepb.Status_STATUS_CODE_ERROR {
+		t.Errorf("backend span status %v, want error", backend.GetStatus().GetCode())
+	}
+	got := map[string]string{}
+	for _, kv := range backend.Attributes {
+		got[kv.Key] = kv.GetValue().GetStringValue()
+	}
+	if got[string(BackendKey)] != "a" || got[string(ClassKey)] != string(pkg.ClassUpstream) {
+		t.Errorf("backend span attributes %v", got)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"time"
+
+	"github.com/yylt/gptmux/pkg/tracing"
 )
 
 type logTransport struct {
@@ -30,10 +32,10 @@ func NewDebugHTTPClient(proxy string, debug bool) *http.Client {
 		tr.Proxy = http.ProxyURL(proxy)
 	}
 	return &http.Client{
-		Transport: &logTransport{
+		Transport: tracing.Transport(&logTransport{
 			tr:    tr,
 			debug: debug,
-		},
+		}),
 	}
 }
 
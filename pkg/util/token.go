@@ -0,0 +1,25 @@
+package util
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// EstimateTokens return the approximate token count of s,
+// a cjk character is one token, other text is about four bytes per token.
+func EstimateTokens(s string) int {
+	var (
+		cjk   int
+		other int
+	)
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		s = s[size:]
+		if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) {
+			cjk++
+			continue
+		}
+		other += size
+	}
+	return cjk + (other+3)/4
+}
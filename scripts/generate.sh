@@ -25,3 +25,5 @@ useless_file=(
 
 sudo rm -rf "${useless_file[@]}"
 
+# model ids may contain "/"
+sed -i 's#"/v1/models/:model"#"/v1/models/*model"#' api/go/routers.go